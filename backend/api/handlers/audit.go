@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const DEFAULT_AUDIT_LOG_LIMIT = 100
+
+// recordAudit writes an audit log entry for the request's user.
+func recordAudit(conn *gorm.DB, c *gin.Context, action, resourceID, status, details string) {
+	entry := &db.AuditLog{
+		Username:   c.GetString("FullUserName"),
+		Action:     action,
+		ResourceID: resourceID,
+		Details:    details,
+		Status:     status,
+		ClientIP:   c.ClientIP(),
+	}
+	if err := db.CreateAuditLog(conn, entry); err != nil {
+		log.Printf("Unable to write audit log: %v", err)
+	}
+}
+
+// Audited records an audit log entry for every request to the route once
+// its handler ran, as failed when the handler responded with an error.
+func Audited(conn *gorm.DB, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		status := "allowed"
+		if c.Writer.Status() >= http.StatusBadRequest {
+			status = "failed"
+		}
+		var resourceID string
+		for _, param := range []string{"backup_id", "restore_id", "stream_id", "schedule_id", "filename", "connection_id", "destination_id"} {
+			if resourceID = c.Query(param); resourceID != "" {
+				break
+			}
+		}
+		recordAudit(conn, c, action, resourceID, status, fmt.Sprintf("HTTP %d", c.Writer.Status()))
+	}
+}
+
+func ListAuditLogs(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListAuditLogs handler called")
+		filters := make(map[string]interface{})
+		if username := c.Query("username"); username != "" {
+			filters["username"] = username
+		}
+		if action := c.Query("action"); action != "" {
+			filters["action"] = action
+		}
+		limit := DEFAULT_AUDIT_LOG_LIMIT
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid limit parameter",
+				})
+				return
+			}
+			limit = parsed
+		}
+
+		logs, err := db.ListAuditLogs(conn, filters, limit)
+		if err != nil {
+			log.Printf("Error listing audit logs: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to list audit logs",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    logs,
+			"count":   len(logs),
+		})
+	}
+}
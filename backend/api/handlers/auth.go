@@ -38,6 +38,12 @@ func CreateUser(conn *gorm.DB) gin.HandlerFunc {
 		}
 		log.Printf("Password hashed successfully for user: %s", r.Username)
 		r.Password = hashedPassword
+		// Anyone can sign up, so only the first user becomes an admin; admins
+		// grant other roles through /user/role.
+		r.Role = db.RoleUser
+		if admins, err := db.CountUsersWithRole(conn, db.RoleAdmin); err == nil && admins == 0 {
+			r.Role = db.RoleAdmin
+		}
 		err = db.CreateUser(conn, r)
 		if err != nil {
 			log.Printf("Error creating user in database: %v", err)
@@ -133,3 +139,54 @@ func ListUsers(conn *gorm.DB) gin.HandlerFunc {
 		})
 	}
 }
+
+type UpdateUserRoleRequest struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+func UpdateUserRole(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("UpdateUserRole handler called")
+		var r UpdateUserRoleRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		switch r.Role {
+		case db.RoleAdmin, db.RoleOperator, db.RoleUser:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": fmt.Sprintf("Unknown role %s", r.Role),
+			})
+			return
+		}
+		if r.Username == c.GetString("FullUserName") && r.Role != db.RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Admins cannot take away their own admin role",
+			})
+			return
+		}
+
+		if err := db.UpdateUserRole(conn, r.Username, r.Role); err != nil {
+			log.Printf("Error updating role of user %s: %v", r.Username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to update role",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "user.role", r.Username, "allowed", r.Role)
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": fmt.Sprintf("User %s is now %s", r.Username, r.Role),
+		})
+	}
+}
@@ -1,23 +1,57 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	backup_manager "pg_bckup_mgr/backup-manager"
 	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type CreateBackupRequest struct {
-	DatabaseId  string `json:"database_id"`
-	Destination string `json:"backup_destination"`
+	DatabaseId  string                       `json:"database_id"`
+	Destination string                       `json:"backup_destination"`
+	BackupType  string                       `json:"backup_type"`
+	Options     backup_manager.BackupOptions `json:"options"`
+	Copies      []backup_manager.CopyTarget  `json:"copy_destinations"` // further destinations the backup is copied to
+	Async       bool                         `json:"async"`             // respond with the job right away, see /jobs/stream
 }
 type RestoreFromBackupRequest struct {
-	DatabaseId  string `json:"database_id"`
-	Destination string `json:"backup_destination"`
-	Filename    string `json:"backup_filename"`
+	DatabaseId      string `json:"database_id"`
+	Destination     string `json:"backup_destination"`
+	Filename        string `json:"backup_filename"`
+	WithGlobals     bool   `json:"with_globals"`
+	GlobalsFilename string `json:"globals_filename"`
+
+	TargetDatabaseId string            `json:"target_database_id"`
+	TargetDBName     string            `json:"target_db_name"`
+	CreateDatabase   bool              `json:"create_database"`
+	NoOwner          bool              `json:"no_owner"`
+	NoPrivileges     bool              `json:"no_privileges"`
+	RoleMapping      map[string]string `json:"role_mapping"`
+	TocEntries       []int             `json:"toc_entries"`
+	SafetyBackup     *bool             `json:"safety_backup"` // back up the target first, default true
+
+	TerminateSessions bool `json:"terminate_sessions"`
+	SingleTransaction bool `json:"single_transaction"`
+	ExitOnError       bool `json:"exit_on_error"`
+	Jobs              int  `json:"jobs"`
+
+	Staging           bool `json:"staging"`
+	KeepPreviousHours int  `json:"keep_previous_hours"`
+
+	Async bool `json:"async"` // respond with the job right away, see /jobs/stream
+}
+type RestorePhysicalBackupRequest struct {
+	DatabaseId    string `json:"database_id"`
+	Destination   string `json:"backup_destination"`
+	Filename      string `json:"backup_filename"`
+	DataDirectory string `json:"data_directory" binding:"required"`
 }
 
 func CreateBackup(conn *gorm.DB) gin.HandlerFunc {
@@ -34,7 +68,32 @@ func CreateBackup(conn *gorm.DB) gin.HandlerFunc {
 			})
 			return
 		}
-		log.Printf("CreateBackup request: DatabaseId=%s, Destination=%s", r.DatabaseId, r.Destination)
+		log.Printf("CreateBackup request: DatabaseId=%s, Destination=%s, BackupType=%s", r.DatabaseId, r.Destination, r.BackupType)
+		backupType, err := backup_manager.ParseBackupType(r.BackupType)
+		if err != nil {
+			log.Printf("Invalid backup type in CreateBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := r.Options.Normalize(); err != nil {
+			log.Printf("Invalid backup options in CreateBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := backup_manager.ValidateCopyTargets(conn, r.Copies); err != nil {
+			log.Printf("Invalid copy destinations in CreateBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
 		creds, err := db.GetCredentialsById(conn, r.DatabaseId)
 		if err != nil {
 			log.Printf("Error getting credentials in CreateBackup: %v", err)
@@ -67,9 +126,29 @@ func CreateBackup(conn *gorm.DB) gin.HandlerFunc {
 			User:              creds.PostgresUser,
 			Password:          creds.PostgresPassword,
 			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
+			Copies:            r.Copies,
 		}
 		log.Printf("BackupManager initialized for %s@%s:%s/%s", creds.PostgresUser, creds.PostgresHost, creds.PostgresPort, creds.PostgresDBName)
-		err = bckupManager.CreateBackup(backup_manager.BackupDestination(r.Destination))
+		if r.Async {
+			job := backup_manager.NewJob("backup", fmt.Sprintf("%s backup of %s to %s", backupType, creds.PostgresDBName, r.Destination))
+			bckupManager.Job = job
+			go func() {
+				err := bckupManager.CreateBackup(backup_manager.BackupDestination(r.Destination), backupType, r.Options)
+				if err != nil {
+					log.Printf("Error creating backup: %v", err)
+				}
+				job.Finish(err)
+			}()
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":  http.StatusAccepted,
+				"message": "Backup started",
+				"data":    job,
+			})
+			return
+		}
+		err = bckupManager.CreateBackup(backup_manager.BackupDestination(r.Destination), backupType, r.Options)
 		if err != nil {
 			log.Printf("Error creating backup: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -125,6 +204,8 @@ func ListBackups(conn *gorm.DB) gin.HandlerFunc {
 			User:              creds.PostgresUser,
 			Password:          creds.PostgresPassword,
 			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
 		}
 		log.Printf("BackupManager initialized for listing backups")
 		files := bckupManager.ListAvaiableBackups(backup_manager.BackupDestination(backupDestination))
@@ -137,6 +218,71 @@ func ListBackups(conn *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+func ListBackupContents(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListBackupContents handler called")
+		var destination *db.Destination
+		databaseId := c.Query("database_id")
+		backupDestination := c.Query("backup_destination")
+		filename := c.Query("backup_filename")
+		log.Printf("ListBackupContents request: DatabaseId=%s, Destination=%s, Filename=%s", databaseId, backupDestination, filename)
+		if filename == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "backup_filename is required",
+			})
+			return
+		}
+		creds, err := db.GetCredentialsById(conn, databaseId)
+		if err != nil {
+			log.Printf("Error getting credentials in ListBackupContents: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		if backupDestination != "local" {
+			dest, err := db.GetBackupDestinationByID(conn, backupDestination)
+			if err != nil {
+				log.Printf("Error getting backup destination in ListBackupContents: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": err.Error(),
+				})
+				return
+			}
+			destination = &dest
+			backupDestination = "s3"
+		}
+		bckupManager := backup_manager.BackupManager{
+			Host:              creds.PostgresHost,
+			Port:              creds.PostgresPort,
+			DBName:            creds.PostgresDBName,
+			User:              creds.PostgresUser,
+			Password:          creds.PostgresPassword,
+			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
+		}
+		entries, err := bckupManager.ListBackupContents(backup_manager.BackupDestination(backupDestination), filename)
+		if err != nil {
+			log.Printf("Error listing backup contents: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    entries,
+			"count":   len(entries),
+		})
+	}
+}
+
 func RestoreFromBackup(conn *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log.Println("RestoreFromBackup handler called")
@@ -184,14 +330,69 @@ func RestoreFromBackup(conn *gorm.DB) gin.HandlerFunc {
 			User:              creds.PostgresUser,
 			Password:          creds.PostgresPassword,
 			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
+		}
+		restoreOpts := backup_manager.RestoreOptions{
+			WithGlobals:     r.WithGlobals,
+			GlobalsFilename: r.GlobalsFilename,
+			TargetDBName:    r.TargetDBName,
+			CreateDatabase:  r.CreateDatabase,
+			NoOwner:         r.NoOwner,
+			NoPrivileges:    r.NoPrivileges,
+			RoleMapping:     r.RoleMapping,
+			TocEntries:      r.TocEntries,
+
+			TerminateSessions: r.TerminateSessions,
+			SingleTransaction: r.SingleTransaction,
+			ExitOnError:       r.ExitOnError,
+			Jobs:              r.Jobs,
+
+			Staging:      r.Staging,
+			KeepPrevious: time.Duration(r.KeepPreviousHours) * time.Hour,
+		}
+		if r.SafetyBackup != nil && !*r.SafetyBackup {
+			restoreOpts.SkipSafetyBackup = true
+		}
+		if r.TargetDatabaseId != "" {
+			target, err := db.GetCredentialsById(conn, r.TargetDatabaseId)
+			if err != nil {
+				log.Printf("Error getting target credentials in RestoreFromBackup: %v", err)
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Target connection not found",
+					"error":   err.Error(),
+				})
+				return
+			}
+			restoreOpts.Target = &target
+			log.Printf("Restoring into target connection: %s@%s:%s", target.PostgresUser, target.PostgresHost, target.PostgresPort)
 		}
 		log.Printf("BackupManager initialized for restore from %s", r.Destination)
-		err = bckupManager.RestoreFromBackup(backup_manager.BackupDestination(r.Destination), r.Filename)
+		if r.Async {
+			job := backup_manager.NewJob("restore", fmt.Sprintf("restore of %s from %s", r.Filename, r.Destination))
+			bckupManager.Job = job
+			go func() {
+				_, err := bckupManager.RestoreFromBackup(backup_manager.BackupDestination(r.Destination), r.Filename, restoreOpts)
+				if err != nil {
+					log.Printf("Error restoring from backup: %v", err)
+				}
+				job.Finish(err)
+			}()
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":  http.StatusAccepted,
+				"message": "Restore started",
+				"data":    job,
+			})
+			return
+		}
+		report, err := bckupManager.RestoreFromBackup(backup_manager.BackupDestination(r.Destination), r.Filename, restoreOpts)
 		if err != nil {
 			log.Printf("Error restoring from backup: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status":  http.StatusInternalServerError,
 				"message": err.Error(),
+				"data":    report,
 			})
 			return
 		}
@@ -199,6 +400,7 @@ func RestoreFromBackup(conn *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{
 			"status":  http.StatusOK,
 			"message": "OK",
+			"data":    report,
 		})
 	}
 }
@@ -259,6 +461,8 @@ func DeleteBackup(conn *gorm.DB) gin.HandlerFunc {
 			User:              creds.PostgresUser,
 			Password:          creds.PostgresPassword,
 			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
 		}
 		log.Printf("BackupManager initialized for delete from %s", backupDestination)
 		err = bckupManager.DeleteBackup(backup_manager.BackupDestination(backupDestination), filename)
@@ -277,3 +481,109 @@ func DeleteBackup(conn *gorm.DB) gin.HandlerFunc {
 		})
 	}
 }
+
+func RestorePhysicalBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("RestorePhysicalBackup handler called")
+		var destination *db.Destination
+		var r RestorePhysicalBackupRequest
+		err := c.ShouldBindJSON(&r)
+		if err != nil {
+			log.Printf("Error binding JSON in RestorePhysicalBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
+		log.Printf("RestorePhysicalBackup request: DatabaseId=%s, Destination=%s, Filename=%s, DataDirectory=%s", r.DatabaseId, r.Destination, r.Filename, r.DataDirectory)
+		creds, err := db.GetCredentialsById(conn, r.DatabaseId)
+		if err != nil {
+			log.Printf("Error getting credentials in RestorePhysicalBackup: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		if r.Destination != "local" {
+			dest, err := db.GetBackupDestinationByID(conn, r.Destination)
+			if err != nil {
+				log.Printf("Error getting backup destination in RestorePhysicalBackup: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": err.Error(),
+				})
+				return
+			}
+			destination = &dest
+			r.Destination = "s3"
+		}
+		bckupManager := backup_manager.BackupManager{
+			Host:              creds.PostgresHost,
+			Port:              creds.PostgresPort,
+			DBName:            creds.PostgresDBName,
+			User:              creds.PostgresUser,
+			Password:          creds.PostgresPassword,
+			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
+		}
+		err = bckupManager.PreparePhysicalRestore(backup_manager.BackupDestination(r.Destination), r.Filename, r.DataDirectory)
+		if err != nil {
+			log.Printf("Error preparing physical restore: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		log.Printf("Data directory %s prepared from backup: %s", r.DataDirectory, r.Filename)
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+		})
+	}
+}
+
+func ListBackupCatalog(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListBackupCatalog handler called")
+		filters := make(map[string]interface{})
+		if databaseId := c.Query("database_id"); databaseId != "" {
+			id, err := strconv.ParseUint(databaseId, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid database_id parameter",
+				})
+				return
+			}
+			filters["connection_id"] = uint(id)
+		}
+		if backupType := c.Query("backup_type"); backupType != "" {
+			filters["backup_type"] = backupType
+		}
+		if status := c.Query("status"); status != "" {
+			filters["status"] = status
+		}
+		if validation := c.Query("validation"); validation != "" {
+			filters["validation"] = validation
+		}
+		backups, err := db.ListBackupRecords(conn, filters)
+		if err != nil {
+			log.Printf("Error listing backup catalog: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    backups,
+			"count":   len(backups),
+		})
+	}
+}
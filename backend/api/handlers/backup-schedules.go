@@ -12,15 +12,29 @@ import (
 )
 
 type CreateScheduleRequest struct {
-	ConnectionID  string `json:"connection_id" binding:"required"`
-	DestinationID string `json:"destination_id" binding:"required"`
-	Schedule      string `json:"schedule" binding:"required"`
+	ConnectionID       string                       `json:"connection_id" binding:"required"`
+	DestinationID      string                       `json:"destination_id" binding:"required"`
+	Schedule           string                       `json:"schedule" binding:"required"`
+	BackupType         string                       `json:"backup_type"`
+	FullBackupEvery    int                          `json:"full_backup_every"`
+	RetentionCount     int                          `json:"retention_count"`
+	Options            backup_manager.BackupOptions `json:"options"`
+	VerifyConnectionID *uint                        `json:"verify_connection_id"`
+	VerifyAssertions   []string                     `json:"verify_assertions"`
+	CopyDestinations   []backup_manager.CopyTarget  `json:"copy_destinations"` // further destinations every backup is copied to
 }
 type UpdateScheduleRequest struct {
-	Schedule      *string `json:"schedule,omitempty"`
-	Enabled       *bool   `json:"enabled,omitempty"`
-	ConnectionID  *string `json:"connection_id,omitempty"`
-	DestinationID *string `json:"destination_id,omitempty"`
+	Schedule           *string                       `json:"schedule,omitempty"`
+	Enabled            *bool                         `json:"enabled,omitempty"`
+	ConnectionID       *string                       `json:"connection_id,omitempty"`
+	DestinationID      *string                       `json:"destination_id,omitempty"`
+	BackupType         *string                       `json:"backup_type,omitempty"`
+	FullBackupEvery    *int                          `json:"full_backup_every,omitempty"`
+	RetentionCount     *int                          `json:"retention_count,omitempty"`
+	Options            *backup_manager.BackupOptions `json:"options,omitempty"`
+	VerifyConnectionID *uint                         `json:"verify_connection_id,omitempty"`
+	VerifyAssertions   []string                      `json:"verify_assertions,omitempty"`
+	CopyDestinations   *[]backup_manager.CopyTarget  `json:"copy_destinations,omitempty"` // an empty list stops copying
 }
 
 func CreateSchedule(conn *gorm.DB) gin.HandlerFunc {
@@ -59,7 +73,15 @@ func CreateSchedule(conn *gorm.DB) gin.HandlerFunc {
 			})
 			return
 		}
-		err = backup_manager.CreateSchedule(conn, r.ConnectionID, r.DestinationID, r.Schedule)
+		err = backup_manager.CreateSchedule(conn, r.ConnectionID, r.DestinationID, r.Schedule, backup_manager.ScheduleOptions{
+			BackupType:         backup_manager.BackupType(r.BackupType),
+			FullBackupEvery:    r.FullBackupEvery,
+			RetentionCount:     r.RetentionCount,
+			Dump:               r.Options,
+			VerifyConnectionID: r.VerifyConnectionID,
+			VerifyAssertions:   r.VerifyAssertions,
+			Copies:             r.CopyDestinations,
+		})
 		if err != nil {
 			log.Printf("Error creating schedule: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -107,6 +129,34 @@ func UpdateSchedule(conn *gorm.DB) gin.HandlerFunc {
 			updates["schedule"] = *r.Schedule
 			log.Printf("Updating schedule to: %s", *r.Schedule)
 		}
+		if r.BackupType != nil {
+			updates["backup_type"] = *r.BackupType
+			log.Printf("Updating backup_type to: %s", *r.BackupType)
+		}
+		if r.FullBackupEvery != nil {
+			updates["full_backup_every"] = *r.FullBackupEvery
+			log.Printf("Updating full_backup_every to: %d", *r.FullBackupEvery)
+		}
+		if r.RetentionCount != nil {
+			updates["retention_count"] = *r.RetentionCount
+			log.Printf("Updating retention_count to: %d", *r.RetentionCount)
+		}
+		if r.Options != nil {
+			updates["options"] = *r.Options
+			log.Printf("Updating options to: %s", r.Options)
+		}
+		if r.VerifyConnectionID != nil {
+			updates["verify_connection_id"] = *r.VerifyConnectionID
+			log.Printf("Updating verify_connection_id to: %d", *r.VerifyConnectionID)
+		}
+		if r.VerifyAssertions != nil {
+			updates["verify_assertions"] = r.VerifyAssertions
+			log.Printf("Updating verify_assertions to: %v", r.VerifyAssertions)
+		}
+		if r.CopyDestinations != nil {
+			updates["copy_destinations"] = *r.CopyDestinations
+			log.Printf("Updating copy_destinations to: %v", *r.CopyDestinations)
+		}
 		if r.Enabled != nil {
 			updates["enabled"] = *r.Enabled
 			log.Printf("Updating enabled to: %v", *r.Enabled)
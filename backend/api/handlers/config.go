@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// MAX_CONFIG_IMPORT_SIZE limits uploaded configuration exports.
+const MAX_CONFIG_IMPORT_SIZE = 32 << 20
+
+type ExportConfigRequest struct {
+	Passphrase string `json:"passphrase" binding:"required"` // encrypts the secrets of the export
+}
+
+func ExportConfig(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ExportConfig handler called")
+		var r ExportConfigRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		export, err := backup_manager.ExportConfig(conn, r.Passphrase)
+		if err != nil {
+			log.Printf("Error exporting configuration: %v", err)
+			recordAudit(conn, c, "config.export", "", "failed", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Export failed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "config.export", "", "allowed", "")
+
+		filename := fmt.Sprintf("pg_bckup_mgr-config_%s.json", time.Now().Format("20060102_150405"))
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.IndentedJSON(http.StatusOK, export)
+	}
+}
+
+func ImportConfig(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ImportConfig handler called")
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "file is required",
+				"error":   err.Error(),
+			})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Unable to read upload",
+				"error":   err.Error(),
+			})
+			return
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, MAX_CONFIG_IMPORT_SIZE))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Unable to read upload",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		report, err := backup_manager.ImportConfig(conn, data, c.PostForm("passphrase"))
+		if err != nil {
+			log.Printf("Error importing configuration: %v", err)
+			recordAudit(conn, c, "config.import", "", "failed", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Import failed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "config.import", "", "allowed", fmt.Sprintf("%v", report.Created))
+
+		// Pick up the imported schedules and WAL streams.
+		backup_manager.RestartBackupScheduler(conn)
+		backup_manager.StartWalStreams(conn)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    report,
+		})
+	}
+}
+
+// ApplyConfig applies a YAML configuration file sent as the request body.
+// With plan=true it only returns the changes, with prune=true it also
+// deletes what the file does not declare, and with force=true also the
+// connections and destinations that still have backups. Secrets are only read from the
+// places set aside for them, see backup_manager.SecretRef.
+func ApplyConfig(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ApplyConfig handler called")
+		planOnly := c.Query("plan") == "true"
+		opts := backup_manager.ApplyOptions{
+			Prune:  c.Query("prune") == "true",
+			Force:  c.Query("force") == "true",
+			Remote: true,
+		}
+
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, MAX_CONFIG_IMPORT_SIZE))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Unable to read request body",
+				"error":   err.Error(),
+			})
+			return
+		}
+		config, err := backup_manager.LoadDeclaredConfig(data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid configuration file",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		if planOnly {
+			plan, err := backup_manager.PlanConfig(conn, config, opts)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid configuration",
+					"error":   err.Error(),
+					"data":    plan,
+				})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"status":  http.StatusOK,
+				"message": "OK",
+				"data":    plan,
+			})
+			return
+		}
+
+		plan, err := backup_manager.ApplyConfig(conn, config, opts)
+		if err != nil {
+			log.Printf("Error applying configuration: %v", err)
+			recordAudit(conn, c, "config.apply", "", "failed", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Apply failed, nothing was changed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "config.apply", "", "allowed", fmt.Sprintf("%d changes, prune=%t", len(plan.Changes), opts.Prune))
+		backup_manager.RestartBackupScheduler(conn)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    plan,
+		})
+	}
+}
+
+func CreateSelfBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("CreateSelfBackup handler called")
+		job := backup_manager.NewJob("self-backup", "backup of the manager's database")
+		filename, err := backup_manager.CreateSelfBackup(conn, job)
+		job.Finish(err)
+		if err != nil {
+			log.Printf("Error creating self-backup: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Self-backup failed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    filename,
+		})
+	}
+}
+
+func ListSelfBackups(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListSelfBackups handler called")
+		names, err := backup_manager.ListSelfBackups(conn)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Unable to list self-backups",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    names,
+			"count":   len(names),
+		})
+	}
+}
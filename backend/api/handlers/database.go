@@ -54,7 +54,7 @@ func CreateConnection(conn *gorm.DB) gin.HandlerFunc {
 			PostgresPassword: encryptedPassword,
 		}
 		if testFlag == "true" {
-			if !db.TestConnection(connection) {
+			if !db.TestConnection(&connection) {
 				c.JSON(http.StatusRequestTimeout, gin.H{
 					"status":  http.StatusRequestTimeout,
 					"message": "failed to create connection",
@@ -65,10 +65,14 @@ func CreateConnection(conn *gorm.DB) gin.HandlerFunc {
 				c.JSON(http.StatusOK, gin.H{
 					"status":  http.StatusOK,
 					"message": "Conection Test successful",
+					"data":    gin.H{"server_version": connection.ServerVersion},
 				})
 				return
 			}
 		}
+		// The version picks the client binaries; an unreachable server gets
+		// it recorded on first use.
+		probeErr := db.ProbeConnection(&connection)
 		err = db.AddCredentials(conn, connection)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -78,11 +82,15 @@ func CreateConnection(conn *gorm.DB) gin.HandlerFunc {
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"status":  http.StatusOK,
 			"message": "connection created successfully",
 			"data":    connection,
-		})
+		}
+		if probeErr != nil {
+			response["warning"] = "the database could not be reached: " + probeErr.Error()
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
@@ -152,6 +160,7 @@ func UpdateConnection(conn *gorm.DB) gin.HandlerFunc {
 			}
 			connection.PostgresPassword = encryptedPassword
 		}
+		probeErr := db.ProbeConnection(&connection)
 		err = db.UpdateCredentials(conn, connection)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -161,11 +170,15 @@ func UpdateConnection(conn *gorm.DB) gin.HandlerFunc {
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"status":  http.StatusOK,
 			"message": "connection updated successfully",
 			"data":    connection,
-		})
+		}
+		if probeErr != nil {
+			response["warning"] = "the database could not be reached: " + probeErr.Error()
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
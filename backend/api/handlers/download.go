@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func DownloadBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("DownloadBackup handler called")
+		backupID := c.Query("backup_id")
+		if _, err := strconv.ParseUint(backupID, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid backup_id parameter",
+			})
+			return
+		}
+		backup, err := db.GetBackupRecordByID(conn, backupID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Backup not found",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		details := backup.Filename
+		if rng := c.GetHeader("Range"); rng != "" {
+			details = fmt.Sprintf("%s %s", backup.Filename, rng)
+		}
+		if err := backup_manager.ServeBackup(conn, backup, c.Writer, c.Request); err != nil {
+			log.Printf("Error downloading backup %s: %v", backupID, err)
+			recordAudit(conn, c, "backup.download", backupID, "failed", details)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Download failed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "backup.download", backupID, "allowed", details)
+	}
+}
+
+func PresignBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("PresignBackup handler called")
+		backupID := c.Query("backup_id")
+		if _, err := strconv.ParseUint(backupID, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid backup_id parameter",
+			})
+			return
+		}
+		var ttl time.Duration
+		if value := c.Query("expires_in"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid expires_in parameter",
+				})
+				return
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+		backup, err := db.GetBackupRecordByID(conn, backupID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Backup not found",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		url, expiresAt, err := backup_manager.PresignBackup(conn, backup, ttl)
+		if err != nil {
+			log.Printf("Error presigning backup %s: %v", backupID, err)
+			recordAudit(conn, c, "backup.presign", backupID, "failed", err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Unable to create download URL",
+				"error":   err.Error(),
+			})
+			return
+		}
+		recordAudit(conn, c, "backup.presign", backupID, "allowed",
+			fmt.Sprintf("%s, expires %s", backup.Filename, expiresAt.Format(time.RFC3339)))
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data": gin.H{
+				"url":        url,
+				"expires_at": expiresAt,
+			},
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateHookRequest struct {
+	ConnectionID   string `json:"connection_id" binding:"required"`
+	ScheduleID     *uint  `json:"schedule_id"`
+	Name           string `json:"name" binding:"required"`
+	Stage          string `json:"stage" binding:"required"`
+	Kind           string `json:"kind" binding:"required"`
+	Command        string `json:"command" binding:"required"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	AbortOnFailure *bool  `json:"abort_on_failure"` // default true
+	Position       int    `json:"position"`
+}
+type UpdateHookRequest struct {
+	Name           *string `json:"name,omitempty"`
+	Stage          *string `json:"stage,omitempty"`
+	Kind           *string `json:"kind,omitempty"`
+	Command        *string `json:"command,omitempty"`
+	TimeoutSeconds *int    `json:"timeout_seconds,omitempty"`
+	AbortOnFailure *bool   `json:"abort_on_failure,omitempty"`
+	Position       *int    `json:"position,omitempty"`
+	Enabled        *bool   `json:"enabled,omitempty"`
+}
+
+func CreateHook(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("CreateHook handler called")
+		var r CreateHookRequest
+		err := c.ShouldBindJSON(&r)
+		if err != nil {
+			log.Printf("Error binding JSON in CreateHook: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		connection, err := db.GetCredentialsById(conn, r.ConnectionID)
+		if err != nil {
+			log.Printf("Error getting connection in CreateHook: %v", err)
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Connection not found",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if r.ScheduleID != nil {
+			schedule, err := backup_manager.GetScheduleByID(conn, strconv.FormatUint(uint64(*r.ScheduleID), 10))
+			if err != nil || schedule.ConnectionID != connection.ID {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Schedule not found for this connection",
+				})
+				return
+			}
+		}
+
+		hook := db.Hook{
+			ConnectionID:   connection.ID,
+			ScheduleID:     r.ScheduleID,
+			Name:           r.Name,
+			Stage:          r.Stage,
+			Kind:           r.Kind,
+			Command:        r.Command,
+			TimeoutSeconds: r.TimeoutSeconds,
+			AbortOnFailure: r.AbortOnFailure == nil || *r.AbortOnFailure,
+			Position:       r.Position,
+			Enabled:        true,
+		}
+		if err := backup_manager.ValidateHook(&hook); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid hook",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if err := db.CreateHook(conn, &hook); err != nil {
+			log.Printf("Error creating hook: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to create hook",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "Hook created successfully",
+			"data":    hook,
+		})
+	}
+}
+
+func ListHooks(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListHooks handler called")
+		filters := make(map[string]interface{})
+		for _, param := range []string{"connection_id", "schedule_id"} {
+			if value := c.Query(param); value != "" {
+				id, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"status":  http.StatusBadRequest,
+						"message": "Invalid " + param + " parameter",
+					})
+					return
+				}
+				filters[param] = uint(id)
+			}
+		}
+		if stage := c.Query("stage"); stage != "" {
+			filters["stage"] = stage
+		}
+		hooks, err := db.ListHooks(conn, filters)
+		if err != nil {
+			log.Printf("Error listing hooks: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    hooks,
+			"count":   len(hooks),
+		})
+	}
+}
+
+func UpdateHook(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("UpdateHook handler called")
+		var r UpdateHookRequest
+		err := c.ShouldBindJSON(&r)
+		if err != nil {
+			log.Printf("Error binding JSON in UpdateHook: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		hook, err := db.GetHookByID(conn, c.Query("hook_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Hook not found",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if r.Name != nil {
+			hook.Name = *r.Name
+		}
+		if r.Stage != nil {
+			hook.Stage = *r.Stage
+		}
+		if r.Kind != nil {
+			hook.Kind = *r.Kind
+		}
+		if r.Command != nil {
+			hook.Command = *r.Command
+		}
+		if r.TimeoutSeconds != nil {
+			hook.TimeoutSeconds = *r.TimeoutSeconds
+		}
+		if r.AbortOnFailure != nil {
+			hook.AbortOnFailure = *r.AbortOnFailure
+		}
+		if r.Position != nil {
+			hook.Position = *r.Position
+		}
+		if r.Enabled != nil {
+			hook.Enabled = *r.Enabled
+		}
+		if err := backup_manager.ValidateHook(&hook); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid hook",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if err := db.UpdateHook(conn, &hook); err != nil {
+			log.Printf("Error updating hook: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to update hook",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "Hook updated successfully",
+			"data":    hook,
+		})
+	}
+}
+
+func DeleteHook(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("DeleteHook handler called")
+		if err := db.DeleteHookByID(conn, c.Query("hook_id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Failed to delete hook",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "Hook deleted successfully",
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AdoptBackupsRequest struct {
+	DatabaseId  string `json:"database_id" binding:"required"`
+	Destination string `json:"backup_destination" binding:"required"`
+	Pattern     string `json:"pattern" binding:"required"` // shell glob the file names have to match
+	Async       bool   `json:"async"`                      // respond with the job right away, see /jobs/stream
+}
+
+// importManager returns a manager for the connection and destination, "local"
+// or the ID of an S3 destination, and the destination's type.
+func importManager(conn *gorm.DB, databaseId, destinationParam string) (backup_manager.BackupManager, backup_manager.BackupDestination, error) {
+	creds, err := db.GetCredentialsById(conn, databaseId)
+	if err != nil {
+		return backup_manager.BackupManager{}, "", err
+	}
+	manager := backup_manager.BackupManager{
+		Host:         creds.PostgresHost,
+		Port:         creds.PostgresPort,
+		DBName:       creds.PostgresDBName,
+		User:         creds.PostgresUser,
+		Password:     creds.PostgresPassword,
+		Catalog:      conn,
+		ConnectionID: creds.ID,
+	}
+	if destinationParam == "local" {
+		return manager, backup_manager.BackupFilesystem, nil
+	}
+	dest, err := db.GetBackupDestinationByID(conn, destinationParam)
+	if err != nil {
+		return manager, "", err
+	}
+	manager.BackupDestination = &dest
+	return manager, backup_manager.BackupS3Bucket, nil
+}
+
+func UploadBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("UploadBackup handler called")
+		manager, destination, err := importManager(conn, c.PostForm("database_id"), c.PostForm("backup_destination"))
+		if err != nil {
+			log.Printf("Error setting up UploadBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid database_id or backup_destination",
+				"error":   err.Error(),
+			})
+			return
+		}
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "file is required",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		os.MkdirAll(backup_manager.LOCAL_BACKUP_DIR, 0755)
+		uploadDir, err := os.MkdirTemp(backup_manager.LOCAL_BACKUP_DIR, ".upload-")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Unable to store upload",
+				"error":   err.Error(),
+			})
+			return
+		}
+		defer os.RemoveAll(uploadDir)
+
+		uploadPath := filepath.Join(uploadDir, filepath.Base(file.Filename))
+		if err := c.SaveUploadedFile(file, uploadPath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Unable to store upload",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		filename := c.PostForm("filename")
+		if filename == "" {
+			filename = file.Filename
+		}
+		log.Printf("UploadBackup request: DatabaseId=%s, Destination=%s, Filename=%s", c.PostForm("database_id"), destination, filename)
+		manager.Job = backup_manager.NewJob("import", fmt.Sprintf("import of %s to %s", filename, destination))
+		backup, err := manager.ImportBackup(destination, uploadPath, filename)
+		manager.Job.Finish(err)
+		if err != nil {
+			log.Printf("Error importing backup %s: %v", filename, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Import failed",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    backup,
+		})
+	}
+}
+
+func AdoptBackups(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("AdoptBackups handler called")
+		var r AdoptBackupsRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		manager, destination, err := importManager(conn, r.DatabaseId, r.Destination)
+		if err != nil {
+			log.Printf("Error setting up AdoptBackups: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid database_id or backup_destination",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		job := backup_manager.NewJob("adopt", fmt.Sprintf("adoption of %s on %s", r.Pattern, destination))
+		manager.Job = job
+		if r.Async {
+			go func() {
+				_, err := manager.AdoptBackups(destination, r.Pattern)
+				job.Finish(err)
+			}()
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":  http.StatusAccepted,
+				"message": "Adoption started",
+				"data":    job,
+			})
+			return
+		}
+
+		report, err := manager.AdoptBackups(destination, r.Pattern)
+		job.Finish(err)
+		if err != nil {
+			log.Printf("Error adopting backups: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Adoption failed",
+				"error":   err.Error(),
+				"data":    report,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    report,
+			"count":   len(report.Adopted),
+		})
+	}
+}
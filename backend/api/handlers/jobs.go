@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ListJobs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListJobs handler called")
+		jobs := backup_manager.ListJobs()
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    jobs,
+			"count":   len(jobs),
+		})
+	}
+}
+
+func GetJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("GetJob handler called")
+		job, ok := backup_manager.GetJob(c.Query("job_id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Job not found",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    job,
+			"log":     job.Log(),
+		})
+	}
+}
+
+// StreamJob sends the log of a job as Server-Sent Events: a "log" event per
+// line, starting with the output so far, a "progress" event whenever the
+// progress changed (checked every second), and a final "status" event once
+// the job finished.
+func StreamJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("StreamJob handler called")
+		job, ok := backup_manager.GetJob(c.Query("job_id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Job not found",
+			})
+			return
+		}
+
+		history, lines, cancel := job.Subscribe()
+		defer cancel()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		for _, line := range history {
+			c.SSEvent("log", line)
+		}
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var lastProgress backup_manager.JobProgress
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case line := <-lines:
+				c.SSEvent("log", line)
+				return true
+			case <-ticker.C:
+				if progress := job.Progress(); progress != nil && *progress != lastProgress {
+					lastProgress = *progress
+					c.SSEvent("progress", progress)
+				}
+				return true
+			case <-job.Done():
+				// Lines written right before the job finished may still be queued.
+				for {
+					select {
+					case line := <-lines:
+						c.SSEvent("log", line)
+					default:
+						c.SSEvent("status", job)
+						return false
+					}
+				}
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ReconcileCatalog compares the stored backups with the catalog, a dry run
+// unless apply=true is passed.
+func ReconcileCatalog(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ReconcileCatalog handler called")
+		apply := c.Query("apply") == "true"
+
+		job := backup_manager.NewJob("reconcile", "reconciliation of the backup catalog")
+		report, err := backup_manager.Reconcile(conn, apply, job)
+		job.Finish(err)
+		if apply {
+			details := fmt.Sprintf("%d restored, %d repaired, %d missing", len(report.Restored), len(report.Repaired), len(report.Missing))
+			recordAudit(conn, c, "catalog.reconcile", "", "allowed", details)
+		}
+		if err != nil {
+			log.Printf("Error reconciling the catalog: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Reconciliation finished with errors",
+				"error":   err.Error(),
+				"data":    report,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    report,
+		})
+	}
+}
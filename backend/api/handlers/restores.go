@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func ListRestores(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ListRestores handler called")
+		filters := make(map[string]interface{})
+		if databaseId := c.Query("database_id"); databaseId != "" {
+			id, err := strconv.ParseUint(databaseId, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid database_id parameter",
+				})
+				return
+			}
+			filters["target_connection_id"] = uint(id)
+		}
+		if status := c.Query("status"); status != "" {
+			filters["status"] = status
+		}
+		restores, err := db.ListRestoreRecords(conn, filters)
+		if err != nil {
+			log.Printf("Error listing restores: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    restores,
+			"count":   len(restores),
+		})
+	}
+}
+
+func RollbackRestore(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("RollbackRestore handler called")
+		restoreID := c.Query("restore_id")
+		if _, err := strconv.ParseUint(restoreID, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid restore_id parameter",
+			})
+			return
+		}
+		restore, err := backup_manager.RollbackRestore(conn, restoreID)
+		if err != nil {
+			log.Printf("Error rolling back restore %s: %v", restoreID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to roll back restore",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "Restore rolled back successfully",
+			"data":    restore,
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type TransferBackupsRequest struct {
+	BackupIDs       []uint `json:"backup_ids" binding:"required"`
+	DestinationType string `json:"destination_type" binding:"required"` // local or s3
+	DestinationID   *uint  `json:"destination_id"`
+	Move            bool   `json:"move"`  // delete the backups from where they are stored afterwards
+	Async           bool   `json:"async"` // respond with the job right away, see /jobs/stream
+}
+
+func TransferBackups(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("TransferBackups handler called")
+		var r TransferBackupsRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			log.Printf("Error binding JSON in TransferBackups: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		target := backup_manager.CopyTarget{
+			DestinationType: backup_manager.BackupDestination(r.DestinationType),
+			DestinationID:   r.DestinationID,
+		}
+		if err := backup_manager.ValidateCopyTargets(conn, []backup_manager.CopyTarget{target}); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid destination",
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		action := "copy"
+		if r.Move {
+			action = "move"
+		}
+		job := backup_manager.NewJob("transfer", fmt.Sprintf("%s of %d backups to %s", action, len(r.BackupIDs), target))
+		if r.Async {
+			go func() {
+				_, err := backup_manager.TransferBackups(conn, r.BackupIDs, target, r.Move, job)
+				job.Finish(err)
+			}()
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":  http.StatusAccepted,
+				"message": "Transfer started",
+				"data":    job,
+			})
+			return
+		}
+
+		backups, err := backup_manager.TransferBackups(conn, r.BackupIDs, target, r.Move, job)
+		job.Finish(err)
+		if err != nil {
+			log.Printf("Error transferring backups: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Transfer failed",
+				"error":   err.Error(),
+				"data":    backups,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    backups,
+		})
+	}
+}
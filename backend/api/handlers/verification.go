@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type VerifyBackupRequest struct {
+	BackupID            string   `json:"backup_id"`
+	ScheduleID          string   `json:"schedule_id"`
+	SandboxConnectionID string   `json:"sandbox_connection_id" binding:"required"`
+	Assertions          []string `json:"assertions"`
+}
+
+func VerifyBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("VerifyBackup handler called")
+		var r VerifyBackupRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			log.Printf("Error binding JSON in VerifyBackup: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if (r.BackupID == "") == (r.ScheduleID == "") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Exactly one of backup_id and schedule_id is required",
+			})
+			return
+		}
+		log.Printf("VerifyBackup request: BackupID=%s, ScheduleID=%s, SandboxConnectionID=%s", r.BackupID, r.ScheduleID, r.SandboxConnectionID)
+
+		var verification db.BackupVerification
+		var err error
+		if r.BackupID != "" {
+			verification, err = backup_manager.VerifyBackup(conn, r.BackupID, r.SandboxConnectionID, r.Assertions)
+		} else {
+			verification, err = backup_manager.VerifyLatestBackup(conn, r.ScheduleID, r.SandboxConnectionID, r.Assertions)
+		}
+		if err != nil {
+			log.Printf("Error verifying backup: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to verify backup",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "Backup verification " + verification.Status,
+			"data":    verification,
+		})
+	}
+}
+
+func ListBackupVerifications(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var backupID uint64
+		if id := c.Query("backup_id"); id != "" {
+			var err error
+			backupID, err = strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Invalid backup_id parameter",
+				})
+				return
+			}
+		}
+		verifications, err := db.ListBackupVerifications(conn, uint(backupID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to list backup verifications",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    verifications,
+			"count":   len(verifications),
+		})
+	}
+}
+
+func ScrubBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ScrubBackup handler called")
+		backupID := c.Query("backup_id")
+		if _, err := strconv.ParseUint(backupID, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid backup_id parameter",
+			})
+			return
+		}
+		backup, err := backup_manager.ScrubBackup(conn, backupID)
+		if err != nil {
+			log.Printf("Error scrubbing backup %s: %v", backupID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Backup failed verification",
+				"error":   err.Error(),
+				"data":    backup,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    backup,
+		})
+	}
+}
+
+func ValidateBackup(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("ValidateBackup handler called")
+		backupID := c.Query("backup_id")
+		if _, err := strconv.ParseUint(backupID, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid backup_id parameter",
+			})
+			return
+		}
+		backup, err := backup_manager.ValidateBackup(conn, backupID)
+		if err != nil {
+			log.Printf("Error validating backup %s: %v", backupID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Backup failed validation",
+				"error":   err.Error(),
+				"data":    backup,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    backup,
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	backup_manager "pg_bckup_mgr/backup-manager"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateWalStreamRequest struct {
+	ConnectionID  string `json:"connection_id" binding:"required"`
+	DestinationID string `json:"destination_id"`
+	SlotName      string `json:"slot_name"`
+}
+type PointInTimeRecoveryRequest struct {
+	DatabaseId    string     `json:"database_id" binding:"required"`
+	Destination   string     `json:"backup_destination"`
+	Filename      string     `json:"backup_filename" binding:"required"`
+	DataDirectory string     `json:"data_directory" binding:"required"`
+	TargetTime    *time.Time `json:"target_time,omitempty"`
+	TargetLSN     string     `json:"target_lsn,omitempty"`
+}
+
+func CreateWalStream(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("CreateWalStream handler called")
+		var r CreateWalStreamRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			log.Printf("Error binding JSON in CreateWalStream: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid request format",
+				"error":   err.Error(),
+			})
+			return
+		}
+		log.Printf("CreateWalStream request: ConnectionID=%s, DestinationID=%s", r.ConnectionID, r.DestinationID)
+		stream, err := backup_manager.CreateWalStream(conn, r.ConnectionID, r.DestinationID, r.SlotName)
+		if err != nil {
+			if isDuplicateKeyError(err) {
+				c.JSON(http.StatusConflict, gin.H{
+					"status":  http.StatusConflict,
+					"message": "A WAL stream for this connection already exists",
+				})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to create WAL stream",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if err := backup_manager.StartWalStream(conn, stream.ID); err != nil {
+			log.Printf("Error starting WAL stream %d: %v", stream.ID, err)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "WAL stream created successfully",
+			"data":    stream,
+		})
+	}
+}
+
+func ListWalStreams(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		streams, err := db.ListWalStreams(conn)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to list WAL streams",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    streams,
+			"count":   len(streams),
+		})
+	}
+}
+
+func StartWalStream(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("StartWalStream handler called")
+		id, err := strconv.ParseUint(c.Query("stream_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid stream_id parameter",
+			})
+			return
+		}
+		if err := backup_manager.StartWalStream(conn, uint(id)); err != nil {
+			log.Printf("Error starting WAL stream: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to start WAL stream",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "WAL stream started",
+		})
+	}
+}
+
+func StopWalStream(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("StopWalStream handler called")
+		id, err := strconv.ParseUint(c.Query("stream_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid stream_id parameter",
+			})
+			return
+		}
+		if err := backup_manager.StopWalStream(conn, uint(id)); err != nil {
+			log.Printf("Error stopping WAL stream: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to stop WAL stream",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "WAL stream stopped",
+		})
+	}
+}
+
+func DeleteWalStream(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("DeleteWalStream handler called")
+		streamID := c.Query("stream_id")
+		id, err := strconv.ParseUint(streamID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid stream_id parameter",
+			})
+			return
+		}
+		warning, err := backup_manager.DeleteWalStream(conn, uint(id))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Failed to delete WAL stream",
+				"error":   err.Error(),
+			})
+			return
+		}
+		response := gin.H{
+			"status":  http.StatusOK,
+			"message": "WAL stream deleted successfully",
+		}
+		if warning != "" {
+			response["warning"] = warning
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func ListWalSegments(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Query("connection_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Invalid connection_id parameter",
+			})
+			return
+		}
+		segments, err := db.ListWalSegments(conn, uint(id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Failed to list WAL segments",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+			"data":    segments,
+			"count":   len(segments),
+		})
+	}
+}
+
+func PointInTimeRecovery(conn *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log.Println("PointInTimeRecovery handler called")
+		var destination *db.Destination
+		var r PointInTimeRecoveryRequest
+		if err := c.ShouldBindJSON(&r); err != nil {
+			log.Printf("Error binding JSON in PointInTimeRecovery: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  http.StatusBadRequest,
+				"message": err.Error(),
+			})
+			return
+		}
+		log.Printf("PointInTimeRecovery request: DatabaseId=%s, Filename=%s, DataDirectory=%s, TargetTime=%v, TargetLSN=%s",
+			r.DatabaseId, r.Filename, r.DataDirectory, r.TargetTime, r.TargetLSN)
+		creds, err := db.GetCredentialsById(conn, r.DatabaseId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		if r.Destination != "local" {
+			dest, err := db.GetBackupDestinationByID(conn, r.Destination)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": err.Error(),
+				})
+				return
+			}
+			destination = &dest
+			r.Destination = "s3"
+		}
+		bckupManager := backup_manager.BackupManager{
+			Host:              creds.PostgresHost,
+			Port:              creds.PostgresPort,
+			DBName:            creds.PostgresDBName,
+			User:              creds.PostgresUser,
+			Password:          creds.PostgresPassword,
+			BackupDestination: destination,
+			Catalog:           conn,
+			ConnectionID:      creds.ID,
+		}
+		target := backup_manager.RecoveryTarget{Time: r.TargetTime, LSN: r.TargetLSN}
+		err = bckupManager.PreparePointInTimeRecovery(backup_manager.BackupDestination(r.Destination), r.Filename, r.DataDirectory, target)
+		if err != nil {
+			log.Printf("Error preparing point-in-time recovery: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":  http.StatusOK,
+			"message": "OK",
+		})
+	}
+}
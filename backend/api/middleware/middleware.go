@@ -5,9 +5,11 @@ import (
 	"log"
 	"net/http"
 	"pg_bckup_mgr/auth"
+	"pg_bckup_mgr/db"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func CORSMiddleware() gin.HandlerFunc {
@@ -26,11 +28,23 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+// queryTokenRoutes may pass the JWT as the token query parameter, as
+// EventSource cannot set headers. Everywhere else the token would end up in
+// access logs and Referer headers for nothing.
+var queryTokenRoutes = map[string]bool{
+	"/api/v1/jobs/stream": true,
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		authHeader := c.GetHeader("Authorization")
-		jwt := strings.Split(authHeader, " ")[1]
+		var jwt string
+		if queryTokenRoutes[c.FullPath()] {
+			jwt = c.Query("token")
+		}
+		if parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2); len(parts) == 2 {
+			jwt = parts[1]
+		}
 
 		if jwt == "" {
 			log.Println("JWT token not provided")
@@ -53,3 +67,36 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// RequireRole lets only users with one of the roles through. Denied
+// requests are recorded in the audit log. It has to run after
+// AuthMiddleware.
+func RequireRole(conn *gorm.DB, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString("FullUserName")
+		user, err := db.GetUserByName(conn, username)
+		if err == nil {
+			for _, role := range roles {
+				if user.Role == role {
+					c.Set("UserRole", user.Role)
+					c.Next()
+					return
+				}
+			}
+		}
+
+		log.Printf("User %s denied access to %s", username, c.FullPath())
+		entry := &db.AuditLog{
+			Username:   username,
+			Action:     c.Request.Method + " " + c.FullPath(),
+			ResourceID: c.Request.URL.Query().Get("backup_id"),
+			Status:     "denied",
+			ClientIP:   c.ClientIP(),
+		}
+		if err := db.CreateAuditLog(conn, entry); err != nil {
+			log.Printf("Unable to write audit log: %v", err)
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("requires one of the roles %s", strings.Join(roles, ", "))})
+		c.Abort()
+	}
+}
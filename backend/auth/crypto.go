@@ -43,19 +43,20 @@ func deriveKey(salt []byte) ([]byte, error) {
 	if secretKey == "" {
 		return nil, fmt.Errorf("SECRET_KEY environment variable is not set")
 	}
+	return deriveKeyFrom(secretKey, salt), nil
+}
 
+func deriveKeyFrom(secret string, salt []byte) []byte {
 	params := getDefaultParams()
 
-	key := argon2.IDKey(
-		[]byte(secretKey),
+	return argon2.IDKey(
+		[]byte(secret),
 		salt,
 		params.Iterations,
 		params.Memory,
 		params.Parallelism,
 		params.KeyLength,
 	)
-
-	return key, nil
 }
 
 func HashPassword(password string) (string, error) {
@@ -138,6 +139,36 @@ func hashPasswordWithSalt(password string, salt []byte) ([]byte, error) {
 }
 
 func EncryptString(str string) (string, error) {
+	return encryptString(str, deriveKey)
+}
+
+// EncryptWithPassphrase encrypts like EncryptString, with a key derived
+// from the passphrase instead of SECRET_KEY, e.g. for secrets that leave
+// this instance.
+func EncryptWithPassphrase(str, passphrase string) (string, error) {
+	return encryptString(str, passphraseKey(passphrase))
+}
+
+func DecryptString(encryptedStr string) (string, error) {
+	return decryptString(encryptedStr, deriveKey)
+}
+
+// DecryptWithPassphrase decrypts a string encrypted with
+// EncryptWithPassphrase.
+func DecryptWithPassphrase(encryptedStr, passphrase string) (string, error) {
+	return decryptString(encryptedStr, passphraseKey(passphrase))
+}
+
+func passphraseKey(passphrase string) func(salt []byte) ([]byte, error) {
+	return func(salt []byte) ([]byte, error) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase cannot be empty")
+		}
+		return deriveKeyFrom(passphrase, salt), nil
+	}
+}
+
+func encryptString(str string, keyFor func(salt []byte) ([]byte, error)) (string, error) {
 	params := getDefaultParams()
 
 	// Generate random salt for key derivation
@@ -147,7 +178,7 @@ func EncryptString(str string) (string, error) {
 	}
 
 	// Derive encryption key using Argon2id
-	key, err := deriveKey(salt)
+	key, err := keyFor(salt)
 	if err != nil {
 		return "", fmt.Errorf("failed to derive key: %w", err)
 	}
@@ -185,7 +216,7 @@ func EncryptString(str string) (string, error) {
 	return encoded, nil
 }
 
-func DecryptString(encryptedStr string) (string, error) {
+func decryptString(encryptedStr string, keyFor func(salt []byte) ([]byte, error)) (string, error) {
 	params := getDefaultParams()
 
 	// Decode from base64
@@ -204,7 +235,7 @@ func DecryptString(encryptedStr string) (string, error) {
 	salt := data[:params.SaltLength]
 
 	// Derive decryption key using Argon2id
-	key, err := deriveKey(salt)
+	key, err := keyFor(salt)
 	if err != nil {
 		return "", fmt.Errorf("failed to derive key: %w", err)
 	}
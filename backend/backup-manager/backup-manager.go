@@ -1,45 +1,152 @@
 package backup_manager
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"pg_bckup_mgr/auth"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-func (b BackupManager) createPgDumpBackup(outputPath string) error {
-	cmd := exec.Command("pg_dump",
+// createPgDumpBackup dumps the database to outputPath, reporting the bytes
+// written so far against estimatedSize as progress.
+func (b BackupManager) createPgDumpBackup(outputPath string, opts BackupOptions, snapshot string, estimatedSize int64) error {
+	args := []string{
 		"-h", b.Host,
 		"-p", b.Port,
 		"-U", b.User,
 		"-d", b.DBName,
 		"-W",
-		"-Fc",
+		"-F", string(opts.Format),
+	}
+	if compression := opts.compressionArg(); compression != "" {
+		args = append(args, "-Z", compression)
+	}
+	args = append(args, opts.selectionArgs()...)
+	if snapshot != "" {
+		args = append(args, "--snapshot", snapshot)
+	}
+	if opts.Format == DumpPlain && !opts.DataOnly {
+		args = append(args, "--clean", "--if-exists")
+	}
+
+	progress := b.Job.StartPhase("dump", "bytes")
+	if opts.Format != DumpDirectory {
+		stop := watchOutputSize(outputPath, estimatedSize, progress)
+		defer stop()
+		return b.runCommand(b.pgCommand("pg_dump", append(args, "-f", outputPath)...))
+	}
+
+	// Directory format dumps are written next to the final file and archived
+	// into a single tar so they can be stored and listed like other backups.
+	dumpDir := strings.TrimSuffix(outputPath, ".tar")
+	defer os.RemoveAll(dumpDir)
+	if opts.Jobs > 1 {
+		args = append(args, "-j", strconv.Itoa(opts.Jobs))
+	}
+	stop := watchOutputSize(dumpDir, estimatedSize, progress)
+	err := b.runCommand(b.pgCommand("pg_dump", append(args, "-f", dumpDir)...))
+	stop()
+	if err != nil {
+		return err
+	}
+
+	return archiveDirectory(dumpDir, outputPath)
+}
+
+// createGlobalsBackup dumps the roles, role memberships and tablespaces of
+// the connection's server, which per-database dumps do not contain.
+func (b BackupManager) createGlobalsBackup(outputPath string) error {
+	return b.runCommand(b.pgCommand("pg_dumpall",
+		"-h", b.Host,
+		"-p", b.Port,
+		"-U", b.User,
+		"-l", b.DBName,
+		"-w",
+		"--globals-only",
 		"-f", outputPath,
-	)
+	))
+}
+
+// pgCommand prepares a PostgreSQL client command authenticated with the
+// manager's stored password.
+func (b BackupManager) pgCommand(name string, args ...string) *exec.Cmd {
+	return b.pgCommandContext(context.Background(), name, args...)
+}
+
+// pgCommandContext runs the binary matching the server's major version, see
+// pgBinary. When there is none, running the command fails with the reason.
+func (b BackupManager) pgCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	path, err := b.pgBinary(name)
+	if err != nil {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Err = err
+		return cmd
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
 	decryptedPassword, _ := auth.DecryptString(b.Password)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("PGPASSWORD=%s", decryptedPassword))
 
-	return cmd.Run()
+	return cmd
+}
+
+func (b BackupManager) backupDirName() string {
+	return fmt.Sprintf("%s-%s-%s", b.DBName, b.Host, b.User)
+}
+
+func (b BackupManager) newS3Client() (*S3Client, error) {
+	if b.BackupDestination == nil {
+		return nil, fmt.Errorf("no S3 destination configured")
+	}
+
+	return NewS3Client(b.BackupDestination.Name,
+		b.BackupDestination.EndpointURL,
+		b.BackupDestination.Region,
+		b.BackupDestination.BucketName,
+		b.BackupDestination.AccessKeyID,
+		b.BackupDestination.SecretAccessKey,
+		b.BackupDestination.UseSSL,
+		b.BackupDestination.VerifySSL,
+	)
+}
+
+// dsnValue quotes a value of a key=value connection string, so that spaces,
+// quotes and "=" in e.g. passwords or restore target names are kept as they
+// are instead of ending the value or adding parameters.
+func dsnValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
 }
 
 func (b BackupManager) Connect() (*gorm.DB, error) {
 	decryptedPassword, _ := auth.DecryptString(b.Password)
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
-		b.Host, b.User, decryptedPassword, b.DBName, b.Port)
+		dsnValue(b.Host), dsnValue(b.User), dsnValue(decryptedPassword), dsnValue(b.DBName), dsnValue(b.Port))
 
 	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
+	var version int
+	if err := conn.Raw("SHOW server_version_num").Scan(&version).Error; err == nil {
+		b.recordServerVersion(version)
+	}
+
 	return conn, nil
 
 }
@@ -60,6 +167,9 @@ func (b BackupManager) ListAvaiableBackups(destination BackupDestination) []stri
 
 		filenames := []string{}
 		for _, file := range files {
+			if strings.HasSuffix(file.Name(), CHECKSUM_SUFFIX) || strings.HasSuffix(file.Name(), METADATA_SUFFIX) {
+				continue
+			}
 			filenames = append(filenames, file.Name())
 		}
 		log.Println("found: ", len(filenames), " files")
@@ -69,20 +179,25 @@ func (b BackupManager) ListAvaiableBackups(destination BackupDestination) []stri
 	case BackupS3Bucket:
 		log.Println("Searching for backups in S3 bucket...")
 
-		S3Client, _ := NewS3Client(b.BackupDestination.Name,
-			b.BackupDestination.EndpointURL,
-			b.BackupDestination.Region,
-			b.BackupDestination.BucketName,
-			b.BackupDestination.AccessKeyID,
-			b.BackupDestination.SecretAccessKey,
-			b.BackupDestination.UseSSL,
-			b.BackupDestination.VerifySSL,
-		)
-
-		filenames, err := S3Client.ListFiles()
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			log.Printf("Error creating S3 client: %v", err)
+			return []string{}
+		}
+
+		keys, err := S3Client.ListFiles()
 		if err != nil {
 			return []string{}
 		}
+
+		filenames := []string{}
+		for _, key := range keys {
+			if strings.HasPrefix(key, WAL_ARCHIVE_PREFIX) || strings.HasPrefix(key, SELF_BACKUP_PREFIX) ||
+				strings.HasSuffix(key, METADATA_SUFFIX) {
+				continue
+			}
+			filenames = append(filenames, key)
+		}
 		log.Println("found: ", len(filenames), " files")
 
 		return filenames
@@ -92,186 +207,522 @@ func (b BackupManager) ListAvaiableBackups(destination BackupDestination) []stri
 	return []string{}
 }
 
-func (b BackupManager) RestoreFromBackup(destination BackupDestination, filename string) error {
-	switch destination {
-	case BackupFilesystem:
-		log.Printf("Restoring database from backup: %s", filename)
-		backupDirName := fmt.Sprintf("%s-%s-%s", b.DBName, b.Host, b.User)
-		backupPath := filepath.Join(LOCAL_BACKUP_DIR, backupDirName, filename)
+func (b BackupManager) RestoreFromBackup(destination BackupDestination, filename string, restoreOpts RestoreOptions) (RestoreReport, error) {
+	if b.Job == nil {
+		b.Job = NewJob("restore", fmt.Sprintf("restore of %s from %s", filename, destination))
+		report, err := b.RestoreFromBackup(destination, filename, restoreOpts)
+		b.Job.Finish(err)
+		return report, err
+	}
 
-		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-			log.Printf("Backup file does not exist: %s", backupPath)
-			return fmt.Errorf("backup file not found: %s", filename)
+	report := RestoreReport{JobID: b.Job.ID}
+	restore := b.startRestoreRecord(destination, filename, restoreOpts)
+	if restore != nil {
+		report.RestoreID = restore.ID
+	}
+
+	// Hooks are those of the connection restored into.
+	target := b.restoreTarget(restoreOpts)
+	targetID := b.ConnectionID
+	if restoreOpts.Target != nil {
+		targetID = restoreOpts.Target.ID
+	}
+	event := hookEvent{Stage: HookPreRestore, Host: target.Host, Database: target.DBName, Filename: filename}
+
+	var err error
+	if !restoreOpts.skipHooks {
+		err = target.runHooks(targetID, event)
+	}
+	if err == nil {
+		err = b.restoreFromBackup(destination, filename, restoreOpts, restore, &report)
+		if !restoreOpts.skipHooks {
+			if hookErr := target.runHooks(targetID, event.after(HookPostRestore, "", err)); hookErr != nil && err == nil {
+				err = hookErr
+			}
 		}
+	}
+	b.finishRestoreRecord(restore, report, err)
+	return report, err
+}
+
+func (b BackupManager) restoreFromBackup(destination BackupDestination, filename string, restoreOpts RestoreOptions, restore *db.Restore, report *RestoreReport) error {
+	record := b.lookupBackupRecord(filename)
+	backupType := backupTypeOf(record, filename)
+	if backupType.isPhysical() {
+		return fmt.Errorf("backup %s is a physical backup and has to be restored into a data directory", filename)
+	}
+
+	target := b.restoreTarget(restoreOpts)
+	if backupType == BackupGlobals {
+		return report.phase("globals", func() error {
+			return b.applyGlobals(destination, filename, target)
+		})
+	}
+
+	opts := dumpOptionsOf(record, filename)
+	if err := restoreOpts.validate(opts); err != nil {
+		return err
+	}
+	if restoreOpts.Staging {
+		return b.stagedRestore(destination, filename, restoreOpts, restore, report)
+	}
 
-		conn, err := b.Connect()
+	if restoreOpts.WithGlobals {
+		globalsFilename := restoreOpts.GlobalsFilename
+		if globalsFilename == "" {
+			globals := b.latestBackupOfType(destination, BackupGlobals)
+			if globals == nil {
+				return fmt.Errorf("no globals backup found on %s", destination)
+			}
+			globalsFilename = globals.Filename
+		}
+		err := report.phase("globals", func() error {
+			return b.applyGlobals(destination, globalsFilename, target)
+		})
 		if err != nil {
-			log.Printf("Unable to connect to database for restore: %v", err)
-			return fmt.Errorf("database connection failed: %v", err)
+			return err
 		}
+	}
 
-		db, _ := conn.DB()
-		db.Close()
+	created := false
+	if restoreOpts.CreateDatabase {
+		existingDB := b.DBName
+		if restoreOpts.Target != nil {
+			existingDB = restoreOpts.Target.PostgresDBName
+		}
+		var err error
+		if created, err = target.ensureDatabase(existingDB); err != nil {
+			return err
+		}
+	}
 
-		cmd := exec.Command("pg_restore",
-			"-h", b.Host,
-			"-p", b.Port,
-			"-U", b.User,
-			"-d", b.DBName,
-			"-c",
-			"--if-exists",
-			"-v",
-			backupPath,
-		)
+	// A database created for this restore has nothing worth keeping.
+	if !restoreOpts.SkipSafetyBackup && !created {
+		err := report.phase("safety_backup", func() error {
+			safety, err := b.safetyBackup(destination, target, restoreOpts)
+			if restore != nil && safety != nil {
+				restore.SafetyBackupID = &safety.ID
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Safety backup of %s failed: %v", target.DBName, err)
+			return fmt.Errorf("safety backup of %s failed, nothing was restored: %v", target.DBName, err)
+		}
+	}
+
+	log.Printf("Restoring %s backup %s into %s@%s:%s/%s", destination, filename, target.User, target.Host, target.Port, target.DBName)
+	var backupPath string
+	var cleanup func()
+	err := report.phase("download", func() error {
+		var err error
+		backupPath, cleanup, err = b.fetchBackupFile(destination, filename)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	conn, err := target.Connect()
+	if err != nil {
+		log.Printf("Unable to connect to database for restore: %v", err)
+		return fmt.Errorf("database connection failed: %v", err)
+	}
 
-		decryptedPassword, _ := auth.DecryptString(b.Password)
-		cmd.Env = append(os.Environ(),
-			fmt.Sprintf("PGPASSWORD=%s", decryptedPassword))
+	sqlDB, _ := conn.DB()
+	sqlDB.Close()
 
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error restoring backup: %v", err)
-			return fmt.Errorf("restore failed: %v", err)
+	if restoreOpts.TerminateSessions {
+		var reopen func()
+		err := report.phase("terminate_sessions", func() error {
+			var err error
+			reopen, err = target.blockSessions()
+			return err
+		})
+		if err != nil {
+			return err
 		}
+		defer reopen()
+	}
 
-		log.Printf("Successfully restored database from backup: %s", filename)
-		return nil
+	err = report.phase("restore", func() error {
+		return target.restoreDump(backupPath, opts, restoreOpts)
+	})
+	if err != nil {
+		log.Printf("Error restoring backup: %v", err)
+		return fmt.Errorf("restore failed: %v", err)
+	}
 
-	case BackupS3Bucket:
-		log.Printf("Restoring database from S3 backup: %s", filename)
-
-		S3Client, err := NewS3Client(b.BackupDestination.Name,
-			b.BackupDestination.EndpointURL,
-			b.BackupDestination.Region,
-			b.BackupDestination.BucketName,
-			b.BackupDestination.AccessKeyID,
-			b.BackupDestination.SecretAccessKey,
-			b.BackupDestination.UseSSL,
-			b.BackupDestination.VerifySSL,
-		)
+	if len(restoreOpts.RoleMapping) > 0 {
+		err := report.phase("role_mapping", func() error {
+			return target.remapRoles(restoreOpts.RoleMapping)
+		})
 		if err != nil {
-			log.Printf("Error creating S3 client: %v", err)
-			return fmt.Errorf("S3 client creation failed: %v", err)
+			return err
 		}
+	}
 
-		// Create temporary directory for download
-		backupDirName := fmt.Sprintf("%s-%s-%s", b.DBName, b.Host, b.User)
-		os.MkdirAll(fmt.Sprintf("%s/%s/", LOCAL_BACKUP_DIR, backupDirName), 0755)
+	log.Printf("Successfully restored database from backup: %s", filename)
+	return nil
+}
+
+// applyGlobals replays a globals backup through the target server's
+// maintenance database. Roles that already exist make their CREATE ROLE
+// fail, so errors do not stop the script and the following ALTER ROLE still
+// applies.
+func (b BackupManager) applyGlobals(destination BackupDestination, filename string, target BackupManager) error {
+	log.Printf("Applying globals from backup: %s", filename)
+	backupPath, cleanup, err := b.fetchBackupFile(destination, filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := target.pgCommand("psql",
+		"-h", target.Host,
+		"-p", target.Port,
+		"-U", target.User,
+		"-d", "postgres",
+		"-q",
+		"-f", backupPath,
+	)
+	if err := target.runCommand(cmd); err != nil {
+		log.Printf("Error applying globals: %v", err)
+		return fmt.Errorf("applying globals failed: %v", err)
+	}
+
+	log.Printf("Successfully applied globals from backup: %s", filename)
+	return nil
+}
 
-		tempBackupPath := filepath.Join(LOCAL_BACKUP_DIR, backupDirName, filename)
-		log.Printf("Downloading backup from S3 to: %s", tempBackupPath)
+// restoreDump replays a logical backup with the client matching its format:
+// psql for plain SQL, pg_restore for everything else.
+func (b BackupManager) restoreDump(backupPath string, opts BackupOptions, restoreOpts RestoreOptions) error {
+	connArgs := []string{
+		"-h", b.Host,
+		"-p", b.Port,
+		"-U", b.User,
+		"-d", b.DBName,
+	}
 
-		// Download file from S3
-		err = S3Client.DownloadFile(filename, tempBackupPath)
+	if opts.Format == DumpPlain {
+		f, err := os.Open(backupPath)
 		if err != nil {
-			log.Printf("Error downloading backup from S3: %v", err)
-			return fmt.Errorf("S3 download failed: %v", err)
+			return err
+		}
+		defer f.Close()
+
+		var input io.Reader = newProgressReader(f, b.Job.StartPhase("restore", "bytes"))
+		if opts.Compression == "gzip" {
+			gz, err := gzip.NewReader(input)
+			if err != nil {
+				return fmt.Errorf("failed to read compressed dump: %w", err)
+			}
+			defer gz.Close()
+			input = gz
 		}
-		log.Println("Successfully downloaded backup from S3")
 
-		// Verify downloaded file exists
-		if _, err := os.Stat(tempBackupPath); os.IsNotExist(err) {
-			log.Printf("Downloaded backup file does not exist: %s", tempBackupPath)
-			return fmt.Errorf("downloaded backup file not found: %s", filename)
+		args := append(connArgs, "-v", "ON_ERROR_STOP=1", "-q")
+		if restoreOpts.SingleTransaction {
+			args = append(args, "--single-transaction")
 		}
+		cmd := b.pgCommand("psql", args...)
+		cmd.Stdin = input
+		return b.runCommand(cmd)
+	}
+
+	inputPath, inputCleanup, err := dumpInput(backupPath, opts)
+	if err != nil {
+		return err
+	}
+	defer inputCleanup()
 
-		conn, err := b.Connect()
+	args := append(connArgs, "-v")
+	// Data-only dumps carry no object definitions to drop first.
+	if !opts.DataOnly {
+		args = append(args, "-c", "--if-exists")
+	}
+	if restoreOpts.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if restoreOpts.NoPrivileges {
+		args = append(args, "--no-privileges")
+	}
+	if restoreOpts.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	if restoreOpts.ExitOnError {
+		args = append(args, "--exit-on-error")
+	}
+	if jobs := restoreOpts.restoreJobs(opts); jobs > 1 {
+		args = append(args, "-j", strconv.Itoa(jobs))
+	}
+	if len(restoreOpts.TocEntries) > 0 {
+		listPath, err := b.writeTocList(inputPath, restoreOpts.TocEntries)
 		if err != nil {
-			log.Printf("Unable to connect to database for restore: %v", err)
-			return fmt.Errorf("database connection failed: %v", err)
+			return err
 		}
+		defer os.Remove(listPath)
+		args = append(args, "-L", listPath)
+	}
 
-		db, _ := conn.DB()
-		db.Close()
+	progress := &restoreProgress{report: b.Job.StartPhase("restore", "entries")}
+	if len(restoreOpts.TocEntries) > 0 {
+		progress.total = int64(len(restoreOpts.TocEntries))
+	} else {
+		progress.total = int64(b.countTocEntries(inputPath))
+	}
+	return b.runCommand(b.pgCommand("pg_restore", append(args, inputPath)...), progress)
+}
 
-		log.Println("Starting database restore from downloaded backup...")
-		cmd := exec.Command("pg_restore",
-			"-h", b.Host,
-			"-p", b.Port,
-			"-U", b.User,
-			"-d", b.DBName,
-			"-c",
-			"--if-exists",
-			"-v",
-			tempBackupPath,
-		)
+// dumpInput returns the path pg_restore reads a stored dump from, unpacking
+// archived directory format dumps into a temporary directory.
+func dumpInput(backupPath string, opts BackupOptions) (string, func(), error) {
+	if opts.Format != DumpDirectory {
+		return backupPath, func() {}, nil
+	}
 
-		decryptedPassword, _ := auth.DecryptString(b.Password)
-		cmd.Env = append(os.Environ(),
-			fmt.Sprintf("PGPASSWORD=%s", decryptedPassword))
+	dumpDir, err := os.MkdirTemp(LOCAL_BACKUP_DIR, ".restore-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dumpDir) }
 
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error restoring backup: %v", err)
-			// Clean up temp file
-			os.Remove(tempBackupPath)
-			return fmt.Errorf("restore failed: %v", err)
-		}
+	if err := extractArchive(backupPath, dumpDir, false); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dumpDir, cleanup, nil
+}
 
-		// Clean up temp file
-		log.Println("Cleaning up temporary backup file...")
-		os.Remove(tempBackupPath)
+func (b BackupManager) CreateBackup(destination BackupDestination, backupType BackupType, opts BackupOptions) error {
+	if b.Job == nil {
+		b.Job = NewJob("backup", fmt.Sprintf("%s backup of %s to %s", backupType, b.DBName, destination))
+		err := b.CreateBackup(destination, backupType, opts)
+		b.Job.Finish(err)
+		return err
+	}
 
-		log.Printf("Successfully restored database from S3 backup: %s", filename)
-		return nil
+	event := hookEvent{Stage: HookPreBackup, Host: b.Host, Database: b.DBName}
+	if err := b.runHooks(b.ConnectionID, event); err != nil {
+		return err
 	}
 
-	log.Printf("Unable to restore backup from destination: %s", destination)
-	return fmt.Errorf("unsupported backup destination: %s", destination)
+	record, err := b.createBackup(destination, backupType, opts)
+	filename := ""
+	if record != nil {
+		filename = record.Filename
+	}
+	// The backup itself is kept when a post hook fails.
+	if hookErr := b.runHooks(b.ConnectionID, event.after(HookPostBackup, filename, err)); hookErr != nil && err == nil {
+		return hookErr
+	}
+	return err
 }
 
-func (b BackupManager) CreateBackup(destination BackupDestination) error {
+// createBackup takes a backup and returns its catalog entry, which is nil
+// when the manager has no catalog.
+func (b BackupManager) createBackup(destination BackupDestination, backupType BackupType, opts BackupOptions) (*db.Backup, error) {
+	if err := opts.Normalize(); err != nil {
+		return nil, err
+	}
 
 	conn, err := b.Connect()
 	if err != nil {
 		log.Printf("Unable to connect to a database")
-		return err
+		return nil, err
 	}
 
-	db, _ := conn.DB()
-	db.Close()
+	// The database size is what dump progress is measured against.
+	var databaseSize int64
+	if !backupType.isPhysical() && backupType != BackupGlobals {
+		conn.Raw("SELECT pg_database_size(current_database())").Scan(&databaseSize)
+	}
+	sqlDB, _ := conn.DB()
+	sqlDB.Close()
 
 	timestamp := time.Now().Format("20060102_150405")
-	backupDirName := fmt.Sprintf("%s-%s-%s", b.DBName, b.Host, b.User)
+	backupDirName := b.backupDirName()
 	os.MkdirAll(fmt.Sprintf("%s/%s/", LOCAL_BACKUP_DIR, backupDirName), 0755)
-	outputFile := fmt.Sprintf("%s/%s/backup_%s.dump", LOCAL_BACKUP_DIR, backupDirName, timestamp)
-	err = b.createPgDumpBackup(outputFile)
+
+	var parent *db.Backup
+	if backupType == BackupIncremental {
+		parent = b.latestChainBackup(destination)
+		if parent == nil {
+			log.Println("No previous physical backup on this destination, taking a full base backup instead")
+			backupType = BackupPhysical
+		}
+	}
+
+	var outputFile string
+	switch backupType {
+	case BackupPhysical:
+		outputFile = fmt.Sprintf("%s/%s/basebackup_%s.tar", LOCAL_BACKUP_DIR, backupDirName, timestamp)
+	case BackupIncremental:
+		outputFile = fmt.Sprintf("%s/%s/incrbackup_%s.tar", LOCAL_BACKUP_DIR, backupDirName, timestamp)
+	case BackupGlobals:
+		outputFile = fmt.Sprintf("%s/%s/globals_%s.sql", LOCAL_BACKUP_DIR, backupDirName, timestamp)
+	default:
+		backupType = BackupLogical
+		outputFile = fmt.Sprintf("%s/%s/backup_%s%s", LOCAL_BACKUP_DIR, backupDirName, timestamp, opts.fileExtension())
+	}
+
+	record := b.startBackupRecord(destination, backupType, filepath.Base(outputFile))
+	if record != nil && parent != nil {
+		record.ParentBackupID = &parent.ID
+	}
+	if record != nil && backupType == BackupLogical {
+		record.Format = string(opts.Format)
+		record.Compression = opts.Compression
+		record.Options = opts.String()
+	}
+
+	if backupType.isPhysical() {
+		var parentManifest string
+		if parent != nil {
+			parentManifest, err = b.chainManifest(destination, parent)
+			if err != nil {
+				log.Printf("Unable to get manifest of %s: %v", parent.Filename, err)
+				b.finishBackupRecord(record, 0, err)
+				return record, err
+			}
+		}
+
+		var wal walRange
+		wal, err = b.createPgBaseBackup(outputFile, parentManifest)
+		if record != nil {
+			record.WalTimeline = wal.Timeline
+			record.WalStartLSN = wal.StartLSN
+			record.WalEndLSN = wal.EndLSN
+		}
+	} else if backupType == BackupGlobals {
+		err = b.createGlobalsBackup(outputFile)
+	} else {
+		snapshot, stats, release := b.exportDumpSnapshot(opts)
+		err = b.createPgDumpBackup(outputFile, opts, snapshot, databaseSize)
+		release()
+		if record != nil && stats != nil {
+			if data, jsonErr := json.Marshal(stats); jsonErr == nil {
+				record.TableStats = string(data)
+			}
+		}
+	}
 	if err != nil {
 		log.Println("Error occurred: \n\n", err.Error())
-		return err
+		b.finishBackupRecord(record, 0, err)
+		return record, err
+	}
+
+	var sizeBytes int64
+	if info, err := os.Stat(outputFile); err == nil {
+		sizeBytes = info.Size()
+	}
+
+	checksum, err := fileChecksum(outputFile)
+	if err != nil {
+		log.Printf("Unable to checksum %s: %v", outputFile, err)
+		os.RemoveAll(outputFile)
+		b.finishBackupRecord(record, sizeBytes, err)
+		return record, err
+	}
+	b.Job.Logf("sha256 %s", checksum)
+	if record != nil {
+		record.Checksum = checksum
+	}
+
+	// A backup failing validation is still stored, but reported as an
+	// error so schedules keep their older backups and post hooks alert.
+	var validationErr error
+	if backupType == BackupLogical || backupType == BackupGlobals {
+		counts, err := b.validateDump(outputFile, backupType, opts)
+		setValidation(record, counts, err)
+		if err != nil {
+			log.Printf("Backup %s failed validation: %v", filepath.Base(outputFile), err)
+			b.Job.Logf("Validation failed: %v", err)
+			validationErr = fmt.Errorf("backup %s failed validation: %w", filepath.Base(outputFile), err)
+		} else {
+			b.Job.Logf("Validation passed: %v", counts)
+		}
 	}
 
 	switch destination {
 	case BackupFilesystem:
 		log.Println("Backing up database to a local filesystem...")
-		return nil
+		if err := writeChecksumFile(outputFile, checksum); err != nil {
+			log.Printf("Unable to write checksum file for %s: %v", outputFile, err)
+		}
 
 	case BackupS3Bucket:
 		log.Println("Backing up database to a remote S3 bucket...")
 
-		S3Client, _ := NewS3Client(b.BackupDestination.Name,
-			b.BackupDestination.EndpointURL,
-			b.BackupDestination.Region,
-			b.BackupDestination.BucketName,
-			b.BackupDestination.AccessKeyID,
-			b.BackupDestination.SecretAccessKey,
-			b.BackupDestination.UseSSL,
-			b.BackupDestination.VerifySSL,
-		)
-
-		err = S3Client.UploadFile(outputFile)
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			log.Printf("Error creating S3 client: %v", err)
+			os.RemoveAll(outputFile)
+			b.finishBackupRecord(record, sizeBytes, err)
+			return record, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+
+		S3Client.Progress = b.Job.StartPhase("upload", "bytes")
+		// S3 checks the upload against the checksum, so the stored object
+		// starts out verified.
+		err = S3Client.UploadFileWithChecksum(outputFile, filepath.Base(outputFile), checksum)
 		if err != nil {
 			log.Println("Error Ocurred durig file upload ", err.Error())
+			os.RemoveAll(outputFile)
+			b.finishBackupRecord(record, sizeBytes, err)
+			return record, err
 		}
 
+		if record != nil {
+			checkedAt := time.Now()
+			record.Integrity = IntegrityOK
+			record.IntegrityCheckedAt = &checkedAt
+		}
+
+	default:
+		log.Println("Unable to backup database to ", destination)
+		err = fmt.Errorf("unsupported backup destination: %s", destination)
 		os.RemoveAll(outputFile)
-		return nil
+		b.finishBackupRecord(record, sizeBytes, err)
+		return record, err
 	}
 
-	log.Println("Unable to backup database to ", destination)
-	return err
-
+	// Failed copies are reported like failed validation, the backup itself
+	// is kept.
+	keepLocal, copyErr := b.replicateBackup(record, destination, outputFile, checksum)
+	if destination != BackupFilesystem && !keepLocal {
+		os.RemoveAll(outputFile)
+	}
+	b.finishBackupRecord(record, sizeBytes, nil)
+	b.publishMetadata(record)
+	return record, errors.Join(validationErr, copyErr)
 }
 
 func (b BackupManager) DeleteBackup(destination BackupDestination, filename string) error {
+	record := b.lookupBackupRecord(filename)
+	if record != nil {
+		if dependents := b.backupDependents(record); len(dependents) > 0 {
+			return fmt.Errorf("backup %s is required by incremental backup %s", filename, dependents[0].Filename)
+		}
+	}
+
+	err := b.deleteBackupFile(destination, filename)
+	if err == nil && record != nil {
+		if copyErr := b.deleteBackupCopies(record); copyErr != nil {
+			log.Printf("Deleting copies of backup %s: %v", filename, copyErr)
+			err = copyErr
+		}
+		record.Status = BackupStatusDeleted
+		if err := db.UpdateBackupRecord(b.Catalog, record); err != nil {
+			log.Printf("Unable to update catalog entry for backup %s: %v", filename, err)
+		}
+	}
+	return err
+}
+
+func (b BackupManager) deleteBackupFile(destination BackupDestination, filename string) error {
 	switch destination {
 	case BackupFilesystem:
 		log.Printf("Deleting backup file: %s", filename)
@@ -288,6 +739,8 @@ func (b BackupManager) DeleteBackup(destination BackupDestination, filename stri
 			log.Printf("Error deleting backup file: %v", err)
 			return fmt.Errorf("failed to delete backup file: %v", err)
 		}
+		os.Remove(backupPath + CHECKSUM_SUFFIX)
+		os.Remove(backupPath + METADATA_SUFFIX)
 
 		log.Printf("Successfully deleted backup file: %s", filename)
 		return nil
@@ -295,15 +748,7 @@ func (b BackupManager) DeleteBackup(destination BackupDestination, filename stri
 	case BackupS3Bucket:
 		log.Printf("Deleting backup file from S3: %s", filename)
 
-		S3Client, err := NewS3Client(b.BackupDestination.Name,
-			b.BackupDestination.EndpointURL,
-			b.BackupDestination.Region,
-			b.BackupDestination.BucketName,
-			b.BackupDestination.AccessKeyID,
-			b.BackupDestination.SecretAccessKey,
-			b.BackupDestination.UseSSL,
-			b.BackupDestination.VerifySSL,
-		)
+		S3Client, err := b.newS3Client()
 		if err != nil {
 			log.Printf("Error creating S3 client: %v", err)
 			return fmt.Errorf("S3 client creation failed: %v", err)
@@ -315,6 +760,9 @@ func (b BackupManager) DeleteBackup(destination BackupDestination, filename stri
 			log.Printf("Error deleting backup from S3: %v", err)
 			return fmt.Errorf("failed to delete S3 backup: %v", err)
 		}
+		if err := S3Client.DeleteFile(filename + METADATA_SUFFIX); err != nil {
+			log.Printf("Unable to delete metadata of %s from S3: %v", filename, err)
+		}
 
 		log.Printf("Successfully deleted backup file from S3: %s", filename)
 		return nil
@@ -0,0 +1,173 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_PG_BIN_DIRS is where the Debian/Ubuntu packages install the
+// client binaries of every major version. PG_BIN_DIRS overrides it with a
+// list of directories separated by ':'.
+const DEFAULT_PG_BIN_DIRS = "/usr/lib/postgresql/*/bin"
+
+var (
+	// clientDirs maps the major versions of the installed client binaries
+	// to their directory.
+	clientDirs     map[int]string
+	clientDirsOnce sync.Once
+
+	// serverVersions caches the server_version_num of every server by
+	// host:port.
+	serverVersions   = make(map[string]int)
+	serverVersionsMu sync.Mutex
+)
+
+func installedClients() map[int]string {
+	clientDirsOnce.Do(func() {
+		clientDirs = make(map[int]string)
+
+		dirs := filepath.SplitList(os.Getenv("PG_BIN_DIRS"))
+		if len(dirs) == 0 {
+			dirs, _ = filepath.Glob(DEFAULT_PG_BIN_DIRS)
+		}
+		for _, dir := range dirs {
+			out, err := exec.Command(filepath.Join(dir, "pg_dump"), "--version").Output()
+			if err != nil {
+				log.Printf("Skipping PostgreSQL binary directory %s: %v", dir, err)
+				continue
+			}
+			major, ok := parseClientMajor(string(out))
+			if !ok {
+				log.Printf("Skipping PostgreSQL binary directory %s: unrecognised version %q", dir, strings.TrimSpace(string(out)))
+				continue
+			}
+			if _, seen := clientDirs[major]; !seen {
+				clientDirs[major] = dir
+			}
+		}
+
+		if len(clientDirs) > 0 {
+			log.Printf("PostgreSQL client binaries found for versions %v", clientMajors())
+		}
+	})
+	return clientDirs
+}
+
+// parseClientMajor parses the major version out of --version output such
+// as "pg_dump (PostgreSQL) 17.2 (Debian 17.2-1.pgdg120+1)".
+func parseClientMajor(out string) (int, bool) {
+	fields := strings.Fields(out)
+	for i, field := range fields {
+		if field == "(PostgreSQL)" && i+1 < len(fields) {
+			majorPart, _, _ := strings.Cut(fields[i+1], ".")
+			major, err := strconv.Atoi(majorPart)
+			return major, err == nil
+		}
+	}
+	return 0, false
+}
+
+func clientMajors() []int {
+	var majors []int
+	for major := range clientDirs {
+		majors = append(majors, major)
+	}
+	sort.Ints(majors)
+	return majors
+}
+
+// clientDirFor picks the binaries for a server major version: the same
+// major version when installed, otherwise the newest one. Older clients
+// cannot dump or stream from a newer server.
+func clientDirFor(serverMajor int) (string, error) {
+	clients := installedClients()
+	if dir, ok := clients[serverMajor]; ok {
+		return dir, nil
+	}
+
+	majors := clientMajors()
+	if newest := majors[len(majors)-1]; newest > serverMajor {
+		return clients[newest], nil
+	}
+	return "", fmt.Errorf("no PostgreSQL client binaries for server version %d, installed versions are %v (see PG_BIN_DIRS)", serverMajor, majors)
+}
+
+// pgBinary returns the path of the named client binary matching the
+// manager's server. Without configured binary directories the binary is
+// looked up in PATH.
+func (b BackupManager) pgBinary(name string) (string, error) {
+	if len(installedClients()) == 0 {
+		return name, nil
+	}
+
+	version, err := b.serverVersion()
+	if err != nil {
+		// The tool reports the unreachable server itself.
+		majors := clientMajors()
+		return filepath.Join(clientDirs[majors[len(majors)-1]], name), nil
+	}
+
+	dir, err := clientDirFor(version / 10000)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// serverVersion returns the server_version_num of the manager's server,
+// connecting once when it is not known yet.
+func (b BackupManager) serverVersion() (int, error) {
+	serverVersionsMu.Lock()
+	version, ok := serverVersions[net.JoinHostPort(b.Host, b.Port)]
+	serverVersionsMu.Unlock()
+	if ok {
+		return version, nil
+	}
+
+	conn, err := b.Connect()
+	if err != nil {
+		// The server may be gone, e.g. when restoring it from a physical
+		// backup; fall back to the version seen last.
+		if b.Catalog != nil {
+			if version, _ := db.GetServerVersion(b.Catalog, b.Host, b.Port); version > 0 {
+				return version, nil
+			}
+		}
+		return 0, err
+	}
+	sqlDB, _ := conn.DB()
+	sqlDB.Close()
+
+	serverVersionsMu.Lock()
+	defer serverVersionsMu.Unlock()
+	version, ok = serverVersions[net.JoinHostPort(b.Host, b.Port)]
+	if !ok {
+		return 0, fmt.Errorf("unable to determine the server version of %s:%s", b.Host, b.Port)
+	}
+	return version, nil
+}
+
+// recordServerVersion remembers the version of the manager's server and
+// stores it on the catalogued connections when it changed.
+func (b BackupManager) recordServerVersion(version int) {
+	key := net.JoinHostPort(b.Host, b.Port)
+	serverVersionsMu.Lock()
+	known := serverVersions[key]
+	serverVersions[key] = version
+	serverVersionsMu.Unlock()
+
+	if known != version && b.Catalog != nil {
+		if err := db.UpdateServerVersion(b.Catalog, b.Host, b.Port, version); err != nil {
+			log.Printf("Unable to record server version of %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func (b BackupManager) startBackupRecord(destination BackupDestination, backupType BackupType, filename string) *db.Backup {
+	if b.Catalog == nil {
+		return nil
+	}
+
+	record := &db.Backup{
+		ConnectionID:    b.ConnectionID,
+		ScheduleID:      b.ScheduleID,
+		DestinationType: string(destination),
+		BackupType:      string(backupType),
+		Filename:        filename,
+		Status:          BackupStatusRunning,
+		StartedAt:       time.Now(),
+	}
+	if destination == BackupS3Bucket && b.BackupDestination != nil {
+		record.DestinationID = &b.BackupDestination.ID
+	}
+
+	if err := db.CreateBackupRecord(b.Catalog, record); err != nil {
+		log.Printf("Unable to catalog backup %s: %v", filename, err)
+		return nil
+	}
+
+	return record
+}
+
+func (b BackupManager) finishBackupRecord(record *db.Backup, sizeBytes int64, backupErr error) {
+	if record == nil {
+		return
+	}
+
+	finishedAt := time.Now()
+	record.FinishedAt = &finishedAt
+	record.SizeBytes = sizeBytes
+	record.Log = b.Job.Log()
+	record.Status = BackupStatusCompleted
+	if backupErr != nil {
+		record.Status = BackupStatusFailed
+		record.Error = backupErr.Error()
+	}
+
+	if err := db.UpdateBackupRecord(b.Catalog, record); err != nil {
+		log.Printf("Unable to update catalog entry for backup %s: %v", record.Filename, err)
+	}
+}
+
+// managerForBackup returns a manager for the connection and destination a
+// catalogued backup was taken with.
+func managerForBackup(conn *gorm.DB, backup db.Backup) (BackupManager, error) {
+	creds, err := db.GetCredentialsById(conn, strconv.FormatUint(uint64(backup.ConnectionID), 10))
+	if err != nil {
+		return BackupManager{}, err
+	}
+
+	manager := BackupManager{
+		Host:         creds.PostgresHost,
+		Port:         creds.PostgresPort,
+		DBName:       creds.PostgresDBName,
+		User:         creds.PostgresUser,
+		Password:     creds.PostgresPassword,
+		Catalog:      conn,
+		ConnectionID: creds.ID,
+	}
+	if backup.DestinationID != nil {
+		dest, err := db.GetBackupDestinationByID(conn, strconv.FormatUint(uint64(*backup.DestinationID), 10))
+		if err != nil {
+			return manager, err
+		}
+		manager.BackupDestination = &dest
+	}
+	return manager, nil
+}
+
+// lookupBackupRecord returns the catalog entry for a stored backup file, or
+// nil when the file was not created through the catalog.
+func (b BackupManager) lookupBackupRecord(filename string) *db.Backup {
+	if b.Catalog == nil {
+		return nil
+	}
+
+	record, err := db.GetBackupRecordByFilename(b.Catalog, b.ConnectionID, filename)
+	if err != nil {
+		return nil
+	}
+
+	return &record
+}
+
+func backupTypeOf(record *db.Backup, filename string) BackupType {
+	if record != nil && record.BackupType != "" {
+		return BackupType(record.BackupType)
+	}
+	if strings.HasPrefix(filename, "basebackup_") {
+		return BackupPhysical
+	}
+	if strings.HasPrefix(filename, "incrbackup_") {
+		return BackupIncremental
+	}
+	if strings.HasPrefix(filename, "globals_") {
+		return BackupGlobals
+	}
+	return BackupLogical
+}
+
+// isPhysical reports whether backups of this type are taken with
+// pg_basebackup and restored into a data directory.
+func (t BackupType) isPhysical() bool {
+	return t == BackupPhysical || t == BackupIncremental
+}
+
+// latestChainBackup returns the most recent completed physical or
+// incremental backup stored on the given destination, which a new
+// incremental backup can be based on.
+func (b BackupManager) latestChainBackup(destination BackupDestination) *db.Backup {
+	return b.latestBackupOfType(destination, BackupPhysical, BackupIncremental)
+}
+
+// latestBackupOfType returns the most recent completed backup of one of the
+// given types stored on the destination.
+func (b BackupManager) latestBackupOfType(destination BackupDestination, types ...BackupType) *db.Backup {
+	if b.Catalog == nil {
+		return nil
+	}
+
+	typeNames := make([]string, 0, len(types))
+	for _, t := range types {
+		typeNames = append(typeNames, string(t))
+	}
+
+	query := b.Catalog.Where("connection_id = ? AND status = ? AND backup_type IN ?",
+		b.ConnectionID, BackupStatusCompleted, typeNames).
+		Where("destination_type = ?", string(destination))
+	if destination == BackupS3Bucket && b.BackupDestination != nil {
+		query = query.Where("destination_id = ?", b.BackupDestination.ID)
+	}
+
+	var record db.Backup
+	if err := query.Order("id DESC").First(&record).Error; err != nil {
+		return nil
+	}
+	return &record
+}
+
+// backupChain returns the backups needed to restore record, starting with
+// the full backup and ending with record itself.
+func (b BackupManager) backupChain(record *db.Backup) ([]db.Backup, error) {
+	chain := []db.Backup{*record}
+	for chain[0].ParentBackupID != nil {
+		parent, err := db.GetBackupRecordByID(b.Catalog, fmt.Sprint(*chain[0].ParentBackupID))
+		if err != nil {
+			return nil, fmt.Errorf("incremental chain of %s is broken: %w", record.Filename, err)
+		}
+		if parent.Status != BackupStatusCompleted {
+			return nil, fmt.Errorf("incremental chain of %s is broken: %s is %s", record.Filename, parent.Filename, parent.Status)
+		}
+		chain = append([]db.Backup{parent}, chain...)
+	}
+	return chain, nil
+}
+
+// backupDependents lists the stored backups that are built on top of record.
+func (b BackupManager) backupDependents(record *db.Backup) []db.Backup {
+	var dependents []db.Backup
+	b.Catalog.Where("parent_backup_id = ? AND status <> ?", record.ID, BackupStatusDeleted).Find(&dependents)
+	return dependents
+}
+
+func ParseBackupType(value string) (BackupType, error) {
+	switch BackupType(value) {
+	case "", BackupLogical:
+		return BackupLogical, nil
+	case BackupPhysical:
+		return BackupPhysical, nil
+	case BackupIncremental:
+		return BackupIncremental, nil
+	case BackupGlobals:
+		return BackupGlobals, nil
+	}
+	return "", fmt.Errorf("unsupported backup type: %s", value)
+}
@@ -0,0 +1,210 @@
+package backup_manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"gorm.io/gorm"
+)
+
+// CHECKSUM_SUFFIX is appended to a local backup's name for its sidecar
+// manifest, a sha256sum compatible line. S3 backups carry the checksum in
+// their object metadata instead.
+const CHECKSUM_SUFFIX = ".sha256"
+
+const (
+	IntegrityOK      = "ok"
+	IntegrityCorrupt = "corrupt"
+	IntegrityMissing = "missing"
+)
+
+const (
+	// scrubInterval is how often every stored backup is read back and
+	// checked against its checksum.
+	scrubInterval = 7 * 24 * time.Hour
+	// scrubBatchSize bounds the backups scrubbed per run of the scrubber.
+	scrubBatchSize = 20
+)
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func verifyFileChecksum(path, expected string) error {
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if checksum != expected {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, checksum)
+	}
+	return nil
+}
+
+func writeChecksumFile(path, checksum string) error {
+	line := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	return os.WriteFile(path+CHECKSUM_SUFFIX, []byte(line), 0644)
+}
+
+func readChecksumFile(path string) string {
+	data, err := os.ReadFile(path + CHECKSUM_SUFFIX)
+	if err != nil {
+		return ""
+	}
+	checksum, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	return checksum
+}
+
+// verifyFetchedBackup checks a backup made available locally against the
+// checksum in the catalog, or its sidecar manifest. verified is a checksum
+// the file already matched, e.g. the one in its S3 metadata. Backups
+// without any recorded checksum pass.
+func (b BackupManager) verifyFetchedBackup(backupPath, filename, verified string) error {
+	expected := ""
+	record := b.lookupBackupRecord(filename)
+	if record != nil {
+		expected = record.Checksum
+	}
+	if expected == "" {
+		expected = readChecksumFile(backupPath)
+	}
+	if expected == "" || expected == verified {
+		return nil
+	}
+
+	if err := verifyFileChecksum(backupPath, expected); err != nil {
+		b.recordIntegrity(record, IntegrityCorrupt, err)
+		return fmt.Errorf("backup %s failed verification: %w", filename, err)
+	}
+	return nil
+}
+
+// recordIntegrity stores the outcome of checking a backup's checksum.
+func (b BackupManager) recordIntegrity(record *db.Backup, status string, checkErr error) {
+	if record == nil || b.Catalog == nil {
+		return
+	}
+
+	checkedAt := time.Now()
+	record.Integrity = status
+	record.IntegrityCheckedAt = &checkedAt
+	record.IntegrityError = ""
+	if checkErr != nil {
+		record.IntegrityError = checkErr.Error()
+	}
+	if err := db.UpdateBackupRecord(b.Catalog, record); err != nil {
+		log.Printf("Unable to update catalog entry for backup %s: %v", record.Filename, err)
+	}
+}
+
+// ScrubBackup reads a stored backup back from its destination and checks
+// it against the checksum taken when it was created.
+func ScrubBackup(conn *gorm.DB, backupID string) (db.Backup, error) {
+	backup, err := db.GetBackupRecordByID(conn, backupID)
+	if err != nil {
+		return backup, err
+	}
+	if backup.Status != BackupStatusCompleted {
+		return backup, fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+	if backup.Checksum == "" {
+		return backup, fmt.Errorf("backup %s has no checksum", backup.Filename)
+	}
+
+	manager, err := managerForBackup(conn, backup)
+	if err != nil {
+		return backup, err
+	}
+
+	var checksum string
+	switch BackupDestination(backup.DestinationType) {
+	case BackupFilesystem:
+		checksum, err = fileChecksum(filepath.Join(LOCAL_BACKUP_DIR, manager.backupDirName(), backup.Filename))
+		if os.IsNotExist(err) {
+			manager.recordIntegrity(&backup, IntegrityMissing, err)
+			return backup, fmt.Errorf("backup %s is missing", backup.Filename)
+		}
+	case BackupS3Bucket:
+		var S3Client *S3Client
+		S3Client, err = manager.newS3Client()
+		if err != nil {
+			return backup, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		checksum, err = S3Client.HashFile(backup.Filename)
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			manager.recordIntegrity(&backup, IntegrityMissing, err)
+			return backup, fmt.Errorf("backup %s is missing", backup.Filename)
+		}
+	default:
+		return backup, fmt.Errorf("unsupported backup destination: %s", backup.DestinationType)
+	}
+	if err != nil {
+		// Not being able to read it is no proof of corruption, the backup
+		// is tried again after the next interval.
+		manager.recordIntegrity(&backup, backup.Integrity, err)
+		return backup, err
+	}
+
+	if checksum != backup.Checksum {
+		err = fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", backup.Checksum, checksum)
+		log.Printf("Backup %s failed scrubbing: %v", backup.Filename, err)
+		manager.recordIntegrity(&backup, IntegrityCorrupt, err)
+		return backup, err
+	}
+	manager.recordIntegrity(&backup, IntegrityOK, nil)
+	return backup, nil
+}
+
+// StartBackupScrubber re-verifies stored backups in the background, each
+// at most once per scrubInterval.
+func StartBackupScrubber(conn *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			scrubDueBackups(conn)
+			<-ticker.C
+		}
+	}()
+}
+
+func scrubDueBackups(conn *gorm.DB) {
+	var backups []db.Backup
+	err := conn.Where("status = ? AND checksum <> '' AND (integrity_checked_at IS NULL OR integrity_checked_at <= ?)",
+		BackupStatusCompleted, time.Now().Add(-scrubInterval)).
+		Order("integrity_checked_at NULLS FIRST, id").
+		Limit(scrubBatchSize).
+		Find(&backups).Error
+	if err != nil {
+		log.Printf("Backup scrubber: unable to load backups: %v", err)
+		return
+	}
+
+	for _, backup := range backups {
+		if _, err := ScrubBackup(conn, strconv.FormatUint(uint64(backup.ID), 10)); err != nil {
+			log.Printf("Backup scrubber: %v", err)
+		}
+	}
+}
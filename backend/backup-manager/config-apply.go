@@ -0,0 +1,825 @@
+package backup_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/auth"
+	"pg_bckup_mgr/db"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeclaredConfig is a configuration file declaring connections,
+// destinations and schedules. Entries refer to each other by name; names
+// of connections only exist in the file.
+type DeclaredConfig struct {
+	Connections  []DeclaredConnection  `yaml:"connections"`
+	Destinations []DeclaredDestination `yaml:"destinations"`
+	Schedules    []DeclaredSchedule    `yaml:"schedules"`
+}
+
+// SecretRef reads a secret from an environment variable or a file, so the
+// configuration file itself can be kept in Git. Files applied over HTTP may
+// only refer to files in CONFIG_SECRETS_DIR and environment variables
+// starting with CONFIG_SECRETS_ENV_PREFIX, see resolve.
+type SecretRef struct {
+	Env  string `yaml:"env"`
+	File string `yaml:"file"`
+}
+
+type DeclaredConnection struct {
+	Name     string    `yaml:"name"`
+	Host     string    `yaml:"host"`
+	Port     string    `yaml:"port"` // 5432 when unset
+	Database string    `yaml:"database"`
+	User     string    `yaml:"user"`
+	Password SecretRef `yaml:"password"`
+}
+
+type DeclaredDestination struct {
+	Name            string    `yaml:"name"`
+	Connection      string    `yaml:"connection"`
+	EndpointURL     string    `yaml:"endpoint_url"`
+	Region          string    `yaml:"region"`
+	Bucket          string    `yaml:"bucket"`
+	AccessKeyID     SecretRef `yaml:"access_key_id"`
+	SecretAccessKey SecretRef `yaml:"secret_access_key"`
+	PathPrefix      string    `yaml:"path_prefix"`
+	UseSSL          *bool     `yaml:"use_ssl"`    // true when unset
+	VerifySSL       *bool     `yaml:"verify_ssl"` // true when unset
+}
+
+type DeclaredSchedule struct {
+	Connection       string                 `yaml:"connection"`
+	Destination      string                 `yaml:"destination"`
+	Schedule         string                 `yaml:"schedule"`
+	BackupType       string                 `yaml:"backup_type"` // logical when unset
+	FullBackupEvery  int                    `yaml:"full_backup_every"`
+	Retention        int                    `yaml:"retention"` // most recent backups to keep, 0 keeps all
+	Options          map[string]interface{} `yaml:"options"`   // dump options, as accepted by the API
+	VerifyConnection string                 `yaml:"verify_connection"`
+	VerifyAssertions []string               `yaml:"verify_assertions"`
+	CopyDestinations []string               `yaml:"copy_destinations"` // "local" or destination names
+	Enabled          *bool                  `yaml:"enabled"`           // true when unset
+}
+
+// ConfigChange is a change planned, or made, to bring the database in line
+// with the configuration file.
+type ConfigChange struct {
+	Action string   `json:"action"` // create, update or delete
+	Kind   string   `json:"kind"`   // connection, destination or schedule
+	Name   string   `json:"name"`
+	Fields []string `json:"fields,omitempty"` // changed fields of an update, secrets by name only
+	Note   string   `json:"note,omitempty"`
+}
+
+// ApplyOptions control PlanConfig and ApplyConfig.
+type ApplyOptions struct {
+	Prune bool // delete what the file does not declare
+	Force bool // prune connections and destinations that still have backups
+	// Remote is set for files sent over HTTP, whose secrets may only come
+	// from the places set aside for them.
+	Remote bool
+}
+
+const (
+	DEFAULT_CONFIG_SECRETS_DIR        = "/run/secrets"
+	DEFAULT_CONFIG_SECRETS_ENV_PREFIX = "PGBM_SECRET_"
+)
+
+// ConfigPlan lists the changes of an apply, and the entries the file does
+// not declare that are kept without pruning.
+type ConfigPlan struct {
+	Applied   bool           `json:"applied"`
+	Changes   []ConfigChange `json:"changes"`
+	Unchanged int            `json:"unchanged"`
+	Unmanaged []string       `json:"unmanaged"`
+}
+
+// LoadDeclaredConfig parses a YAML configuration file, rejecting unknown
+// keys so that typos do not go unnoticed.
+func LoadDeclaredConfig(data []byte) (*DeclaredConfig, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var config DeclaredConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid configuration file: %w", err)
+	}
+	return &config, nil
+}
+
+func configSecretsDir() string {
+	if dir := os.Getenv("CONFIG_SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	return DEFAULT_CONFIG_SECRETS_DIR
+}
+
+func configSecretsEnvPrefix() string {
+	if prefix := os.Getenv("CONFIG_SECRETS_ENV_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return DEFAULT_CONFIG_SECRETS_ENV_PREFIX
+}
+
+// insideDir reports whether path, with symlinks resolved, is in dir.
+func insideDir(path, dir string) (bool, error) {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(resolvedDir, resolved)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// resolve reads the secret. Without restricted, any environment variable or
+// file of the manager's process can be read, which is fine for the CLI but
+// would let API callers read SECRET_KEY or /proc/self/environ into a
+// destination of theirs.
+func (s SecretRef) resolve(restricted bool) (string, error) {
+	switch {
+	case s.Env != "" && s.File != "":
+		return "", errors.New("set either env or file")
+	case s.Env != "":
+		if restricted && !strings.HasPrefix(s.Env, configSecretsEnvPrefix()) {
+			return "", fmt.Errorf("environment variables applied over HTTP must start with %s", configSecretsEnvPrefix())
+		}
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		if restricted {
+			if !filepath.IsAbs(s.File) {
+				return "", fmt.Errorf("files applied over HTTP must be absolute paths in %s", configSecretsDir())
+			}
+			inside, err := insideDir(s.File, configSecretsDir())
+			if err != nil {
+				return "", err
+			}
+			if !inside {
+				return "", fmt.Errorf("files applied over HTTP must be in %s", configSecretsDir())
+			}
+		}
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", errors.New("env or file is required")
+}
+
+func boolOr(value *bool, fallback bool) bool {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+func connectionName(c db.Connection) string {
+	return fmt.Sprintf("%s@%s:%s/%s", c.PostgresUser, c.PostgresHost, c.PostgresPort, c.PostgresDBName)
+}
+
+// configApplier holds the state of one PlanConfig or ApplyConfig run. IDs
+// of entries still to be created are 0 while planning.
+type configApplier struct {
+	tx     *gorm.DB
+	apply  bool
+	opts   ApplyOptions
+	plan   ConfigPlan
+	errs   []error
+	config *DeclaredConfig
+
+	connections  map[string]uint // file name to ID
+	destinations map[string]uint
+}
+
+// PlanConfig compares the configuration file with the database and returns
+// the changes ApplyConfig would make, without making them.
+func PlanConfig(conn *gorm.DB, config *DeclaredConfig, opts ApplyOptions) (ConfigPlan, error) {
+	a := newConfigApplier(conn, config, false, opts)
+	err := a.run()
+	return a.plan, err
+}
+
+// ApplyConfig creates, updates and, with prune, deletes connections,
+// destinations and schedules until the database matches the configuration
+// file. Entries are matched by connection identity, destination name and
+// the connection, destination and backup type of schedules, so applying the
+// same file again changes nothing. The changes are made in a
+// single transaction; nothing is changed when the file has errors.
+func ApplyConfig(conn *gorm.DB, config *DeclaredConfig, opts ApplyOptions) (ConfigPlan, error) {
+	var plan ConfigPlan
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		a := newConfigApplier(tx, config, true, opts)
+		err := a.run()
+		plan = a.plan
+		return err
+	})
+	if err != nil {
+		plan.Applied = false
+		return plan, err
+	}
+	log.Printf("Applied configuration: %d changes, %d unchanged", len(plan.Changes), plan.Unchanged)
+	return plan, nil
+}
+
+func newConfigApplier(tx *gorm.DB, config *DeclaredConfig, apply bool, opts ApplyOptions) *configApplier {
+	return &configApplier{
+		tx:           tx,
+		apply:        apply,
+		opts:         opts,
+		plan:         ConfigPlan{Applied: apply},
+		config:       config,
+		connections:  map[string]uint{},
+		destinations: map[string]uint{},
+	}
+}
+
+func (a *configApplier) fail(format string, args ...interface{}) {
+	a.errs = append(a.errs, fmt.Errorf(format, args...))
+}
+
+func (a *configApplier) change(action, kind, name string, fields []string, note string) {
+	a.plan.Changes = append(a.plan.Changes, ConfigChange{Action: action, Kind: kind, Name: name, Fields: fields, Note: note})
+}
+
+func (a *configApplier) run() error {
+	steps := []func() error{a.applyConnections, a.applyDestinations, a.applySchedules}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+		// Later steps refer to what the earlier ones declare.
+		if len(a.errs) > 0 {
+			return errors.Join(a.errs...)
+		}
+	}
+	if err := a.pruneConnections(); err != nil {
+		return err
+	}
+	return errors.Join(a.errs...)
+}
+
+func (a *configApplier) applyConnections() error {
+	var existing []db.Connection
+	if err := a.tx.Order("id").Find(&existing).Error; err != nil {
+		return err
+	}
+	declared := map[uint]bool{}
+
+	for _, c := range a.config.Connections {
+		if c.Port == "" {
+			c.Port = "5432"
+		}
+		if c.Name == "" || c.Host == "" || c.Database == "" || c.User == "" {
+			a.fail("connection %q: name, host, database and user are required", c.Name)
+			continue
+		}
+		if _, ok := a.connections[c.Name]; ok {
+			a.fail("connection %q is declared twice", c.Name)
+			continue
+		}
+		password, err := c.Password.resolve(a.opts.Remote)
+		if err != nil {
+			a.fail("connection %q: password: %v", c.Name, err)
+			continue
+		}
+
+		var match *db.Connection
+		for i := range existing {
+			e := &existing[i]
+			if e.PostgresHost == c.Host && e.PostgresPort == c.Port && e.PostgresDBName == c.Database && e.PostgresUser == c.User {
+				match = e
+			}
+		}
+		if match == nil {
+			a.connections[c.Name] = 0
+			a.change("create", "connection", c.Name, nil, fmt.Sprintf("%s@%s:%s/%s", c.User, c.Host, c.Port, c.Database))
+			if !a.apply {
+				continue
+			}
+			encrypted, err := auth.EncryptString(password)
+			if err != nil {
+				return err
+			}
+			created := db.Connection{PostgresHost: c.Host, PostgresPort: c.Port, PostgresDBName: c.Database, PostgresUser: c.User, PostgresPassword: encrypted}
+			if err := a.tx.Create(&created).Error; err != nil {
+				return fmt.Errorf("failed to create connection %q: %w", c.Name, err)
+			}
+			a.connections[c.Name] = created.ID
+			continue
+		}
+
+		a.connections[c.Name] = match.ID
+		declared[match.ID] = true
+		if current, err := auth.DecryptString(match.PostgresPassword); err == nil && current == password {
+			a.plan.Unchanged++
+			continue
+		}
+		a.change("update", "connection", c.Name, []string{"password"}, "")
+		if a.apply {
+			encrypted, err := auth.EncryptString(password)
+			if err != nil {
+				return err
+			}
+			if err := a.tx.Model(match).Update("postgres_password", encrypted).Error; err != nil {
+				return fmt.Errorf("failed to update connection %q: %w", c.Name, err)
+			}
+		}
+	}
+
+	// Pruned last, see pruneConnections.
+	for _, e := range existing {
+		if !declared[e.ID] && !a.opts.Prune {
+			a.plan.Unmanaged = append(a.plan.Unmanaged, "connection "+connectionName(e))
+		}
+	}
+	return nil
+}
+
+func (a *configApplier) applyDestinations() error {
+	var existing []db.Destination
+	if err := a.tx.Order("id").Find(&existing).Error; err != nil {
+		return err
+	}
+	declared := map[uint]bool{}
+
+	for _, d := range a.config.Destinations {
+		if d.Name == "" || d.EndpointURL == "" || d.Bucket == "" {
+			a.fail("destination %q: name, endpoint_url and bucket are required", d.Name)
+			continue
+		}
+		if d.Name == "local" {
+			a.fail("destination name local is reserved for the local filesystem")
+			continue
+		}
+		if _, ok := a.destinations[d.Name]; ok {
+			a.fail("destination %q is declared twice", d.Name)
+			continue
+		}
+		connectionID, ok := a.connections[d.Connection]
+		if !ok {
+			a.fail("destination %q: connection %q is not declared", d.Name, d.Connection)
+			continue
+		}
+		accessKeyID, err := d.AccessKeyID.resolve(a.opts.Remote)
+		if err != nil {
+			a.fail("destination %q: access_key_id: %v", d.Name, err)
+			continue
+		}
+		secretAccessKey, err := d.SecretAccessKey.resolve(a.opts.Remote)
+		if err != nil {
+			a.fail("destination %q: secret_access_key: %v", d.Name, err)
+			continue
+		}
+
+		var match *db.Destination
+		for i := range existing {
+			if existing[i].Name == d.Name {
+				match = &existing[i]
+			}
+		}
+		if match == nil {
+			a.destinations[d.Name] = 0
+			a.change("create", "destination", d.Name, nil, "")
+			if !a.apply {
+				continue
+			}
+			created := db.Destination{ConnectionID: connectionID}
+			if _, err := setDestination(&created, d, accessKeyID, secretAccessKey); err != nil {
+				return err
+			}
+			// Select keeps false booleans, which gorm would replace with
+			// their defaults.
+			if err := a.tx.Select("*").Omit(clause.Associations, "ID").Create(&created).Error; err != nil {
+				return fmt.Errorf("failed to create destination %q: %w", d.Name, err)
+			}
+			a.destinations[d.Name] = created.ID
+			continue
+		}
+
+		a.destinations[d.Name] = match.ID
+		declared[match.ID] = true
+		updated := *match
+		updated.ConnectionID = connectionID
+		fields, err := setDestination(&updated, d, accessKeyID, secretAccessKey)
+		if err != nil {
+			return err
+		}
+		if connectionID != match.ConnectionID {
+			fields = append([]string{"connection"}, fields...)
+		}
+		if len(fields) == 0 {
+			a.plan.Unchanged++
+			continue
+		}
+		a.change("update", "destination", d.Name, fields, "")
+		if a.apply {
+			if err := a.tx.Select("*").Omit(clause.Associations).Save(&updated).Error; err != nil {
+				return fmt.Errorf("failed to update destination %q: %w", d.Name, err)
+			}
+		}
+	}
+
+	for _, e := range existing {
+		if declared[e.ID] {
+			continue
+		}
+		if !a.opts.Prune {
+			a.plan.Unmanaged = append(a.plan.Unmanaged, "destination "+e.Name)
+			continue
+		}
+		usage, err := a.catalogUsage(catalogUsageOfDestination, e.ID)
+		if err != nil {
+			return err
+		}
+		note := "its schedules are deleted with it"
+		if usage != "" {
+			if !a.opts.Force {
+				a.fail("destination %q still has %s, prune it with force to delete it anyway", e.Name, usage)
+				continue
+			}
+			note = fmt.Sprintf("its schedules are deleted with it, its %s stay in the catalog but cannot be fetched anymore", usage)
+		}
+		a.change("delete", "destination", e.Name, nil, note)
+		if a.apply {
+			if err := a.tx.Delete(&e).Error; err != nil {
+				return fmt.Errorf("failed to delete destination %q: %w", e.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setDestination sets the declared settings on the destination and returns
+// the fields that changed. Secrets are only re-encrypted when they did.
+func setDestination(dest *db.Destination, d DeclaredDestination, accessKeyID, secretAccessKey string) ([]string, error) {
+	var fields []string
+	set := func(field string, target *string, value string) {
+		if *target != value {
+			*target = value
+			fields = append(fields, field)
+		}
+	}
+	setBool := func(field string, target *bool, value bool) {
+		if *target != value {
+			*target = value
+			fields = append(fields, field)
+		}
+	}
+	setSecret := func(field string, target *string, value string) error {
+		if current, err := auth.DecryptString(*target); err == nil && current == value {
+			return nil
+		}
+		encrypted, err := auth.EncryptString(value)
+		if err != nil {
+			return err
+		}
+		*target = encrypted
+		fields = append(fields, field)
+		return nil
+	}
+
+	set("name", &dest.Name, d.Name)
+	set("endpoint_url", &dest.EndpointURL, d.EndpointURL)
+	set("region", &dest.Region, d.Region)
+	set("bucket", &dest.BucketName, d.Bucket)
+	set("path_prefix", &dest.PathPrefix, d.PathPrefix)
+	setBool("use_ssl", &dest.UseSSL, boolOr(d.UseSSL, true))
+	setBool("verify_ssl", &dest.VerifySSL, boolOr(d.VerifySSL, true))
+	if err := setSecret("access_key_id", &dest.AccessKeyID, accessKeyID); err != nil {
+		return nil, err
+	}
+	if err := setSecret("secret_access_key", &dest.SecretAccessKey, secretAccessKey); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// scheduleName names a declared schedule in plans and errors. It is what
+// identifies the schedule, so its cron expression can change.
+func scheduleName(s DeclaredSchedule) string {
+	backupType := s.BackupType
+	if backupType == "" {
+		backupType = string(BackupLogical)
+	}
+	return fmt.Sprintf("%s to %s (%s)", s.Connection, s.Destination, backupType)
+}
+
+func (a *configApplier) applySchedules() error {
+	var existing []db.BackupSchedule
+	if err := a.tx.Order("id").Find(&existing).Error; err != nil {
+		return err
+	}
+	declared := map[uint]bool{}
+	pairs := map[string]bool{}
+	parser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+	for _, s := range a.config.Schedules {
+		name := scheduleName(s)
+		pair := s.Connection + " to " + s.Destination
+		if pairs[pair] {
+			a.fail("schedule %s: %s has another schedule, there can only be one per connection and destination", name, pair)
+			continue
+		}
+		pairs[pair] = true
+		wanted, ok := a.declaredSchedule(s)
+		if !ok {
+			continue
+		}
+		cronSchedule, err := parser.Parse(s.Schedule)
+		if err != nil {
+			a.fail("schedule %s: invalid cron expression: %v", name, err)
+			continue
+		}
+
+		var matches []*db.BackupSchedule
+		if wanted.ConnectionID != 0 && wanted.DestinationID != 0 {
+			for i := range existing {
+				e := &existing[i]
+				if e.ConnectionID == wanted.ConnectionID && e.DestinationID == wanted.DestinationID && e.BackupType == wanted.BackupType {
+					matches = append(matches, e)
+				}
+			}
+		}
+		if len(matches) > 1 {
+			var ids []string
+			for _, e := range matches {
+				ids = append(ids, fmt.Sprintf("%d at %q", e.ID, e.Schedule))
+			}
+			a.fail("schedule %s is ambiguous, it matches the schedules %s; delete all but one of them", name, strings.Join(ids, ", "))
+			continue
+		}
+		if len(matches) == 0 {
+			conflict := false
+			for _, e := range existing {
+				if e.ConnectionID == wanted.ConnectionID && e.DestinationID == wanted.DestinationID {
+					a.fail("schedule %s: schedule %d of the same connection and destination takes %s backups, delete it first to change the backup type",
+						name, e.ID, e.BackupType)
+					conflict = true
+				}
+			}
+			if conflict {
+				continue
+			}
+			a.change("create", "schedule", name, nil, "")
+			if a.apply {
+				nextRun := cronSchedule.Next(time.Now())
+				wanted.NextRun = &nextRun
+				if err := a.tx.Select("*").Omit(clause.Associations, "ID", "LastRun").Create(&wanted).Error; err != nil {
+					return fmt.Errorf("failed to create schedule %s: %w", name, err)
+				}
+			}
+			continue
+		}
+
+		match := matches[0]
+		declared[match.ID] = true
+		updates := map[string]interface{}{}
+		var fields []string
+		compare := func(field string, current, value interface{}) {
+			if !reflect.DeepEqual(current, value) {
+				updates[field] = value
+				fields = append(fields, field)
+			}
+		}
+		compare("schedule", match.Schedule, wanted.Schedule)
+		if _, ok := updates["schedule"]; ok {
+			updates["next_run"] = cronSchedule.Next(time.Now())
+		}
+		compare("full_backup_every", match.FullBackupEvery, wanted.FullBackupEvery)
+		compare("retention_count", match.RetentionCount, wanted.RetentionCount)
+		compare("options", normalizedOptions(match.Options), wanted.Options)
+		compare("verify_connection_id", match.VerifyConnectionID, wanted.VerifyConnectionID)
+		compare("verify_assertions", match.VerifyAssertions, wanted.VerifyAssertions)
+		compare("copy_destinations", match.CopyDestinations, wanted.CopyDestinations)
+		compare("enabled", match.Enabled, wanted.Enabled)
+		if len(fields) == 0 {
+			a.plan.Unchanged++
+			continue
+		}
+		a.change("update", "schedule", name, fields, "")
+		if a.apply {
+			if err := a.tx.Model(match).Updates(updates).Error; err != nil {
+				return fmt.Errorf("failed to update schedule %s: %w", name, err)
+			}
+		}
+	}
+
+	for _, e := range existing {
+		if declared[e.ID] {
+			continue
+		}
+		name := fmt.Sprintf("%d at %q", e.ID, e.Schedule)
+		if !a.opts.Prune {
+			a.plan.Unmanaged = append(a.plan.Unmanaged, "schedule "+name)
+			continue
+		}
+		a.change("delete", "schedule", name, nil, "")
+		if a.apply {
+			if err := a.tx.Delete(&e).Error; err != nil {
+				return fmt.Errorf("failed to delete schedule %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// declaredSchedule validates a declared schedule and returns it as it is
+// stored, or false after recording what is wrong with it.
+func (a *configApplier) declaredSchedule(s DeclaredSchedule) (db.BackupSchedule, bool) {
+	name := scheduleName(s)
+	connectionID, ok := a.connections[s.Connection]
+	if !ok {
+		a.fail("schedule %s: connection %q is not declared", name, s.Connection)
+		return db.BackupSchedule{}, false
+	}
+	destinationID, ok := a.destinations[s.Destination]
+	if !ok {
+		a.fail("schedule %s: destination %q is not declared", name, s.Destination)
+		return db.BackupSchedule{}, false
+	}
+	backupType := s.BackupType
+	if backupType == "" {
+		backupType = string(BackupLogical)
+	}
+	parsedType, err := ParseBackupType(backupType)
+	if err != nil {
+		a.fail("schedule %s: %v", name, err)
+		return db.BackupSchedule{}, false
+	}
+	if s.FullBackupEvery < 0 || s.Retention < 0 {
+		a.fail("schedule %s: full_backup_every and retention must not be negative", name)
+		return db.BackupSchedule{}, false
+	}
+
+	var opts BackupOptions
+	if len(s.Options) > 0 {
+		data, err := json.Marshal(s.Options)
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&opts)
+		}
+		if err != nil {
+			a.fail("schedule %s: invalid options: %v", name, err)
+			return db.BackupSchedule{}, false
+		}
+	}
+	if err := opts.Normalize(); err != nil {
+		a.fail("schedule %s: %v", name, err)
+		return db.BackupSchedule{}, false
+	}
+
+	schedule := db.BackupSchedule{
+		ConnectionID:     connectionID,
+		DestinationID:    destinationID,
+		Schedule:         s.Schedule,
+		BackupType:       string(parsedType),
+		FullBackupEvery:  s.FullBackupEvery,
+		RetentionCount:   s.Retention,
+		Options:          opts.String(),
+		VerifyAssertions: encodeAssertions(s.VerifyAssertions),
+		Enabled:          boolOr(s.Enabled, true),
+	}
+	if s.VerifyConnection != "" {
+		id, ok := a.connections[s.VerifyConnection]
+		if !ok {
+			a.fail("schedule %s: verify connection %q is not declared", name, s.VerifyConnection)
+			return db.BackupSchedule{}, false
+		}
+		schedule.VerifyConnectionID = &id
+	}
+
+	var copies []CopyTarget
+	for _, copyName := range s.CopyDestinations {
+		if copyName == "local" {
+			copies = append(copies, CopyTarget{DestinationType: BackupFilesystem})
+			continue
+		}
+		id, ok := a.destinations[copyName]
+		if !ok {
+			a.fail("schedule %s: copy destination %q is not declared", name, copyName)
+			return db.BackupSchedule{}, false
+		}
+		copies = append(copies, CopyTarget{DestinationType: BackupS3Bucket, DestinationID: &id})
+	}
+	schedule.CopyDestinations = encodeCopyTargets(copies)
+	return schedule, true
+}
+
+// normalizedOptions returns stored dump options the way declared ones are
+// encoded, so that equal options compare equal.
+func normalizedOptions(value string) string {
+	opts, err := ParseBackupOptions(value)
+	if err != nil {
+		return value
+	}
+	if err := opts.Normalize(); err != nil {
+		return value
+	}
+	return opts.String()
+}
+
+// catalogUsage tables, with the column referring to the connection or
+// destination, and what their rows are called.
+var (
+	catalogUsageOfConnection = []catalogReference{
+		{&db.Backup{}, "connection_id", "backups"},
+		{&db.WalStream{}, "connection_id", "WAL streams"},
+		{&db.WalSegment{}, "connection_id", "WAL segments"},
+		{&db.Restore{}, "connection_id", "restores"},
+	}
+	catalogUsageOfDestination = []catalogReference{
+		{&db.Backup{}, "destination_id", "backups"},
+		{&db.BackupCopy{}, "destination_id", "backup copies"},
+		{&db.WalStream{}, "destination_id", "WAL streams"},
+		{&db.WalSegment{}, "destination_id", "WAL segments"},
+	}
+)
+
+type catalogReference struct {
+	model  interface{}
+	column string
+	name   string
+}
+
+// catalogUsage describes the catalog entries referring to the connection or
+// destination, e.g. "12 backups, 1 WAL streams", or returns "" when there
+// are none. Deleting a connection deletes them too, through ON DELETE
+// CASCADE.
+func (a *configApplier) catalogUsage(references []catalogReference, id uint) (string, error) {
+	var usage []string
+	for _, ref := range references {
+		var count int64
+		if err := a.tx.Model(ref.model).Where(ref.column+" = ?", id).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count > 0 {
+			usage = append(usage, fmt.Sprintf("%d %s", count, ref.name))
+		}
+	}
+	return strings.Join(usage, ", "), nil
+}
+
+// pruneConnections deletes the connections the file does not declare, once
+// the destinations and schedules using them were dealt with.
+func (a *configApplier) pruneConnections() error {
+	if !a.opts.Prune {
+		return nil
+	}
+	declared := map[uint]bool{}
+	for _, id := range a.connections {
+		declared[id] = true
+	}
+
+	var existing []db.Connection
+	if err := a.tx.Order("id").Find(&existing).Error; err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if declared[e.ID] {
+			continue
+		}
+		usage, err := a.catalogUsage(catalogUsageOfConnection, e.ID)
+		if err != nil {
+			return err
+		}
+		note := ""
+		if usage != "" {
+			if !a.opts.Force {
+				a.fail("connection %s still has %s, prune it with force to delete them from the catalog", connectionName(e), usage)
+				continue
+			}
+			note = fmt.Sprintf("its %s are deleted with it, the backup files are kept", usage)
+		}
+		a.change("delete", "connection", connectionName(e), nil, note)
+		if a.apply {
+			if err := a.tx.Delete(&e).Error; err != nil {
+				return fmt.Errorf("failed to delete connection %s: %w", connectionName(e), err)
+			}
+		}
+	}
+	return nil
+}
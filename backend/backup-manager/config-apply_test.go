@@ -0,0 +1,148 @@
+package backup_manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretRefResolve(t *testing.T) {
+	secretsDir := t.TempDir()
+	t.Setenv("CONFIG_SECRETS_DIR", secretsDir)
+	t.Setenv("CONFIG_SECRETS_ENV_PREFIX", "PGBM_SECRET_")
+	t.Setenv("PGBM_SECRET_DB", "from-env")
+	t.Setenv("SECRET_KEY", "manager-key")
+
+	inside := filepath.Join(secretsDir, "s3_key")
+	if err := os.WriteFile(inside, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(outside, []byte("elsewhere\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(secretsDir, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ref        SecretRef
+		restricted bool
+		want       string
+		wantErr    string
+	}{
+		{name: "env", ref: SecretRef{Env: "SECRET_KEY"}, want: "manager-key"},
+		{name: "unset env", ref: SecretRef{Env: "PGBM_SECRET_MISSING"}, wantErr: "is not set"},
+		{name: "file, line break trimmed", ref: SecretRef{File: inside}, want: "from-file"},
+		{name: "any file", ref: SecretRef{File: outside}, want: "elsewhere"},
+		{name: "missing file", ref: SecretRef{File: filepath.Join(secretsDir, "missing")}, wantErr: "no such file"},
+		{name: "env and file", ref: SecretRef{Env: "PGBM_SECRET_DB", File: inside}, wantErr: "either env or file"},
+		{name: "neither", ref: SecretRef{}, wantErr: "env or file is required"},
+
+		{name: "restricted prefixed env", ref: SecretRef{Env: "PGBM_SECRET_DB"}, restricted: true, want: "from-env"},
+		{name: "restricted other env", ref: SecretRef{Env: "SECRET_KEY"}, restricted: true, wantErr: "must start with PGBM_SECRET_"},
+		{name: "restricted file in the secrets directory", ref: SecretRef{File: inside}, restricted: true, want: "from-file"},
+		{name: "restricted file elsewhere", ref: SecretRef{File: outside}, restricted: true, wantErr: "must be in"},
+		{name: "restricted proc file", ref: SecretRef{File: "/proc/self/environ"}, restricted: true, wantErr: "must be in"},
+		{name: "restricted dot dot", ref: SecretRef{File: filepath.Join(secretsDir, "..", filepath.Base(filepath.Dir(outside)), "other")}, restricted: true, wantErr: "must be in"},
+		{name: "restricted symlink out", ref: SecretRef{File: link}, restricted: true, wantErr: "must be in"},
+		{name: "restricted relative path", ref: SecretRef{File: "s3_key"}, restricted: true, wantErr: "absolute paths"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ref.resolve(tt.restricted)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDeclaredConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			yaml: `
+connections:
+  - name: app
+    host: db.internal
+    port: 5433
+    database: app
+    user: backup
+    password: {env: APP_DB_PASSWORD}
+schedules:
+  - connection: app
+    destination: offsite
+    schedule: "0 3 * * *"
+    options: {format: custom, compression: zstd}
+`,
+		},
+		{name: "empty", yaml: "", wantErr: "invalid configuration file"},
+		{name: "unknown top-level key", yaml: "connection:\n  - name: app\n", wantErr: "field connection not found"},
+		{name: "unknown connection key", yaml: "connections:\n  - name: app\n    hostname: db\n", wantErr: "field hostname not found"},
+		{name: "unknown secret key", yaml: "connections:\n  - name: app\n    password: {environment: X}\n", wantErr: "field environment not found"},
+		{name: "inline secret", yaml: "connections:\n  - name: app\n    password: hunter2\n", wantErr: "cannot unmarshal"},
+		{name: "not yaml", yaml: "connections: [", wantErr: "invalid configuration file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadDeclaredConfig([]byte(tt.yaml))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadDeclaredConfig() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadDeclaredConfig() error = %v", err)
+			}
+			if tt.name == "valid" {
+				c := config.Connections[0]
+				if c.Port != "5433" || c.Password.Env != "APP_DB_PASSWORD" || config.Schedules[0].Options["compression"] != "zstd" {
+					t.Errorf("LoadDeclaredConfig() = %+v", config)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizedOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "empty", value: "", want: `{"format":"custom"}`},
+		{name: "defaults filled in", value: `{"compression":"GZIP"}`, want: `{"format":"custom","compression":"gzip"}`},
+		{name: "already normalized", value: `{"format":"directory","jobs":4}`, want: `{"format":"directory","jobs":4}`},
+		{name: "field order", value: `{"jobs":4,"format":"directory"}`, want: `{"format":"directory","jobs":4}`},
+		{name: "invalid JSON kept", value: `{"format":`, want: `{"format":`},
+		{name: "invalid options kept", value: `{"format":"custom","jobs":4}`, want: `{"format":"custom","jobs":4}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizedOptions(tt.value); got != tt.want {
+				t.Errorf("normalizedOptions(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
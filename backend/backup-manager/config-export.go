@@ -0,0 +1,542 @@
+package backup_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"pg_bckup_mgr/auth"
+	"pg_bckup_mgr/db"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	CONFIG_EXPORT_FORMAT  = "pg_bckup_mgr-config"
+	CONFIG_EXPORT_VERSION = 1
+	MIN_PASSPHRASE_LENGTH = 12
+)
+
+// passphraseCheck is encrypted with the passphrase in every export, so a
+// wrong passphrase is rejected before anything is imported.
+const passphraseCheck = "pg_bckup_mgr"
+
+// ConfigExport is the manager's configuration in a form that can be moved
+// to another instance. Secrets are encrypted with the export's passphrase
+// instead of SECRET_KEY; IDs only link the entries of the export.
+type ConfigExport struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Check      string    `json:"check"`
+	// KeyCheck is a password hash of the empty string, which validates
+	// only under the same SECRET_KEY the users' password hashes were made
+	// with.
+	KeyCheck string `json:"key_check"`
+
+	Connections  []ExportedConnection  `json:"connections"`
+	Destinations []ExportedDestination `json:"destinations"`
+	Schedules    []ExportedSchedule    `json:"schedules"`
+	Hooks        []ExportedHook        `json:"hooks"`
+	WalStreams   []ExportedWalStream   `json:"wal_streams"`
+	Users        []ExportedUser        `json:"users"`
+}
+
+type ExportedConnection struct {
+	ID       uint   `json:"id"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	DBName   string `json:"db_name"`
+	User     string `json:"user"`
+	Password string `json:"password"` // encrypted with the passphrase
+}
+
+type ExportedDestination struct {
+	ID              uint   `json:"id"`
+	ConnectionID    uint   `json:"connection_id"`
+	Name            string `json:"name"`
+	EndpointURL     string `json:"endpoint_url"`
+	Region          string `json:"region"`
+	BucketName      string `json:"bucket_name"`
+	AccessKeyID     string `json:"access_key_id"`     // encrypted with the passphrase
+	SecretAccessKey string `json:"secret_access_key"` // encrypted with the passphrase
+	PathPrefix      string `json:"path_prefix"`
+	UseSSL          bool   `json:"use_ssl"`
+	VerifySSL       bool   `json:"verify_ssl"`
+}
+
+type ExportedSchedule struct {
+	ID                 uint         `json:"id"`
+	ConnectionID       uint         `json:"connection_id"`
+	DestinationID      uint         `json:"destination_id"`
+	Schedule           string       `json:"schedule"`
+	BackupType         string       `json:"backup_type"`
+	FullBackupEvery    int          `json:"full_backup_every"`
+	RetentionCount     int          `json:"retention_count"`
+	Options            string       `json:"options,omitempty"`
+	VerifyConnectionID *uint        `json:"verify_connection_id,omitempty"`
+	VerifyAssertions   string       `json:"verify_assertions,omitempty"`
+	CopyDestinations   []CopyTarget `json:"copy_destinations,omitempty"`
+	Enabled            bool         `json:"enabled"`
+}
+
+type ExportedHook struct {
+	ConnectionID   uint   `json:"connection_id"`
+	ScheduleID     *uint  `json:"schedule_id,omitempty"`
+	Name           string `json:"name"`
+	Stage          string `json:"stage"`
+	Kind           string `json:"kind"`
+	Command        string `json:"command"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	AbortOnFailure bool   `json:"abort_on_failure"`
+	Position       int    `json:"position"`
+	Enabled        bool   `json:"enabled"`
+}
+
+type ExportedWalStream struct {
+	ConnectionID  uint   `json:"connection_id"`
+	DestinationID *uint  `json:"destination_id,omitempty"`
+	SlotName      string `json:"slot_name"`
+	SegmentSize   int64  `json:"segment_size"`
+	Enabled       bool   `json:"enabled"`
+}
+
+type ExportedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // encrypted with the passphrase
+	Role         string `json:"role"`
+}
+
+// ConfigImportReport counts the imported entries by kind and lists the ones
+// that were skipped, because they already exist or could not be imported.
+type ConfigImportReport struct {
+	Created  map[string]int `json:"created"`
+	Skipped  []string       `json:"skipped"`
+	Warnings []string       `json:"warnings"`
+}
+
+func checkPassphrase(passphrase string) error {
+	if len(passphrase) < MIN_PASSPHRASE_LENGTH {
+		return fmt.Errorf("the passphrase must be at least %d characters long", MIN_PASSPHRASE_LENGTH)
+	}
+	return nil
+}
+
+// rewrap decrypts a secret stored under SECRET_KEY and encrypts it with the
+// passphrase.
+func rewrap(secret, passphrase string) (string, error) {
+	plain, err := auth.DecryptString(secret)
+	if err != nil {
+		return "", err
+	}
+	return auth.EncryptWithPassphrase(plain, passphrase)
+}
+
+// unwrap decrypts a secret encrypted with the passphrase and encrypts it
+// under this instance's SECRET_KEY.
+func unwrap(secret, passphrase string) (string, error) {
+	plain, err := auth.DecryptWithPassphrase(secret, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return auth.EncryptString(plain)
+}
+
+// ExportConfig exports the connections, destinations, schedules, hooks, WAL
+// streams and users, with their secrets encrypted with the passphrase. The
+// backup catalog is not part of it, see Reconcile.
+func ExportConfig(conn *gorm.DB, passphrase string) (*ConfigExport, error) {
+	if err := checkPassphrase(passphrase); err != nil {
+		return nil, err
+	}
+	export := &ConfigExport{Format: CONFIG_EXPORT_FORMAT, Version: CONFIG_EXPORT_VERSION, ExportedAt: time.Now()}
+	var err error
+	if export.Check, err = auth.EncryptWithPassphrase(passphraseCheck, passphrase); err != nil {
+		return nil, err
+	}
+	if export.KeyCheck, err = auth.HashPassword(""); err != nil {
+		return nil, err
+	}
+
+	var connections []db.Connection
+	var destinations []db.Destination
+	var schedules []db.BackupSchedule
+	var hooks []db.Hook
+	var streams []db.WalStream
+	var users []db.User
+	for _, result := range []*gorm.DB{
+		conn.Order("id").Find(&connections),
+		conn.Order("id").Find(&destinations),
+		conn.Order("id").Find(&schedules),
+		conn.Order("id").Find(&hooks),
+		conn.Order("id").Find(&streams),
+		conn.Order("id").Find(&users),
+	} {
+		if result.Error != nil {
+			return nil, fmt.Errorf("failed to load the configuration: %w", result.Error)
+		}
+	}
+
+	for _, c := range connections {
+		password, err := rewrap(c.PostgresPassword, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to export the password of connection %d: %w", c.ID, err)
+		}
+		export.Connections = append(export.Connections, ExportedConnection{
+			ID: c.ID, Host: c.PostgresHost, Port: c.PostgresPort, DBName: c.PostgresDBName, User: c.PostgresUser, Password: password,
+		})
+	}
+	for _, d := range destinations {
+		accessKeyID, err := rewrap(d.AccessKeyID, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to export the access key of destination %s: %w", d.Name, err)
+		}
+		secretAccessKey, err := rewrap(d.SecretAccessKey, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to export the secret key of destination %s: %w", d.Name, err)
+		}
+		export.Destinations = append(export.Destinations, ExportedDestination{
+			ID: d.ID, ConnectionID: d.ConnectionID, Name: d.Name, EndpointURL: d.EndpointURL, Region: d.Region,
+			BucketName: d.BucketName, AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey,
+			PathPrefix: d.PathPrefix, UseSSL: d.UseSSL, VerifySSL: d.VerifySSL,
+		})
+	}
+	for _, s := range schedules {
+		copies, err := ParseCopyTargets(s.CopyDestinations)
+		if err != nil {
+			log.Printf("Exporting schedule %d without its invalid copy destinations: %v", s.ID, err)
+		}
+		export.Schedules = append(export.Schedules, ExportedSchedule{
+			ID: s.ID, ConnectionID: s.ConnectionID, DestinationID: s.DestinationID, Schedule: s.Schedule,
+			BackupType: s.BackupType, FullBackupEvery: s.FullBackupEvery, RetentionCount: s.RetentionCount,
+			Options: s.Options, VerifyConnectionID: s.VerifyConnectionID, VerifyAssertions: s.VerifyAssertions,
+			CopyDestinations: copies, Enabled: s.Enabled,
+		})
+	}
+	for _, h := range hooks {
+		export.Hooks = append(export.Hooks, ExportedHook{
+			ConnectionID: h.ConnectionID, ScheduleID: h.ScheduleID, Name: h.Name, Stage: h.Stage, Kind: h.Kind,
+			Command: h.Command, TimeoutSeconds: h.TimeoutSeconds, AbortOnFailure: h.AbortOnFailure,
+			Position: h.Position, Enabled: h.Enabled,
+		})
+	}
+	for _, w := range streams {
+		export.WalStreams = append(export.WalStreams, ExportedWalStream{
+			ConnectionID: w.ConnectionID, DestinationID: w.DestinationID, SlotName: w.SlotName,
+			SegmentSize: w.SegmentSize, Enabled: w.Enabled,
+		})
+	}
+	for _, u := range users {
+		hash, err := auth.EncryptWithPassphrase(u.Password, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		export.Users = append(export.Users, ExportedUser{Username: u.Username, PasswordHash: hash, Role: u.Role})
+	}
+	return export, nil
+}
+
+// ImportConfig adds the configuration of an export to this instance, in a
+// single transaction. Entries that already exist, matched by connection
+// identity, destination name, schedule or user name, are kept as they are.
+// Users are only imported when both instances share SECRET_KEY, which
+// their password hashes depend on.
+func ImportConfig(conn *gorm.DB, data []byte, passphrase string) (ConfigImportReport, error) {
+	report := ConfigImportReport{Created: map[string]int{}}
+	var export ConfigExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return report, fmt.Errorf("invalid configuration export: %w", err)
+	}
+	if export.Format != CONFIG_EXPORT_FORMAT {
+		return report, fmt.Errorf("not a configuration export")
+	}
+	if export.Version > CONFIG_EXPORT_VERSION {
+		return report, fmt.Errorf("configuration export version %d is newer than this instance supports", export.Version)
+	}
+	if check, err := auth.DecryptWithPassphrase(export.Check, passphrase); err != nil || check != passphraseCheck {
+		return report, errors.New("wrong passphrase")
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		importer := configImporter{tx: tx, passphrase: passphrase, report: &report,
+			connections: map[uint]uint{}, destinations: map[uint]uint{}, schedules: map[uint]uint{}}
+		return importer.run(export)
+	})
+	if err != nil {
+		return ConfigImportReport{Created: map[string]int{}}, err
+	}
+	log.Printf("Imported configuration exported at %s: %v", export.ExportedAt.Format(time.RFC3339), report.Created)
+	return report, nil
+}
+
+// configImporter maps the IDs of the export to the IDs of this instance.
+type configImporter struct {
+	tx           *gorm.DB
+	passphrase   string
+	report       *ConfigImportReport
+	connections  map[uint]uint
+	destinations map[uint]uint
+	schedules    map[uint]uint
+}
+
+func (i *configImporter) skip(format string, args ...interface{}) {
+	i.report.Skipped = append(i.report.Skipped, fmt.Sprintf(format, args...))
+}
+
+func (i *configImporter) run(export ConfigExport) error {
+	steps := []func(ConfigExport) error{
+		i.importConnections,
+		i.importDestinations,
+		i.importSchedules,
+		i.importHooks,
+		i.importWalStreams,
+		i.importUsers,
+	}
+	for _, step := range steps {
+		if err := step(export); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *configImporter) importConnections(export ConfigExport) error {
+	for _, c := range export.Connections {
+		var existing db.Connection
+		err := i.tx.Where("postgres_host = ? AND postgres_port = ? AND postgres_db_name = ? AND postgres_user = ?",
+			c.Host, c.Port, c.DBName, c.User).First(&existing).Error
+		if err == nil {
+			i.connections[c.ID] = existing.ID
+			i.skip("connection %s@%s:%s/%s exists", c.User, c.Host, c.Port, c.DBName)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		password, err := unwrap(c.Password, i.passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to import the password of %s@%s:%s/%s: %w", c.User, c.Host, c.Port, c.DBName, err)
+		}
+		created := db.Connection{PostgresHost: c.Host, PostgresPort: c.Port, PostgresDBName: c.DBName, PostgresUser: c.User, PostgresPassword: password}
+		if err := i.tx.Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create connection %s@%s:%s/%s: %w", c.User, c.Host, c.Port, c.DBName, err)
+		}
+		i.connections[c.ID] = created.ID
+		i.report.Created["connections"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importDestinations(export ConfigExport) error {
+	for _, d := range export.Destinations {
+		var existing db.Destination
+		err := i.tx.Where("name = ?", d.Name).First(&existing).Error
+		if err == nil {
+			i.destinations[d.ID] = existing.ID
+			i.skip("destination %s exists", d.Name)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		connectionID, ok := i.connections[d.ConnectionID]
+		if !ok {
+			i.skip("destination %s: unknown connection %d", d.Name, d.ConnectionID)
+			continue
+		}
+
+		accessKeyID, err := unwrap(d.AccessKeyID, i.passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to import the access key of destination %s: %w", d.Name, err)
+		}
+		secretAccessKey, err := unwrap(d.SecretAccessKey, i.passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to import the secret key of destination %s: %w", d.Name, err)
+		}
+		created := db.Destination{
+			ConnectionID: connectionID, Name: d.Name, EndpointURL: d.EndpointURL, Region: d.Region,
+			BucketName: d.BucketName, AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey,
+			PathPrefix: d.PathPrefix, UseSSL: d.UseSSL, VerifySSL: d.VerifySSL,
+		}
+		// Select keeps false booleans, which gorm would replace with their
+		// defaults.
+		if err := i.tx.Select("*").Omit(clause.Associations, "ID").Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create destination %s: %w", d.Name, err)
+		}
+		i.destinations[d.ID] = created.ID
+		i.report.Created["destinations"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importSchedules(export ConfigExport) error {
+	for _, s := range export.Schedules {
+		connectionID, ok := i.connections[s.ConnectionID]
+		destinationID, destOK := i.destinations[s.DestinationID]
+		if !ok || !destOK {
+			i.skip("schedule %d: unknown connection or destination", s.ID)
+			continue
+		}
+
+		// There can only be one schedule per connection and destination.
+		var existing db.BackupSchedule
+		err := i.tx.Where("connection_id = ? AND destination_id = ?", connectionID, destinationID).First(&existing).Error
+		if err == nil {
+			i.schedules[s.ID] = existing.ID
+			i.skip("schedule %q of connection %d: the connection and destination have schedule %d at %q", s.Schedule, connectionID, existing.ID, existing.Schedule)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		created := db.BackupSchedule{
+			ConnectionID: connectionID, DestinationID: destinationID, Schedule: s.Schedule, BackupType: s.BackupType,
+			FullBackupEvery: s.FullBackupEvery, RetentionCount: s.RetentionCount, Options: s.Options,
+			VerifyAssertions: s.VerifyAssertions, Enabled: s.Enabled,
+		}
+		if s.VerifyConnectionID != nil {
+			if id, ok := i.connections[*s.VerifyConnectionID]; ok {
+				created.VerifyConnectionID = &id
+			} else {
+				i.report.Warnings = append(i.report.Warnings, fmt.Sprintf("schedule %d: dropped unknown verify connection", s.ID))
+			}
+		}
+		var copies []CopyTarget
+		for _, target := range s.CopyDestinations {
+			if target.DestinationID != nil {
+				id, ok := i.destinations[*target.DestinationID]
+				if !ok {
+					i.report.Warnings = append(i.report.Warnings, fmt.Sprintf("schedule %d: dropped copies to unknown %s", s.ID, target))
+					continue
+				}
+				target.DestinationID = &id
+			}
+			copies = append(copies, target)
+		}
+		created.CopyDestinations = encodeCopyTargets(copies)
+
+		if err := i.tx.Select("*").Omit(clause.Associations, "ID", "LastRun", "NextRun").Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create schedule %q: %w", s.Schedule, err)
+		}
+		i.schedules[s.ID] = created.ID
+		i.report.Created["schedules"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importHooks(export ConfigExport) error {
+	for _, h := range export.Hooks {
+		connectionID, ok := i.connections[h.ConnectionID]
+		if !ok {
+			i.skip("hook %s: unknown connection %d", h.Name, h.ConnectionID)
+			continue
+		}
+		var scheduleID *uint
+		if h.ScheduleID != nil {
+			id, ok := i.schedules[*h.ScheduleID]
+			if !ok {
+				i.skip("hook %s: unknown schedule %d", h.Name, *h.ScheduleID)
+				continue
+			}
+			scheduleID = &id
+		}
+
+		query := i.tx.Where("connection_id = ? AND name = ? AND stage = ?", connectionID, h.Name, h.Stage)
+		if scheduleID != nil {
+			query = query.Where("schedule_id = ?", *scheduleID)
+		} else {
+			query = query.Where("schedule_id IS NULL")
+		}
+		var existing db.Hook
+		err := query.First(&existing).Error
+		if err == nil {
+			i.skip("hook %s exists", h.Name)
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		created := db.Hook{
+			ConnectionID: connectionID, ScheduleID: scheduleID, Name: h.Name, Stage: h.Stage, Kind: h.Kind,
+			Command: h.Command, TimeoutSeconds: h.TimeoutSeconds, AbortOnFailure: h.AbortOnFailure,
+			Position: h.Position, Enabled: h.Enabled,
+		}
+		if err := i.tx.Select("*").Omit(clause.Associations, "ID").Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create hook %s: %w", h.Name, err)
+		}
+		i.report.Created["hooks"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importWalStreams(export ConfigExport) error {
+	for _, w := range export.WalStreams {
+		connectionID, ok := i.connections[w.ConnectionID]
+		if !ok {
+			i.skip("WAL stream %s: unknown connection %d", w.SlotName, w.ConnectionID)
+			continue
+		}
+		var count int64
+		if err := i.tx.Model(&db.WalStream{}).Where("connection_id = ?", connectionID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			i.skip("WAL stream of connection %d exists", connectionID)
+			continue
+		}
+
+		created := db.WalStream{
+			ConnectionID: connectionID, SlotName: w.SlotName, SegmentSize: w.SegmentSize,
+			Enabled: w.Enabled, Status: WalStreamStatusStopped,
+		}
+		if w.DestinationID != nil {
+			id, ok := i.destinations[*w.DestinationID]
+			if !ok {
+				i.skip("WAL stream %s: unknown destination %d", w.SlotName, *w.DestinationID)
+				continue
+			}
+			created.DestinationID = &id
+		}
+		if err := i.tx.Select("*").Omit(clause.Associations, "ID", "LastArchivedAt").Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create WAL stream %s: %w", w.SlotName, err)
+		}
+		i.report.Created["wal_streams"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importUsers(export ConfigExport) error {
+	if len(export.Users) == 0 {
+		return nil
+	}
+	if auth.ValidatePassword("", export.KeyCheck) != nil {
+		i.report.Warnings = append(i.report.Warnings,
+			"users were not imported, their passwords only work with the SECRET_KEY of the exporting instance")
+		return nil
+	}
+
+	for _, u := range export.Users {
+		var count int64
+		if err := i.tx.Model(&db.User{}).Where("username = ?", u.Username).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			i.skip("user %s exists", u.Username)
+			continue
+		}
+		hash, err := auth.DecryptWithPassphrase(u.PasswordHash, i.passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to import user %s: %w", u.Username, err)
+		}
+		if err := i.tx.Create(&db.User{Username: u.Username, Password: hash, Role: u.Role}).Error; err != nil {
+			return fmt.Errorf("failed to create user %s: %w", u.Username, err)
+		}
+		i.report.Created["users"]++
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package backup_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+func (t CopyTarget) String() string {
+	if t.DestinationID != nil {
+		return fmt.Sprintf("%s destination %d", t.DestinationType, *t.DestinationID)
+	}
+	return string(t.DestinationType)
+}
+
+func copyTargetOf(backupCopy db.BackupCopy) CopyTarget {
+	return CopyTarget{DestinationType: BackupDestination(backupCopy.DestinationType), DestinationID: backupCopy.DestinationID}
+}
+
+// ValidateCopyTargets checks that every copy target names an existing
+// destination, and none is listed twice. Local targets lose any
+// destination ID.
+func ValidateCopyTargets(conn *gorm.DB, targets []CopyTarget) error {
+	seen := map[string]bool{}
+	for i := range targets {
+		target := &targets[i]
+		switch target.DestinationType {
+		case BackupFilesystem:
+			target.DestinationID = nil
+		case BackupS3Bucket:
+			if target.DestinationID == nil {
+				return fmt.Errorf("s3 copies need a destination_id")
+			}
+			if _, err := db.GetBackupDestinationByID(conn, strconv.FormatUint(uint64(*target.DestinationID), 10)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported copy destination: %s", target.DestinationType)
+		}
+		if seen[target.String()] {
+			return fmt.Errorf("%s is listed twice", target)
+		}
+		seen[target.String()] = true
+	}
+	return nil
+}
+
+func encodeCopyTargets(targets []CopyTarget) string {
+	if len(targets) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(targets)
+	return string(data)
+}
+
+// ParseCopyTargets decodes the copy destinations stored on a schedule.
+func ParseCopyTargets(value string) ([]CopyTarget, error) {
+	var targets []CopyTarget
+	if value == "" {
+		return targets, nil
+	}
+	if err := json.Unmarshal([]byte(value), &targets); err != nil {
+		return nil, fmt.Errorf("invalid copy destinations: %w", err)
+	}
+	return targets, nil
+}
+
+// isStoredOn reports whether the target is the destination the manager
+// stores backups on.
+func (b BackupManager) isStoredOn(destination BackupDestination, target CopyTarget) bool {
+	if target.DestinationType != destination {
+		return false
+	}
+	if destination == BackupFilesystem {
+		return true
+	}
+	return b.BackupDestination != nil && target.DestinationID != nil && *target.DestinationID == b.BackupDestination.ID
+}
+
+// copyManager returns a manager storing backups of the same database on
+// the target.
+func (b BackupManager) copyManager(target CopyTarget) (BackupManager, error) {
+	manager := b
+	manager.Copies = nil
+	if target.DestinationType != BackupS3Bucket {
+		return manager, nil
+	}
+	if b.Catalog == nil || target.DestinationID == nil {
+		return manager, fmt.Errorf("unable to resolve %s", target)
+	}
+	dest, err := db.GetBackupDestinationByID(b.Catalog, strconv.FormatUint(uint64(*target.DestinationID), 10))
+	if err != nil {
+		return manager, err
+	}
+	manager.BackupDestination = &dest
+	return manager, nil
+}
+
+// replicateBackup copies a backup stored on destination to the manager's
+// copy targets and records every copy in the catalog. It reports whether a
+// copy is kept on the local filesystem, where backupPath already is, and
+// the errors of the copies that failed.
+func (b BackupManager) replicateBackup(record *db.Backup, destination BackupDestination, backupPath, checksum string) (bool, error) {
+	keepLocal := false
+	var errs []error
+	for _, target := range b.Copies {
+		if b.isStoredOn(destination, target) {
+			continue
+		}
+		log.Printf("Copying backup %s to %s", filepath.Base(backupPath), target)
+		b.Job.Logf("Copying backup to %s", target)
+
+		var backupCopy *db.BackupCopy
+		if record != nil {
+			backupCopy = &db.BackupCopy{
+				BackupID:        record.ID,
+				DestinationType: string(target.DestinationType),
+				DestinationID:   target.DestinationID,
+				Status:          BackupStatusRunning,
+			}
+			if err := db.CreateBackupCopy(b.Catalog, backupCopy); err != nil {
+				log.Printf("Unable to catalog copy of %s: %v", record.Filename, err)
+				backupCopy = nil
+			}
+		}
+
+		err := b.storeCopy(target, backupPath, checksum)
+		if err == nil && target.DestinationType == BackupFilesystem {
+			keepLocal = true
+		}
+		if err != nil {
+			log.Printf("Unable to copy backup %s to %s: %v", filepath.Base(backupPath), target, err)
+			b.Job.Logf("Copy to %s failed: %v", target, err)
+			errs = append(errs, fmt.Errorf("copy to %s failed: %w", target, err))
+		}
+
+		if backupCopy != nil {
+			backupCopy.Status = BackupStatusCompleted
+			if err != nil {
+				backupCopy.Status = BackupStatusFailed
+				backupCopy.Error = err.Error()
+			}
+			if err := db.UpdateBackupCopy(b.Catalog, backupCopy); err != nil {
+				log.Printf("Unable to update copy of %s: %v", record.Filename, err)
+			}
+			record.Copies = append(record.Copies, *backupCopy)
+		}
+	}
+	return keepLocal, errors.Join(errs...)
+}
+
+func (b BackupManager) storeCopy(target CopyTarget, backupPath, checksum string) error {
+	switch target.DestinationType {
+	case BackupFilesystem:
+		localPath := filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), filepath.Base(backupPath))
+		if localPath != backupPath {
+			if err := copyFile(backupPath, localPath); err != nil {
+				return err
+			}
+		}
+		return writeChecksumFile(localPath, checksum)
+
+	case BackupS3Bucket:
+		manager, err := b.copyManager(target)
+		if err != nil {
+			return err
+		}
+		S3Client, err := manager.newS3Client()
+		if err != nil {
+			return fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		S3Client.Progress = b.Job.StartPhase("copy to "+manager.BackupDestination.Name, "bytes")
+		return S3Client.UploadFileWithChecksum(backupPath, filepath.Base(backupPath), checksum)
+	}
+
+	return fmt.Errorf("unsupported copy destination: %s", target.DestinationType)
+}
+
+// fetchBackupCopy fetches a backup from the first of its completed copies
+// that is available, after fetching it from destination failed with
+// fetchErr.
+func (b BackupManager) fetchBackupCopy(destination BackupDestination, filename string, fetchErr error) (string, func(), error) {
+	record := b.lookupBackupRecord(filename)
+	if record == nil {
+		return "", nil, fetchErr
+	}
+	copies, err := db.ListBackupCopies(b.Catalog, record.ID)
+	if err != nil {
+		log.Printf("Unable to load copies of %s: %v", filename, err)
+		return "", nil, fetchErr
+	}
+
+	for _, backupCopy := range copies {
+		target := copyTargetOf(backupCopy)
+		if backupCopy.Status != BackupStatusCompleted || b.isStoredOn(destination, target) {
+			continue
+		}
+		manager, err := b.copyManager(target)
+		if err != nil {
+			log.Printf("Unable to use copy of %s on %s: %v", filename, target, err)
+			continue
+		}
+
+		log.Printf("Fetching backup %s failed (%v), trying its copy on %s", filename, fetchErr, target)
+		b.Job.Logf("Fetching backup failed (%v), trying its copy on %s", fetchErr, target)
+		backupPath, cleanup, err := manager.fetchStoredFile(target.DestinationType, filename)
+		if err == nil {
+			return backupPath, cleanup, nil
+		}
+		log.Printf("Unable to fetch copy of %s from %s: %v", filename, target, err)
+	}
+	return "", nil, fetchErr
+}
+
+// deleteBackupCopies deletes the stored copies of a backup. Copies that
+// cannot be deleted are left in the catalog with their error.
+func (b BackupManager) deleteBackupCopies(record *db.Backup) error {
+	copies, err := db.ListBackupCopies(b.Catalog, record.ID)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, backupCopy := range copies {
+		if backupCopy.Status != BackupStatusCompleted {
+			continue
+		}
+		target := copyTargetOf(backupCopy)
+		manager, err := b.copyManager(target)
+		if err == nil {
+			err = manager.deleteBackupFile(target.DestinationType, record.Filename)
+		}
+		if err != nil {
+			backupCopy.Error = err.Error()
+			errs = append(errs, fmt.Errorf("unable to delete copy on %s: %w", target, err))
+		} else {
+			backupCopy.Status = BackupStatusDeleted
+			backupCopy.Error = ""
+		}
+		if err := db.UpdateBackupCopy(b.Catalog, &backupCopy); err != nil {
+			log.Printf("Unable to update copy of %s: %v", record.Filename, err)
+		}
+	}
+	return errors.Join(errs...)
+}
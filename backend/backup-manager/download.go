@@ -0,0 +1,172 @@
+package backup_manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"gorm.io/gorm"
+)
+
+const (
+	DEFAULT_PRESIGN_TTL = 15 * time.Minute
+	MAX_PRESIGN_TTL     = 12 * time.Hour
+)
+
+// backupLocations lists where a catalogued backup can be read from: its
+// own destination first, then its completed copies.
+func backupLocations(backup db.Backup) []CopyTarget {
+	locations := []CopyTarget{{DestinationType: BackupDestination(backup.DestinationType), DestinationID: backup.DestinationID}}
+	if locations[0].DestinationType == BackupFilesystem {
+		locations[0].DestinationID = nil
+	}
+	for _, backupCopy := range backup.Copies {
+		if backupCopy.Status == BackupStatusCompleted {
+			locations = append(locations, copyTargetOf(backupCopy))
+		}
+	}
+	return locations
+}
+
+// ServeBackup writes a catalogued backup to w, honouring Range requests,
+// from its own destination or from a copy when that fails. Errors are only
+// returned when nothing was written yet.
+func ServeBackup(conn *gorm.DB, backup db.Backup, w http.ResponseWriter, r *http.Request) error {
+	if backup.Status != BackupStatusCompleted {
+		return fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+	manager, err := managerForBackup(conn, backup)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, location := range backupLocations(backup) {
+		locationManager, err := manager.copyManager(location)
+		if err == nil {
+			err = locationManager.serveStoredFile(location.DestinationType, backup, w, r)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Printf("Unable to serve backup %s from %s: %v", backup.Filename, location, err)
+		errs = append(errs, fmt.Errorf("%s: %w", location, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (b BackupManager) serveStoredFile(destination BackupDestination, backup db.Backup, w http.ResponseWriter, r *http.Request) error {
+	switch destination {
+	case BackupFilesystem:
+		f, err := os.Open(filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), backup.Filename))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		setDownloadHeaders(w, backup)
+		http.ServeContent(w, r, backup.Filename, info.ModTime(), f)
+		return nil
+
+	case BackupS3Bucket:
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			return fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		output, err := S3Client.OpenFile(r.Context(), backup.Filename, r.Header.Get("Range"))
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+				http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+				return nil
+			}
+			return err
+		}
+		defer output.Body.Close()
+
+		setDownloadHeaders(w, backup)
+		header := w.Header()
+		header.Set("Accept-Ranges", "bytes")
+		if output.ContentLength != nil {
+			header.Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+		}
+		if output.ETag != nil {
+			header.Set("ETag", *output.ETag)
+		}
+		if output.LastModified != nil {
+			header.Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+		}
+		status := http.StatusOK
+		if output.ContentRange != nil {
+			header.Set("Content-Range", *output.ContentRange)
+			status = http.StatusPartialContent
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			if _, err := io.Copy(w, output.Body); err != nil {
+				log.Printf("Download of backup %s interrupted: %v", backup.Filename, err)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported backup destination: %s", destination)
+}
+
+func setDownloadHeaders(w http.ResponseWriter, backup db.Backup) {
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backup.Filename))
+	if backup.Checksum != "" {
+		header.Set("X-Checksum-Sha256", backup.Checksum)
+	}
+}
+
+// PresignBackup returns a URL the backup can be downloaded from without
+// credentials until it expires, from its own destination or else the first
+// copy on S3.
+func PresignBackup(conn *gorm.DB, backup db.Backup, ttl time.Duration) (string, time.Time, error) {
+	if backup.Status != BackupStatusCompleted {
+		return "", time.Time{}, fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_PRESIGN_TTL
+	}
+	if ttl > MAX_PRESIGN_TTL {
+		return "", time.Time{}, fmt.Errorf("presigned URLs expire after at most %s", MAX_PRESIGN_TTL)
+	}
+
+	manager, err := managerForBackup(conn, backup)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	for _, location := range backupLocations(backup) {
+		if location.DestinationType != BackupS3Bucket {
+			continue
+		}
+		locationManager, err := manager.copyManager(location)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		S3Client, err := locationManager.newS3Client()
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		expiresAt := time.Now().Add(ttl)
+		url, err := S3Client.PresignDownload(backup.Filename, ttl)
+		return url, expiresAt, err
+	}
+	return "", time.Time{}, fmt.Errorf("backup %s is not stored on S3", backup.Filename)
+}
@@ -0,0 +1,204 @@
+package backup_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"pg_bckup_mgr/db"
+	"strings"
+)
+
+type DumpFormat string
+
+const (
+	DumpCustom    DumpFormat = "custom"
+	DumpDirectory DumpFormat = "directory"
+	DumpTar       DumpFormat = "tar"
+	DumpPlain     DumpFormat = "plain"
+)
+
+var compressionLevels = map[string][2]int{
+	"gzip": {1, 9},
+	"lz4":  {1, 12},
+	"zstd": {1, 22},
+}
+
+// BackupOptions controls how a logical backup is taken. They are stored as
+// JSON with every catalogued backup and on schedules.
+type BackupOptions struct {
+	Format           DumpFormat `json:"format,omitempty"`
+	Compression      string     `json:"compression,omitempty"` // gzip, lz4, zstd or none
+	CompressionLevel int        `json:"compression_level,omitempty"`
+	Jobs             int        `json:"jobs,omitempty"` // parallel workers, directory format only
+
+	// Selection, passed to pg_dump as -n, -N, -t, -T and --exclude-table-data
+	// patterns.
+	Schemas          []string `json:"schemas,omitempty"`
+	ExcludeSchemas   []string `json:"exclude_schemas,omitempty"`
+	Tables           []string `json:"tables,omitempty"`
+	ExcludeTables    []string `json:"exclude_tables,omitempty"`
+	ExcludeTableData []string `json:"exclude_table_data,omitempty"`
+	SchemaOnly       bool     `json:"schema_only,omitempty"`
+	DataOnly         bool     `json:"data_only,omitempty"`
+
+	// RecordRowCounts counts the rows of every table in the dump's snapshot
+	// so verification can compare them. Costs a full scan of each table.
+	RecordRowCounts bool `json:"record_row_counts,omitempty"`
+}
+
+// Normalize fills in defaults and rejects combinations pg_dump or the
+// restore path cannot handle.
+func (o *BackupOptions) Normalize() error {
+	switch o.Format {
+	case "":
+		o.Format = DumpCustom
+	case DumpCustom, DumpDirectory, DumpTar, DumpPlain:
+	default:
+		return fmt.Errorf("unsupported dump format: %s", o.Format)
+	}
+
+	if o.Jobs < 0 {
+		return fmt.Errorf("jobs must not be negative")
+	}
+	if o.Jobs > 1 && o.Format != DumpDirectory {
+		return fmt.Errorf("parallel dumps require the directory format")
+	}
+
+	if o.SchemaOnly && o.DataOnly {
+		return fmt.Errorf("schema_only and data_only cannot be used together")
+	}
+	for _, patterns := range [][]string{o.Schemas, o.ExcludeSchemas, o.Tables, o.ExcludeTables, o.ExcludeTableData} {
+		for _, pattern := range patterns {
+			if strings.TrimSpace(pattern) == "" {
+				return fmt.Errorf("schema and table patterns must not be empty")
+			}
+		}
+	}
+
+	o.Compression = strings.ToLower(o.Compression)
+	switch o.Compression {
+	case "", "none":
+		if o.CompressionLevel != 0 {
+			return fmt.Errorf("compression level requires a compression algorithm")
+		}
+	case "gzip", "lz4", "zstd":
+		if o.Format == DumpTar {
+			return fmt.Errorf("the tar format does not support compression")
+		}
+		if o.Format == DumpPlain && o.Compression != "gzip" {
+			return fmt.Errorf("plain format dumps can only be compressed with gzip")
+		}
+		limits := compressionLevels[o.Compression]
+		if o.CompressionLevel != 0 && (o.CompressionLevel < limits[0] || o.CompressionLevel > limits[1]) {
+			return fmt.Errorf("%s compression level must be between %d and %d", o.Compression, limits[0], limits[1])
+		}
+	default:
+		return fmt.Errorf("unsupported compression: %s", o.Compression)
+	}
+
+	return nil
+}
+
+// compressionArg renders the options as a pg_dump -Z value, or "" to keep
+// pg_dump's default for the format.
+func (o BackupOptions) compressionArg() string {
+	switch o.Compression {
+	case "":
+		return ""
+	case "none":
+		return "none"
+	}
+	if o.CompressionLevel != 0 {
+		return fmt.Sprintf("%s:%d", o.Compression, o.CompressionLevel)
+	}
+	return o.Compression
+}
+
+// selectionArgs renders the object selection as pg_dump arguments.
+func (o BackupOptions) selectionArgs() []string {
+	var args []string
+	for _, schema := range o.Schemas {
+		args = append(args, "-n", schema)
+	}
+	for _, schema := range o.ExcludeSchemas {
+		args = append(args, "-N", schema)
+	}
+	for _, table := range o.Tables {
+		args = append(args, "-t", table)
+	}
+	for _, table := range o.ExcludeTables {
+		args = append(args, "-T", table)
+	}
+	for _, table := range o.ExcludeTableData {
+		args = append(args, "--exclude-table-data", table)
+	}
+	if o.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if o.DataOnly {
+		args = append(args, "--data-only")
+	}
+	return args
+}
+
+// selective reports whether the dump covers only part of the database.
+func (o BackupOptions) selective() bool {
+	return len(o.Schemas) > 0 || len(o.ExcludeSchemas) > 0 || len(o.Tables) > 0 ||
+		len(o.ExcludeTables) > 0 || len(o.ExcludeTableData) > 0 || o.SchemaOnly || o.DataOnly
+}
+
+// fileExtension is the extension of the stored artifact for the format.
+// Directory format dumps are archived into a single tar file for storage.
+func (o BackupOptions) fileExtension() string {
+	switch o.Format {
+	case DumpDirectory:
+		return ".dir.tar"
+	case DumpTar:
+		return ".tar"
+	case DumpPlain:
+		if o.Compression == "gzip" {
+			return ".sql.gz"
+		}
+		return ".sql"
+	}
+	return ".dump"
+}
+
+func (o BackupOptions) String() string {
+	data, _ := json.Marshal(o)
+	return string(data)
+}
+
+func ParseBackupOptions(value string) (BackupOptions, error) {
+	var opts BackupOptions
+	if value == "" {
+		return opts, nil
+	}
+	if err := json.Unmarshal([]byte(value), &opts); err != nil {
+		return opts, fmt.Errorf("invalid backup options: %w", err)
+	}
+	return opts, nil
+}
+
+// dumpOptionsOf returns the options a logical backup was taken with, falling
+// back to what its file name implies for backups made before they were
+// recorded.
+func dumpOptionsOf(record *db.Backup, filename string) BackupOptions {
+	if record != nil && record.Options != "" {
+		if opts, err := ParseBackupOptions(record.Options); err == nil {
+			opts.Normalize()
+			return opts
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(filename, ".dir.tar"):
+		return BackupOptions{Format: DumpDirectory}
+	case strings.HasSuffix(filename, ".tar"):
+		return BackupOptions{Format: DumpTar}
+	case strings.HasSuffix(filename, ".sql.gz"):
+		return BackupOptions{Format: DumpPlain, Compression: "gzip"}
+	case strings.HasSuffix(filename, ".sql"):
+		return BackupOptions{Format: DumpPlain}
+	}
+	return BackupOptions{Format: DumpCustom}
+}
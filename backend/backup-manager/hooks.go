@@ -0,0 +1,263 @@
+package backup_manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"pg_bckup_mgr/db"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	HookPreBackup   = "pre_backup"
+	HookPostBackup  = "post_backup"
+	HookPreRestore  = "pre_restore"
+	HookPostRestore = "post_restore"
+)
+
+const (
+	HookSQL     = "sql"
+	HookCommand = "command"
+	HookHTTP    = "http"
+)
+
+const DEFAULT_HOOK_TIMEOUT_SECONDS = 60
+
+// commandHooksAllowed reports whether HOOKS_ALLOW_COMMANDS is set to true.
+// Command hooks run with the manager's environment, including SECRET_KEY,
+// so they are off unless the operator of the manager turns them on.
+func commandHooksAllowed() bool {
+	return os.Getenv("HOOKS_ALLOW_COMMANDS") == "true"
+}
+
+// hookAllowedHosts returns the hosts listed in HOOKS_HTTP_ALLOWED_HOSTS,
+// which http hooks may reach even when they resolve to private addresses.
+func hookAllowedHosts() map[string]bool {
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(os.Getenv("HOOKS_HTTP_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// publicAddress reports whether http hooks may connect to the address,
+// which excludes loopback, private, link-local (cloud metadata endpoints)
+// and unspecified addresses.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified())
+}
+
+// hookHTTPClient connects only to public addresses, except for the hosts of
+// HOOKS_HTTP_ALLOWED_HOSTS. The addresses are checked when connecting, so
+// redirects and DNS answers changing after validation are covered too.
+var hookHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			dialer := &net.Dialer{Timeout: 30 * time.Second}
+			if !hookAllowedHosts()[strings.ToLower(host)] {
+				dialer.Control = func(network, address string, _ syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+						return fmt.Errorf("http hooks must not connect to %s, see HOOKS_HTTP_ALLOWED_HOSTS", host)
+					}
+					return nil
+				}
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// ValidateHook checks a hook definition before it is stored and fills in
+// the default timeout.
+func ValidateHook(hook *db.Hook) error {
+	switch hook.Stage {
+	case HookPreBackup, HookPostBackup:
+	case HookPreRestore, HookPostRestore:
+		if hook.ScheduleID != nil {
+			return fmt.Errorf("schedule hooks can only run around backups")
+		}
+	default:
+		return fmt.Errorf("unsupported hook stage: %s", hook.Stage)
+	}
+
+	if strings.TrimSpace(hook.Command) == "" {
+		return fmt.Errorf("hook command must not be empty")
+	}
+	switch hook.Kind {
+	case HookSQL:
+	case HookCommand:
+		if !commandHooksAllowed() {
+			return fmt.Errorf("command hooks are disabled, set HOOKS_ALLOW_COMMANDS=true to enable them")
+		}
+	case HookHTTP:
+		u, err := url.Parse(hook.Command)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http hooks need an http or https URL")
+		}
+	default:
+		return fmt.Errorf("unsupported hook kind: %s", hook.Kind)
+	}
+
+	if hook.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if hook.TimeoutSeconds == 0 {
+		hook.TimeoutSeconds = DEFAULT_HOOK_TIMEOUT_SECONDS
+	}
+	return nil
+}
+
+// hookEvent describes the operation hooks run around. It is the body of
+// HTTP hooks and passed to commands as PGBM_* environment variables.
+type hookEvent struct {
+	Stage    string `json:"stage"`
+	Host     string `json:"host"`
+	Database string `json:"database"`
+	Filename string `json:"filename,omitempty"`
+	Status   string `json:"status,omitempty"` // completed or failed, post stages only
+	Error    string `json:"error,omitempty"`
+}
+
+// after turns the event of a pre stage into the one of its post stage.
+func (e hookEvent) after(stage, filename string, err error) hookEvent {
+	e.Stage = stage
+	if filename != "" {
+		e.Filename = filename
+	}
+	e.Status = "completed"
+	if err != nil {
+		e.Status = "failed"
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (e hookEvent) env() []string {
+	return []string{
+		"PGBM_STAGE=" + e.Stage,
+		"PGBM_HOST=" + e.Host,
+		"PGBM_DATABASE=" + e.Database,
+		"PGBM_FILENAME=" + e.Filename,
+		"PGBM_STATUS=" + e.Status,
+		"PGBM_ERROR=" + e.Error,
+	}
+}
+
+// runHooks runs the enabled hooks of the event's stage defined on the
+// connection, plus those of the manager's schedule. A failing hook with
+// AbortOnFailure stops the remaining ones and its error is returned; other
+// failures are only logged.
+func (b BackupManager) runHooks(connectionID uint, event hookEvent) error {
+	if b.Catalog == nil || connectionID == 0 {
+		return nil
+	}
+
+	query := b.Catalog.Where("connection_id = ? AND stage = ? AND enabled", connectionID, event.Stage)
+	if b.ScheduleID != nil {
+		query = query.Where("schedule_id IS NULL OR schedule_id = ?", *b.ScheduleID)
+	} else {
+		query = query.Where("schedule_id IS NULL")
+	}
+	var hooks []db.Hook
+	if err := query.Order("position, id").Find(&hooks).Error; err != nil {
+		return fmt.Errorf("failed to load %s hooks: %w", event.Stage, err)
+	}
+
+	for _, hook := range hooks {
+		log.Printf("Running %s hook %s", hook.Stage, hook.Name)
+		b.Job.Logf("Running %s hook %s", hook.Stage, hook.Name)
+
+		err := b.runHook(hook, event)
+		if err == nil {
+			continue
+		}
+		log.Printf("Hook %s failed: %v", hook.Name, err)
+		b.Job.Logf("Hook %s failed: %v", hook.Name, err)
+		if hook.AbortOnFailure {
+			return fmt.Errorf("%s hook %s failed: %w", hook.Stage, hook.Name, err)
+		}
+	}
+	return nil
+}
+
+func (b BackupManager) runHook(hook db.Hook, event hookEvent) error {
+	timeout := time.Duration(hook.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = DEFAULT_HOOK_TIMEOUT_SECONDS * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch hook.Kind {
+	case HookSQL:
+		conn, err := b.Connect()
+		if err != nil {
+			return fmt.Errorf("database connection failed: %v", err)
+		}
+		sqlDB, _ := conn.DB()
+		defer sqlDB.Close()
+		return conn.WithContext(ctx).Exec(hook.Command).Error
+
+	case HookCommand:
+		// Hooks stored, or imported, before command hooks were disabled
+		if !commandHooksAllowed() {
+			return fmt.Errorf("command hooks are disabled, set HOOKS_ALLOW_COMMANDS=true to enable them")
+		}
+		cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+		cmd.Env = append(os.Environ(), event.env()...)
+		if b.Job != nil {
+			cmd.Stdout = b.Job
+		}
+		// Background processes started by the command may keep its output
+		// open after it was killed on timeout.
+		cmd.WaitDelay = 5 * time.Second
+		return b.runCommand(cmd)
+
+	case HookHTTP:
+		body, _ := json.Marshal(event)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Command, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := hookHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		response, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if len(response) > 0 {
+			b.Job.Logf("%s", strings.TrimSpace(string(response)))
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s responded with %s", hook.Command, resp.Status)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported hook kind: %s", hook.Kind)
+}
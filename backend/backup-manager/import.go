@@ -0,0 +1,266 @@
+package backup_manager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strings"
+	"time"
+)
+
+// AdoptReport lists the files an adopt scan catalogued and why it left the
+// other matching files alone.
+type AdoptReport struct {
+	Adopted []db.Backup       `json:"adopted"`
+	Skipped map[string]string `json:"skipped"` // filename to reason
+}
+
+// detectDump works out what kind of dump a file created outside of the
+// manager is from its contents.
+func detectDump(dumpPath string) (BackupType, BackupOptions, error) {
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		return "", BackupOptions{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", BackupOptions{}, fmt.Errorf("failed to read %s: %w", filepath.Base(dumpPath), err)
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PGDMP")):
+		return BackupLogical, BackupOptions{Format: DumpCustom}, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return BackupLogical, BackupOptions{Format: DumpPlain, Compression: "gzip"}, nil
+	case len(header) > 262 && string(header[257:262]) == "ustar":
+		f.Seek(0, io.SeekStart)
+		return detectTarDump(f)
+	}
+
+	// Plain SQL starts with pg_dump's or pg_dumpall's header comment.
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(header), f))
+	for i := 0; i < 10; i++ {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-- PostgreSQL database cluster dump") {
+			return BackupGlobals, BackupOptions{}, nil
+		}
+		if strings.HasPrefix(line, "-- PostgreSQL database dump") {
+			return BackupLogical, BackupOptions{Format: DumpPlain}, nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	return "", BackupOptions{}, fmt.Errorf("%s is not a pg_dump or pg_dumpall file", filepath.Base(dumpPath))
+}
+
+// detectTarDump tells pg_dump's tar format, which has a restore.sql,
+// from a directory format dump archived into a tar file.
+func detectTarDump(f *os.File) (BackupType, BackupOptions, error) {
+	tr := tar.NewReader(f)
+	hasToc := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", BackupOptions{}, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		switch header.Name {
+		case "restore.sql":
+			return BackupLogical, BackupOptions{Format: DumpTar}, nil
+		case "toc.dat":
+			hasToc = true
+		}
+	}
+	if hasToc {
+		return BackupLogical, BackupOptions{Format: DumpDirectory}, nil
+	}
+	return "", BackupOptions{}, fmt.Errorf("tar archive does not contain a dump, toc.dat is missing")
+}
+
+// inspectImport detects and validates a dump to be imported and returns
+// its catalog entry, not stored yet.
+func (b BackupManager) inspectImport(dumpPath, filename string) (*db.Backup, error) {
+	backupType, opts, err := detectDump(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := b.validateDump(dumpPath, backupType, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed validation: %w", filename, err)
+	}
+	checksum, err := fileChecksum(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := info.ModTime()
+	record := &db.Backup{
+		ConnectionID: b.ConnectionID,
+		BackupType:   string(backupType),
+		Filename:     filename,
+		Status:       BackupStatusCompleted,
+		SizeBytes:    info.Size(),
+		Checksum:     checksum,
+		StartedAt:    createdAt,
+		FinishedAt:   &createdAt,
+	}
+	if backupType == BackupLogical {
+		record.Format = string(opts.Format)
+		record.Compression = opts.Compression
+		record.Options = opts.String()
+	}
+	setValidation(record, counts, nil)
+	return record, nil
+}
+
+// ImportBackup catalogs a dump created outside of the manager, e.g. an
+// uploaded file, once it passed validation, and stores it on the
+// destination under filename. sourcePath is moved away when possible.
+func (b BackupManager) ImportBackup(destination BackupDestination, sourcePath, filename string) (*db.Backup, error) {
+	if b.Catalog == nil {
+		return nil, fmt.Errorf("importing backups requires the catalog")
+	}
+	filename = filepath.Base(filename)
+	if filename == "." || filename == string(filepath.Separator) || strings.HasPrefix(filename, ".") ||
+		strings.HasSuffix(filename, CHECKSUM_SUFFIX) || strings.HasSuffix(filename, METADATA_SUFFIX) {
+		return nil, fmt.Errorf("invalid backup filename: %s", filename)
+	}
+	if b.lookupBackupRecord(filename) != nil {
+		return nil, fmt.Errorf("backup %s is already catalogued", filename)
+	}
+
+	record, err := b.inspectImport(sourcePath, filename)
+	if err != nil {
+		return nil, err
+	}
+	record.DestinationType = string(destination)
+	record.Log = "Imported from an uploaded file"
+
+	switch destination {
+	case BackupFilesystem:
+		localPath := filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), filename)
+		if _, err := os.Stat(localPath); err == nil {
+			return nil, fmt.Errorf("%s already exists, adopt it instead", filename)
+		}
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err := os.Rename(sourcePath, localPath); err != nil {
+			if err := copyFile(sourcePath, localPath); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeChecksumFile(localPath, record.Checksum); err != nil {
+			log.Printf("Unable to write checksum file for %s: %v", localPath, err)
+		}
+
+	case BackupS3Bucket:
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			return nil, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		S3Client.Progress = b.Job.StartPhase("upload", "bytes")
+		if err := S3Client.UploadFileWithChecksum(sourcePath, filename, record.Checksum); err != nil {
+			return nil, err
+		}
+		checkedAt := time.Now()
+		record.DestinationID = &b.BackupDestination.ID
+		record.Integrity = IntegrityOK
+		record.IntegrityCheckedAt = &checkedAt
+
+	default:
+		return nil, fmt.Errorf("unsupported backup destination: %s", destination)
+	}
+
+	if err := db.CreateBackupRecord(b.Catalog, record); err != nil {
+		return nil, err
+	}
+	b.publishMetadata(record)
+	log.Printf("Imported backup %s to %s", filename, destination)
+	return record, nil
+}
+
+// AdoptBackups catalogs the files on the destination whose names match
+// pattern, a shell glob such as "nightly_*.dump", and that are not
+// catalogued yet. Files are left where they are; those that are not valid
+// dumps are skipped.
+func (b BackupManager) AdoptBackups(destination BackupDestination, pattern string) (AdoptReport, error) {
+	report := AdoptReport{Skipped: map[string]string{}}
+	if b.Catalog == nil {
+		return report, fmt.Errorf("adopting backups requires the catalog")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return report, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	for _, filename := range b.ListAvaiableBackups(destination) {
+		if matched, _ := path.Match(pattern, filename); !matched {
+			continue
+		}
+		if b.lookupBackupRecord(filename) != nil {
+			continue
+		}
+
+		b.Job.Logf("Adopting %s", filename)
+		record, err := b.adoptBackup(destination, filename)
+		if err != nil {
+			log.Printf("Not adopting %s: %v", filename, err)
+			b.Job.Logf("Skipped %s: %v", filename, err)
+			report.Skipped[filename] = err.Error()
+			continue
+		}
+		report.Adopted = append(report.Adopted, *record)
+	}
+
+	if len(report.Adopted) == 0 && len(report.Skipped) > 0 {
+		return report, errors.New("none of the matching files could be adopted")
+	}
+	return report, nil
+}
+
+func (b BackupManager) adoptBackup(destination BackupDestination, filename string) (*db.Backup, error) {
+	backupPath, cleanup, err := b.fetchStoredFile(destination, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	record, err := b.inspectImport(backupPath, filename)
+	if err != nil {
+		return nil, err
+	}
+	record.DestinationType = string(destination)
+	record.Log = "Adopted from an existing file"
+	if destination == BackupS3Bucket {
+		record.DestinationID = &b.BackupDestination.ID
+	}
+	if destination == BackupFilesystem {
+		if err := writeChecksumFile(backupPath, record.Checksum); err != nil {
+			log.Printf("Unable to write checksum file for %s: %v", backupPath, err)
+		}
+	}
+
+	if err := db.CreateBackupRecord(b.Catalog, record); err != nil {
+		return nil, err
+	}
+	b.publishMetadata(record)
+	return record, nil
+}
@@ -0,0 +1,138 @@
+package backup_manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tarArchive(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		content := []byte("content of " + name)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Format: tar.FormatUSTAR}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(data))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectDump(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantType   BackupType
+		wantFormat DumpFormat
+		wantGzip   bool
+		wantErr    bool
+	}{
+		{name: "custom", data: []byte("PGDMP\x01\x10\x00"), wantType: BackupLogical, wantFormat: DumpCustom},
+		{name: "gzipped plain", data: gzipped(t, "-- PostgreSQL database dump\n"), wantType: BackupLogical, wantFormat: DumpPlain, wantGzip: true},
+		{name: "plain", data: []byte("--\n-- PostgreSQL database dump\n--\n\nSET statement_timeout = 0;\n"), wantType: BackupLogical, wantFormat: DumpPlain},
+		{name: "globals", data: []byte("--\n-- PostgreSQL database cluster dump\n--\n"), wantType: BackupGlobals},
+		{name: "tar format", data: tarArchive(t, "toc.dat", "3456.dat", "restore.sql"), wantType: BackupLogical, wantFormat: DumpTar},
+		{name: "archived directory format", data: tarArchive(t, "toc.dat", "3456.dat.gz"), wantType: BackupLogical, wantFormat: DumpDirectory},
+		{name: "tar without a dump", data: tarArchive(t, "notes.txt"), wantErr: true},
+		{name: "sql not written by pg_dump", data: []byte("CREATE TABLE t (id int);\n"), wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupType, opts, err := detectDump(writeTestFile(t, "dump", tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("detectDump() = %s %+v, want an error", backupType, opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("detectDump() error = %v", err)
+			}
+			if backupType != tt.wantType || opts.Format != tt.wantFormat || (opts.Compression == "gzip") != tt.wantGzip {
+				t.Errorf("detectDump() = %s %+v, want %s format %q gzip %t", backupType, opts, tt.wantType, tt.wantFormat, tt.wantGzip)
+			}
+		})
+	}
+}
+
+func TestDetectTarDump(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		wantFormat DumpFormat
+		wantErr    bool
+	}{
+		{name: "restore.sql first", files: []string{"restore.sql", "toc.dat"}, wantFormat: DumpTar},
+		{name: "restore.sql last", files: []string{"toc.dat", "1.dat", "restore.sql"}, wantFormat: DumpTar},
+		{name: "toc.dat only", files: []string{"toc.dat", "1.dat.gz", "2.dat.gz"}, wantFormat: DumpDirectory},
+		{name: "toc.dat in a subdirectory", files: []string{"dump/toc.dat"}, wantErr: true},
+		{name: "empty archive", files: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(writeTestFile(t, "dump.tar", tarArchive(t, tt.files...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			backupType, opts, err := detectTarDump(f)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("detectTarDump() = %s %+v, want an error", backupType, opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("detectTarDump() error = %v", err)
+			}
+			if backupType != BackupLogical || opts.Format != tt.wantFormat {
+				t.Errorf("detectTarDump() = %s %+v, want logical format %q", backupType, opts, tt.wantFormat)
+			}
+		})
+	}
+
+	t.Run("not a tar archive", func(t *testing.T) {
+		f, err := os.Open(writeTestFile(t, "dump.tar", bytes.Repeat([]byte("x"), 1024)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, _, err := detectTarDump(f); err == nil {
+			t.Error("detectTarDump() succeeded on garbage")
+		}
+	})
+}
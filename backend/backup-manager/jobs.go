@@ -0,0 +1,261 @@
+package backup_manager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+const (
+	// maxJobLogLines bounds the log kept per job and stored in the catalog.
+	maxJobLogLines = 2000
+	// jobRetention is how long finished jobs stay available for the API.
+	jobRetention = 24 * time.Hour
+)
+
+// Job is a running or recently finished backup or restore. Output of the
+// PostgreSQL tools it runs is collected line by line and fanned out to
+// subscribers, e.g. the event stream API.
+type Job struct {
+	ID          string
+	Kind        string
+	Description string
+
+	mu          sync.Mutex
+	status      string
+	err         string
+	startedAt   time.Time
+	finishedAt  *time.Time
+	lines       []string
+	partial     []byte
+	progress    *JobProgress
+	subscribers map[chan string]struct{}
+	done        chan struct{}
+}
+
+var (
+	jobs   = make(map[string]*Job)
+	jobsMu sync.Mutex
+)
+
+// NewJob registers a running job of the given kind (backup or restore).
+func NewJob(kind, description string) *Job {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	job := &Job{
+		ID:          hex.EncodeToString(id),
+		Kind:        kind,
+		Description: description,
+		status:      JobRunning,
+		startedAt:   time.Now(),
+		subscribers: make(map[chan string]struct{}),
+		done:        make(chan struct{}),
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, old := range jobs {
+		if finished := old.FinishedAt(); finished != nil && time.Since(*finished) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+	jobs[job.ID] = job
+
+	return job
+}
+
+func GetJob(id string) (*Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	job, ok := jobs[id]
+	return job, ok
+}
+
+// ListJobs returns the known jobs, newest first.
+func ListJobs() []*Job {
+	jobsMu.Lock()
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job)
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].startedAt.After(list[j].startedAt)
+	})
+	return list
+}
+
+// Write adds output to the job log. Complete lines are published to the
+// subscribers right away.
+func (j *Job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.partial = append(j.partial, p...)
+	for {
+		i := bytes.IndexByte(j.partial, '\n')
+		if i < 0 {
+			break
+		}
+		j.appendLine(strings.TrimRight(string(j.partial[:i]), "\r"))
+		j.partial = j.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Logf adds a message of the manager itself to the job log.
+func (j *Job) Logf(format string, args ...interface{}) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.appendLine(fmt.Sprintf(format, args...))
+}
+
+func (j *Job) appendLine(line string) {
+	j.lines = append(j.lines, line)
+	if len(j.lines) > maxJobLogLines {
+		j.lines = j.lines[len(j.lines)-maxJobLogLines:]
+	}
+	for ch := range j.subscribers {
+		// Slow subscribers miss lines rather than stall the job.
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Finish marks the job done and ends all subscriptions.
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.finishedAt != nil {
+		return
+	}
+	if len(j.partial) > 0 {
+		j.appendLine(string(j.partial))
+		j.partial = nil
+	}
+
+	finishedAt := time.Now()
+	j.finishedAt = &finishedAt
+	j.status = JobCompleted
+	if err != nil {
+		j.status = JobFailed
+		j.err = err.Error()
+	}
+	close(j.done)
+}
+
+// Subscribe returns the log so far and a channel receiving every following
+// line. Done is closed when the job finishes; cancel ends the subscription.
+func (j *Job) Subscribe() (history []string, lines <-chan string, cancel func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan string, 256)
+	j.subscribers[ch] = struct{}{}
+	history = append([]string(nil), j.lines...)
+
+	cancel = func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		delete(j.subscribers, ch)
+	}
+	return history, ch, cancel
+}
+
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *Job) FinishedAt() *time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finishedAt
+}
+
+// Log returns the collected output.
+func (j *Job) Log() string {
+	if j == nil {
+		return ""
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return strings.Join(j.lines, "\n")
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return json.Marshal(struct {
+		ID          string       `json:"id"`
+		Kind        string       `json:"kind"`
+		Description string       `json:"description"`
+		Status      string       `json:"status"`
+		Error       string       `json:"error,omitempty"`
+		StartedAt   time.Time    `json:"started_at"`
+		FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+		Progress    *JobProgress `json:"progress,omitempty"`
+	}{j.ID, j.Kind, j.Description, j.status, j.err, j.startedAt, j.finishedAt, j.progressLocked()})
+}
+
+// runCommand runs a PostgreSQL tool with its stderr going to the job log
+// and any extra writers. When the tool fails, its last line of output
+// becomes part of the error instead of a bare exit status.
+func (b BackupManager) runCommand(cmd *exec.Cmd, extra ...io.Writer) error {
+	stderr := &tailBuffer{max: 4096}
+	writers := append([]io.Writer{stderr}, extra...)
+	if b.Job != nil {
+		writers = append(writers, b.Job)
+	}
+	cmd.Stderr = io.MultiWriter(writers...)
+
+	if err := cmd.Run(); err != nil {
+		if line := stderr.lastLine(); line != "" {
+			return fmt.Errorf("%s: %w (%s)", cmd.Args[0], err, line)
+		}
+		return fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	return nil
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) lastLine() string {
+	lines := strings.Split(strings.TrimSpace(string(t.buf)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,37 @@
+package backup_manager
+
+import "testing"
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		writes   []string
+		wantBuf  string
+		wantLine string
+	}{
+		{name: "nothing written", max: 16, writes: nil, wantBuf: "", wantLine: ""},
+		{name: "under the limit", max: 16, writes: []string{"one\n", "two\n"}, wantBuf: "one\ntwo\n", wantLine: "two"},
+		{name: "over the limit", max: 8, writes: []string{"first line\n", "second\n"}, wantBuf: "\nsecond\n", wantLine: "second"},
+		{name: "one large write", max: 4, writes: []string{"abcdefgh"}, wantBuf: "efgh", wantLine: "efgh"},
+		{name: "trailing blank lines", max: 64, writes: []string{"pg_dump: error: connection refused\n\n  \n"}, wantLine: "pg_dump: error: connection refused", wantBuf: "pg_dump: error: connection refused\n\n  \n"},
+		{name: "line split across writes", max: 64, writes: []string{"pg_restore: err", "or: bad input\n"}, wantBuf: "pg_restore: error: bad input\n", wantLine: "pg_restore: error: bad input"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tailBuffer{max: tt.max}
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if string(b.buf) != tt.wantBuf {
+				t.Errorf("buffer = %q, want %q", b.buf, tt.wantBuf)
+			}
+			if got := b.lastLine(); got != tt.wantLine {
+				t.Errorf("lastLine() = %q, want %q", got, tt.wantLine)
+			}
+		})
+	}
+}
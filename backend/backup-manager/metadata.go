@@ -0,0 +1,203 @@
+package backup_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// METADATA_SUFFIX is appended to a backup's name for its metadata sidecar,
+// which describes the backup well enough to catalog it again without the
+// manager's database, see Reconcile.
+const METADATA_SUFFIX = ".meta.json"
+
+const (
+	METADATA_VERSION   = 1
+	MAX_METADATA_BYTES = 1 << 20
+)
+
+// BackupMetadata is the content of a metadata sidecar.
+type BackupMetadata struct {
+	Version int `json:"version"`
+
+	// Identity of the connection the backup was taken from
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+
+	Filename       string          `json:"filename"`
+	BackupType     string          `json:"backup_type"`
+	Format         string          `json:"format,omitempty"`
+	Compression    string          `json:"compression,omitempty"`
+	Options        json.RawMessage `json:"options,omitempty"`
+	ParentFilename string          `json:"parent_filename,omitempty"` // previous backup of an incremental chain
+	Checksum       string          `json:"checksum,omitempty"`
+	SizeBytes      int64           `json:"size_bytes"`
+	WalTimeline    uint            `json:"wal_timeline,omitempty"`
+	WalStartLSN    string          `json:"wal_start_lsn,omitempty"`
+	WalEndLSN      string          `json:"wal_end_lsn,omitempty"`
+	Validation     string          `json:"validation,omitempty"`
+	ObjectCounts   json.RawMessage `json:"object_counts,omitempty"`
+	TableStats     json.RawMessage `json:"table_stats,omitempty"`
+	StartedAt      time.Time       `json:"started_at"`
+	FinishedAt     *time.Time      `json:"finished_at,omitempty"`
+}
+
+// rawJSON keeps a JSON column as is in the sidecar, dropping values that
+// are not valid JSON.
+func rawJSON(value string) json.RawMessage {
+	if value == "" || !json.Valid([]byte(value)) {
+		return nil
+	}
+	return json.RawMessage(value)
+}
+
+func (b BackupManager) backupMetadata(record *db.Backup) BackupMetadata {
+	metadata := BackupMetadata{
+		Version:      METADATA_VERSION,
+		Host:         b.Host,
+		Port:         b.Port,
+		Database:     b.DBName,
+		User:         b.User,
+		Filename:     record.Filename,
+		BackupType:   record.BackupType,
+		Format:       record.Format,
+		Compression:  record.Compression,
+		Options:      rawJSON(record.Options),
+		Checksum:     record.Checksum,
+		SizeBytes:    record.SizeBytes,
+		WalTimeline:  record.WalTimeline,
+		WalStartLSN:  record.WalStartLSN,
+		WalEndLSN:    record.WalEndLSN,
+		Validation:   record.Validation,
+		ObjectCounts: rawJSON(record.ObjectCounts),
+		TableStats:   rawJSON(record.TableStats),
+		StartedAt:    record.StartedAt,
+		FinishedAt:   record.FinishedAt,
+	}
+	if record.ParentBackupID != nil && b.Catalog != nil {
+		parent, err := db.GetBackupRecordByID(b.Catalog, strconv.FormatUint(uint64(*record.ParentBackupID), 10))
+		if err == nil {
+			metadata.ParentFilename = parent.Filename
+		}
+	}
+	return metadata
+}
+
+// catalogEntry returns the catalog entry described by the metadata, stored
+// on the target and not created yet.
+func (m BackupMetadata) catalogEntry(connectionID uint, target CopyTarget) *db.Backup {
+	record := &db.Backup{
+		ConnectionID:    connectionID,
+		DestinationType: string(target.DestinationType),
+		DestinationID:   target.DestinationID,
+		BackupType:      m.BackupType,
+		Format:          m.Format,
+		Compression:     m.Compression,
+		Options:         string(m.Options),
+		Checksum:        m.Checksum,
+		SizeBytes:       m.SizeBytes,
+		WalTimeline:     m.WalTimeline,
+		WalStartLSN:     m.WalStartLSN,
+		WalEndLSN:       m.WalEndLSN,
+		Validation:      m.Validation,
+		ObjectCounts:    string(m.ObjectCounts),
+		TableStats:      string(m.TableStats),
+		Filename:        m.Filename,
+		Status:          BackupStatusCompleted,
+		StartedAt:       m.StartedAt,
+		FinishedAt:      m.FinishedAt,
+		Log:             "Restored from its metadata sidecar",
+	}
+	if record.BackupType == "" {
+		record.BackupType = string(BackupLogical)
+	}
+	return record
+}
+
+// storeMetadata writes the metadata sidecar of a backup stored on the
+// destination.
+func (b BackupManager) storeMetadata(destination BackupDestination, record *db.Backup) error {
+	data, err := json.MarshalIndent(b.backupMetadata(record), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch destination {
+	case BackupFilesystem:
+		metadataPath := filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), record.Filename+METADATA_SUFFIX)
+		return os.WriteFile(metadataPath, data, 0644)
+
+	case BackupS3Bucket:
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			return fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		return S3Client.UploadData(record.Filename+METADATA_SUFFIX, data)
+	}
+
+	return fmt.Errorf("unsupported backup destination: %s", destination)
+}
+
+// publishMetadata writes the metadata sidecar next to the backup and every
+// completed copy of it. Failures are only logged, the backup is usable
+// without its sidecar.
+func (b BackupManager) publishMetadata(record *db.Backup) {
+	if record == nil || record.Status != BackupStatusCompleted {
+		return
+	}
+	for _, location := range backupLocations(*record) {
+		manager, err := b.copyManager(location)
+		if err == nil {
+			err = manager.storeMetadata(location.DestinationType, record)
+		}
+		if err != nil {
+			log.Printf("Unable to write metadata of backup %s to %s: %v", record.Filename, location, err)
+		}
+	}
+}
+
+// readMetadata reads the metadata sidecar of a backup stored on the
+// destination. It returns nil without an error when there is none.
+func (b BackupManager) readMetadata(destination BackupDestination, filename string) (*BackupMetadata, error) {
+	var data []byte
+	var err error
+	switch destination {
+	case BackupFilesystem:
+		data, err = os.ReadFile(filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), filename+METADATA_SUFFIX))
+	case BackupS3Bucket:
+		var S3Client *S3Client
+		S3Client, err = b.newS3Client()
+		if err != nil {
+			return nil, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		data, err = S3Client.ReadData(filename+METADATA_SUFFIX, MAX_METADATA_BYTES)
+	default:
+		return nil, fmt.Errorf("unsupported backup destination: %s", destination)
+	}
+	if err != nil {
+		var apiErr smithy.APIError
+		if os.IsNotExist(err) || errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var metadata BackupMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %w", filename, err)
+	}
+	if metadata.Filename != filename {
+		return nil, fmt.Errorf("metadata of %s describes %s", filename, metadata.Filename)
+	}
+	return &metadata, nil
+}
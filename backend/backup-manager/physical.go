@@ -0,0 +1,521 @@
+package backup_manager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strings"
+)
+
+// walRange is the WAL needed to make a base backup consistent, as recorded
+// in its backup_manifest.
+type walRange struct {
+	Timeline uint   `json:"Timeline"`
+	StartLSN string `json:"Start-LSN"`
+	EndLSN   string `json:"End-LSN"`
+}
+
+// createPgBaseBackup takes a compressed, tar-format base backup of the whole
+// cluster and packs pg_basebackup's output (base.tar.gz, pg_wal.tar.gz and
+// backup_manifest) into a single archive at outputPath. When parentManifest
+// is set the backup is incremental relative to the backup it describes.
+func (b BackupManager) createPgBaseBackup(outputPath, parentManifest string) (walRange, error) {
+	workDir, err := os.MkdirTemp(LOCAL_BACKUP_DIR, ".basebackup-")
+	if err != nil {
+		return walRange{}, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	args := []string{
+		"-h", b.Host,
+		"-p", b.Port,
+		"-U", b.User,
+		"-D", workDir,
+		"-Ft",
+		"-z",
+		"-X", "stream",
+		"--checkpoint=fast",
+		"--manifest-checksums=SHA256",
+		"-w",
+	}
+	if parentManifest != "" {
+		args = append(args, "--incremental="+parentManifest)
+	}
+
+	if err := b.runCommand(b.pgCommand("pg_basebackup", args...)); err != nil {
+		return walRange{}, fmt.Errorf("pg_basebackup failed: %w", err)
+	}
+
+	manifestPath := filepath.Join(workDir, "backup_manifest")
+	wal, err := readManifestWalRange(manifestPath)
+	if err != nil {
+		return walRange{}, err
+	}
+
+	// Keep a copy of the manifest so the next incremental backup does not
+	// have to fetch this one from the destination.
+	cachePath := b.manifestCachePath(filepath.Base(outputPath))
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err == nil {
+		copyFile(manifestPath, cachePath)
+	}
+
+	return wal, archiveDirectory(workDir, outputPath)
+}
+
+func (b BackupManager) manifestCachePath(filename string) string {
+	return filepath.Join(LOCAL_BACKUP_DIR, ".manifests", b.backupDirName(), filename+".backup_manifest")
+}
+
+// chainManifest returns a local path to the backup_manifest of a stored
+// physical or incremental backup.
+func (b BackupManager) chainManifest(destination BackupDestination, record *db.Backup) (string, error) {
+	cachePath := b.manifestCachePath(record.Filename)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	backupPath, cleanup, err := b.fetchBackupFile(destination, record.Filename)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return "", err
+	}
+	if err := extractArchiveMember(backupPath, "backup_manifest", cachePath); err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// fetchBackupFile makes a stored backup available on the local filesystem,
+// from one of its copies when the destination it was created on fails. The
+// returned cleanup function removes any temporary download.
+func (b BackupManager) fetchBackupFile(destination BackupDestination, filename string) (string, func(), error) {
+	backupPath, cleanup, err := b.fetchStoredFile(destination, filename)
+	if err == nil {
+		return backupPath, cleanup, nil
+	}
+	if backupPath, cleanup, copyErr := b.fetchBackupCopy(destination, filename, err); copyErr == nil {
+		return backupPath, cleanup, nil
+	}
+	return "", nil, err
+}
+
+// fetchStoredFile makes a backup stored on the destination available on the
+// local filesystem.
+func (b BackupManager) fetchStoredFile(destination BackupDestination, filename string) (string, func(), error) {
+	switch destination {
+	case BackupFilesystem:
+		backupPath := filepath.Join(LOCAL_BACKUP_DIR, b.backupDirName(), filename)
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			log.Printf("Backup file does not exist: %s", backupPath)
+			return "", nil, fmt.Errorf("backup file not found: %s", filename)
+		}
+		if err := b.verifyFetchedBackup(backupPath, filename, ""); err != nil {
+			return "", nil, err
+		}
+		return backupPath, func() {}, nil
+
+	case BackupS3Bucket:
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			log.Printf("Error creating S3 client: %v", err)
+			return "", nil, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+
+		downloadDir, err := os.MkdirTemp(LOCAL_BACKUP_DIR, ".download-")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create download directory: %w", err)
+		}
+		cleanup := func() { os.RemoveAll(downloadDir) }
+
+		backupPath := filepath.Join(downloadDir, filename)
+		log.Printf("Downloading backup from S3 to: %s", backupPath)
+		S3Client.Progress = b.Job.StartPhase("download", "bytes")
+		verified, err := S3Client.downloadFile(filename, backupPath)
+		if err != nil {
+			cleanup()
+			log.Printf("Error downloading backup from S3: %v", err)
+			return "", nil, fmt.Errorf("S3 download failed: %v", err)
+		}
+		if err := b.verifyFetchedBackup(backupPath, filename, verified); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return backupPath, cleanup, nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported backup destination: %s", destination)
+}
+
+func readManifestWalRange(manifestPath string) (walRange, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return walRange{}, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+
+	var manifest struct {
+		WalRanges []walRange `json:"WAL-Ranges"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return walRange{}, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	if len(manifest.WalRanges) == 0 {
+		return walRange{}, fmt.Errorf("backup manifest contains no WAL ranges")
+	}
+
+	// A backup taken across a timeline switch lists several ranges; the
+	// last one is where recovery continues from.
+	return manifest.WalRanges[len(manifest.WalRanges)-1], nil
+}
+
+// DEFAULT_RESTORE_DATA_DIR is where physical restores prepare data
+// directories unless RESTORE_DATA_DIR is set.
+const DEFAULT_RESTORE_DATA_DIR = "/var/lib/pg_bckup_mgr/restore"
+
+func restoreDataDir() string {
+	if dir := os.Getenv("RESTORE_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return DEFAULT_RESTORE_DATA_DIR
+}
+
+// resolveDataDirectory returns the data directory a physical restore may
+// write to, which has to be below RESTORE_DATA_DIR so that API callers
+// cannot unpack backups over arbitrary paths of the manager's host.
+// Relative paths are taken relative to it.
+func resolveDataDirectory(dataDir string) (string, error) {
+	base, err := filepath.Abs(restoreDataDir())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dataDir) {
+		dataDir = filepath.Join(base, dataDir)
+	}
+	dataDir = filepath.Clean(dataDir)
+	if !strictlyInside(dataDir, base) {
+		return "", fmt.Errorf("data directory %s must be below %s, see RESTORE_DATA_DIR", dataDir, base)
+	}
+
+	// Symlinks in the part of the path that exists must not lead out of it.
+	if resolvedBase, err := filepath.EvalSymlinks(base); err == nil {
+		existing := dataDir
+		for {
+			if resolved, err := filepath.EvalSymlinks(existing); err == nil {
+				if resolved != resolvedBase && !strictlyInside(resolved, resolvedBase) {
+					return "", fmt.Errorf("data directory %s must be below %s, see RESTORE_DATA_DIR", dataDir, base)
+				}
+				break
+			}
+			existing = filepath.Dir(existing)
+		}
+	}
+	return dataDir, nil
+}
+
+// strictlyInside reports whether the clean, absolute path is below dir.
+func strictlyInside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// PreparePhysicalRestore unpacks a physical backup into dataDir so that a
+// PostgreSQL server can be started on it. dataDir must be empty or absent,
+// and below RESTORE_DATA_DIR. Incremental backups are combined with the rest
+// of their chain.
+func (b BackupManager) PreparePhysicalRestore(destination BackupDestination, filename, dataDir string) error {
+	dataDir, err := resolveDataDirectory(dataDir)
+	if err != nil {
+		return err
+	}
+	record := b.lookupBackupRecord(filename)
+	backupType := backupTypeOf(record, filename)
+	if !backupType.isPhysical() {
+		return fmt.Errorf("backup %s is not a physical backup", filename)
+	}
+
+	if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dataDir)
+	}
+
+	if backupType == BackupIncremental {
+		if record == nil {
+			return fmt.Errorf("incremental backup %s is not in the catalog, its chain cannot be resolved", filename)
+		}
+		chain, err := b.backupChain(record)
+		if err != nil {
+			return err
+		}
+		if err := b.combineBackupChain(destination, chain, dataDir); err != nil {
+			log.Printf("Error combining backup chain into %s: %v", dataDir, err)
+			return err
+		}
+		log.Printf("Data directory %s prepared from %d backups ending with %s", dataDir, len(chain), filename)
+		return nil
+	}
+
+	backupPath, cleanup, err := b.fetchBackupFile(destination, filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := unpackBaseBackup(backupPath, dataDir); err != nil {
+		log.Printf("Error preparing data directory %s: %v", dataDir, err)
+		return err
+	}
+
+	log.Printf("Data directory %s prepared from physical backup %s", dataDir, filename)
+	return nil
+}
+
+// combineBackupChain unpacks a full backup and the incremental backups
+// taken on top of it, then reconstructs a full data directory with
+// pg_combinebackup.
+func (b BackupManager) combineBackupChain(destination BackupDestination, chain []db.Backup, dataDir string) error {
+	workDir, err := os.MkdirTemp(LOCAL_BACKUP_DIR, ".combine-")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var dirs []string
+	for i, link := range chain {
+		backupPath, cleanup, err := b.fetchBackupFile(destination, link.Filename)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(workDir, fmt.Sprint(i))
+		err = unpackBaseBackup(backupPath, dir)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to unpack %s: %w", link.Filename, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	cmd := b.pgCommand("pg_combinebackup", append([]string{"-o", dataDir}, dirs...)...)
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("pg_combinebackup failed: %w", err)
+	}
+
+	return nil
+}
+
+// unpackBaseBackup turns an archive produced by createPgBaseBackup into a
+// plain data directory with WAL in pg_wal and backup_manifest at its root.
+func unpackBaseBackup(archivePath, dataDir string) error {
+	workDir, err := os.MkdirTemp(LOCAL_BACKUP_DIR, ".restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := extractArchive(archivePath, workDir, false); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != "base.tar.gz" && name != "pg_wal.tar.gz" && name != "backup_manifest" {
+			return fmt.Errorf("backups with user tablespaces (%s) must be restored manually", name)
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.Chmod(dataDir, 0700); err != nil {
+		return err
+	}
+
+	if err := extractArchive(filepath.Join(workDir, "base.tar.gz"), dataDir, true); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "pg_wal.tar.gz")); err == nil {
+		walDir := filepath.Join(dataDir, "pg_wal")
+		if err := os.MkdirAll(walDir, 0700); err != nil {
+			return err
+		}
+		if err := extractArchive(filepath.Join(workDir, "pg_wal.tar.gz"), walDir, true); err != nil {
+			return err
+		}
+	}
+
+	return copyFile(filepath.Join(workDir, "backup_manifest"), filepath.Join(dataDir, "backup_manifest"))
+}
+
+// archiveDirectory writes the regular files of dir into an uncompressed tar
+// archive at outputPath.
+func archiveDirectory(dir, outputPath string) error {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create archive %s: %w", outputPath, err)
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", dir, err)
+	}
+
+	return tw.Close()
+}
+
+// extractArchive unpacks a tar (optionally gzip-compressed) archive into
+// destDir, refusing entries that would escape it and links.
+func extractArchive(archivePath, destDir string, gzipped bool) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read compressed archive %s: %w", archivePath, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %w", archivePath, err)
+		}
+
+		target := filepath.Join(destDir, header.Name)
+		if target != filepath.Clean(destDir) && !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %s escapes destination directory", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode)&os.ModePerm); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			// Archives can be uploaded or adopted, and a link followed by an
+			// entry below it would write outside destDir. Neither dumps nor
+			// base backups without tablespaces contain links.
+			return fmt.Errorf("archive entry %s is a link, which is not supported", header.Name)
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&os.ModePerm)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
+
+// extractArchiveMember copies a single file out of an uncompressed tar
+// archive.
+func extractArchiveMember(archivePath, member, dst string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in archive %s", member, archivePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %w", archivePath, err)
+		}
+		if header.Name != member {
+			continue
+		}
+
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, tr)
+		return err
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,99 @@
+package backup_manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+	}
+
+	tests := []struct {
+		name      string
+		entries   []entry
+		wantFiles []string
+		wantErr   string
+	}{
+		{
+			name:      "dump directory",
+			entries:   []entry{{name: "toc.dat", typeflag: tar.TypeReg}, {name: "3456.dat.gz", typeflag: tar.TypeReg}},
+			wantFiles: []string{"toc.dat", "3456.dat.gz"},
+		},
+		{
+			name:      "nested directories",
+			entries:   []entry{{name: "global/", typeflag: tar.TypeDir}, {name: "global/pg_control", typeflag: tar.TypeReg}, {name: "base/1/112", typeflag: tar.TypeReg}},
+			wantFiles: []string{"global/pg_control", "base/1/112"},
+		},
+		{
+			name:    "dot dot",
+			entries: []entry{{name: "../outside", typeflag: tar.TypeReg}},
+			wantErr: "escapes destination directory",
+		},
+		{
+			name:    "symlink then an entry below it",
+			entries: []entry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/tmp"}, {name: "link/x", typeflag: tar.TypeReg}},
+			wantErr: "is a link",
+		},
+		{
+			name:    "symlink then the same name",
+			entries: []entry{{name: "toc.dat", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}, {name: "toc.dat", typeflag: tar.TypeReg}},
+			wantErr: "is a link",
+		},
+		{
+			name:    "hard link",
+			entries: []entry{{name: "toc.dat", typeflag: tar.TypeLink, linkname: "/etc/passwd"}},
+			wantErr: "is a link",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, e := range tt.entries {
+				header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+				content := []byte("data")
+				if e.typeflag == tar.TypeReg {
+					header.Size = int64(len(content))
+				}
+				if e.typeflag == tar.TypeDir {
+					header.Mode = 0755
+				}
+				if err := tw.WriteHeader(header); err != nil {
+					t.Fatal(err)
+				}
+				if e.typeflag == tar.TypeReg {
+					tw.Write(content)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			destDir := t.TempDir()
+			err := extractArchive(writeTestFile(t, "dump.dir.tar", buf.Bytes()), destDir, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractArchive() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractArchive() error = %v", err)
+			}
+			for _, name := range tt.wantFiles {
+				if data, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(data) != "data" {
+					t.Errorf("%s = %q, %v", name, data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package backup_manager
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JobProgress is how far the current phase of a job got. Total is an
+// estimate for dumps, whose output is usually smaller than the database
+// because of compression, and zero when unknown.
+type JobProgress struct {
+	Phase      string  `json:"phase"`
+	Unit       string  `json:"unit"` // bytes or entries
+	Done       int64   `json:"done"`
+	Total      int64   `json:"total,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+
+	startedAt time.Time
+}
+
+// ProgressFunc reports the amount of work done so far, out of total when
+// known.
+type ProgressFunc func(done, total int64)
+
+// StartPhase makes name the current phase of the job and returns the
+// function to report its progress with. It is safe to call on a nil job.
+func (j *Job) StartPhase(name, unit string) ProgressFunc {
+	if j == nil {
+		return func(done, total int64) {}
+	}
+
+	progress := &JobProgress{Phase: name, Unit: unit, startedAt: time.Now()}
+	j.mu.Lock()
+	j.progress = progress
+	j.mu.Unlock()
+
+	return func(done, total int64) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		// A later phase took over.
+		if j.progress != progress {
+			return
+		}
+		progress.Done = done
+		progress.Total = total
+	}
+}
+
+// Progress returns the progress of the current phase, with percentage and
+// ETA derived from the rate so far, or nil when none was reported.
+func (j *Job) Progress() *JobProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.progressLocked()
+}
+
+func (j *Job) progressLocked() *JobProgress {
+	if j.progress == nil || j.finishedAt != nil {
+		return nil
+	}
+
+	p := *j.progress
+	if p.Total > 0 {
+		// Estimates can be exceeded; stay below 100 until the phase ends.
+		p.Percent = min(99.9, float64(p.Done)*100/float64(p.Total))
+		elapsed := time.Since(p.startedAt).Seconds()
+		if p.Done > 0 && p.Done < p.Total {
+			p.ETASeconds = elapsed / float64(p.Done) * float64(p.Total-p.Done)
+		}
+	}
+	return &p
+}
+
+// watchOutputSize reports the size of path, a file or a directory, every
+// second until the returned stop function is called.
+func watchOutputSize(path string, total int64, report ProgressFunc) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report(pathSize(path), total)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func pathSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// progressReader counts the bytes read from a file. Seeking, which the S3
+// client does to sign and retry uploads, moves the count along.
+type progressReader struct {
+	file   *os.File
+	read   int64
+	total  int64
+	report ProgressFunc
+}
+
+func newProgressReader(file *os.File, report ProgressFunc) *progressReader {
+	r := &progressReader{file: file, report: report}
+	if info, err := file.Stat(); err == nil {
+		r.total = info.Size()
+	}
+	return r
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.read += int64(n)
+	r.report(r.read, r.total)
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.file.Seek(offset, whence)
+	if err == nil {
+		r.read = pos
+	}
+	return pos, err
+}
+
+// progressStream counts the bytes read from a stream that cannot seek.
+type progressStream struct {
+	reader io.Reader
+	read   int64
+	total  int64
+	report ProgressFunc
+}
+
+func (r *progressStream) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	r.report(r.read, r.total)
+	return n, err
+}
+
+// progressWriterAt counts the bytes the concurrent S3 downloader writes.
+type progressWriterAt struct {
+	file    *os.File
+	written atomic.Int64
+	total   int64
+	report  ProgressFunc
+}
+
+func (w *progressWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.file.WriteAt(p, off)
+	w.report(w.written.Add(int64(n)), w.total)
+	return n, err
+}
+
+// restoreProgress counts the TOC entries pg_restore -v reports as it works
+// through them. Dropping objects for --clean is not counted.
+type restoreProgress struct {
+	partial []byte
+	done    int64
+	total   int64
+	report  ProgressFunc
+}
+
+var restoreItemPrefixes = []string{
+	"pg_restore: creating ",
+	"pg_restore: processing data for table ",
+	"pg_restore: executing ",
+}
+
+func (r *restoreProgress) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(r.partial[:i])
+		r.partial = r.partial[i+1:]
+
+		for _, prefix := range restoreItemPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				r.done++
+				if r.total > 0 && r.done > r.total {
+					r.done = r.total
+				}
+				r.report(r.done, r.total)
+				break
+			}
+		}
+	}
+	return len(p), nil
+}
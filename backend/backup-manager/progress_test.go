@@ -0,0 +1,73 @@
+package backup_manager
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProgressReader(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+
+	tests := []struct {
+		name      string
+		readFirst bool
+		seek      bool
+		offset    int64
+		whence    int
+		readSize  int
+		wantDone  []int64
+	}{
+		{name: "read through", readSize: 40, wantDone: []int64{40, 80, 100, 100}},
+		{name: "seek from the start", seek: true, offset: 50, whence: io.SeekStart, readSize: 30, wantDone: []int64{80, 100, 100}},
+		{name: "seek from the end", seek: true, offset: -10, whence: io.SeekEnd, readSize: 64, wantDone: []int64{100, 100}},
+		{name: "rewind after reading", readFirst: true, seek: true, offset: 0, whence: io.SeekStart, readSize: 100, wantDone: []int64{100, 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(writeTestFile(t, "dump", []byte(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var done []int64
+			r := newProgressReader(f, func(d, total int64) {
+				if total != int64(len(content)) {
+					t.Errorf("total = %d, want %d", total, len(content))
+				}
+				done = append(done, d)
+			})
+			if tt.readFirst {
+				io.ReadAll(r)
+				done = nil
+			}
+			if tt.seek {
+				if _, err := r.Seek(tt.offset, tt.whence); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			buf := make([]byte, tt.readSize)
+			for {
+				_, err := r.Read(buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(done) != len(tt.wantDone) {
+				t.Fatalf("reported %v, want %v", done, tt.wantDone)
+			}
+			for i := range done {
+				if done[i] != tt.wantDone[i] {
+					t.Fatalf("reported %v, want %v", done, tt.wantDone)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package backup_manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"pg_bckup_mgr/db"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// StoredFile is a backup file found on, or missing from, a destination.
+type StoredFile struct {
+	DestinationType BackupDestination `json:"destination_type"`
+	DestinationID   *uint             `json:"destination_id,omitempty"`
+	ConnectionID    uint              `json:"connection_id,omitempty"`
+	Filename        string            `json:"filename"`
+	Reason          string            `json:"reason"`
+}
+
+// ReconcileReport lists what a reconciliation found, and changed when it
+// was applied.
+type ReconcileReport struct {
+	Applied  bool         `json:"applied"`
+	Restored []db.Backup  `json:"restored"` // catalog entries rebuilt from metadata sidecars
+	Repaired []StoredFile `json:"repaired"` // catalog entries or sidecars brought up to date
+	Orphaned []StoredFile `json:"orphaned"` // files the catalog knows nothing about
+	Missing  []StoredFile `json:"missing"`  // catalogued files that are not stored anymore
+	Errors   []string     `json:"errors"`
+}
+
+// reconciler holds the state of one Reconcile run.
+type reconciler struct {
+	conn        *gorm.DB
+	apply       bool
+	job         *Job
+	report      ReconcileReport
+	connections []db.Connection
+	scanned     map[string]bool // locations that could be listed
+	found       map[string]bool // record ID and location of every file found, see markFound
+	restored    []restoredBackup
+	errs        []error
+}
+
+type restoredBackup struct {
+	record         *db.Backup
+	parentFilename string
+}
+
+// Reconcile scans the local backup directory and every S3 destination and
+// compares what is stored with the catalog. Backups with a metadata sidecar
+// but no catalog entry, e.g. after the manager's database was lost, are
+// catalogued again; files without either are reported as orphaned, and
+// catalogued backups whose files are gone as missing. Nothing is changed
+// unless apply is set.
+func Reconcile(conn *gorm.DB, apply bool, job *Job) (ReconcileReport, error) {
+	r := &reconciler{
+		conn:    conn,
+		apply:   apply,
+		job:     job,
+		report:  ReconcileReport{Applied: apply},
+		scanned: map[string]bool{},
+		found:   map[string]bool{},
+	}
+
+	connections, err := db.ListAllCredentials(conn)
+	if err != nil {
+		return r.report, err
+	}
+	r.connections = connections
+	destinations, err := db.ListAllBackupDestinations(conn)
+	if err != nil {
+		return r.report, err
+	}
+
+	r.scanLocal()
+	for _, destination := range destinations {
+		r.scanS3(destination)
+	}
+	r.linkRestored()
+	r.findMissing()
+
+	for _, err := range r.errs {
+		r.report.Errors = append(r.report.Errors, err.Error())
+	}
+	log.Printf("Reconciliation found %d restorable, %d repairable, %d orphaned and %d missing backups",
+		len(r.report.Restored), len(r.report.Repaired), len(r.report.Orphaned), len(r.report.Missing))
+	return r.report, errors.Join(r.errs...)
+}
+
+func (r *reconciler) fail(err error) {
+	log.Printf("Reconciliation: %v", err)
+	r.job.Logf("%v", err)
+	r.errs = append(r.errs, err)
+}
+
+func (r *reconciler) manager(connection db.Connection) BackupManager {
+	return BackupManager{
+		Host:         connection.PostgresHost,
+		Port:         connection.PostgresPort,
+		DBName:       connection.PostgresDBName,
+		User:         connection.PostgresUser,
+		Password:     connection.PostgresPassword,
+		Catalog:      r.conn,
+		ConnectionID: connection.ID,
+	}
+}
+
+// connectionFor returns the connection the metadata was written for.
+func (r *reconciler) connectionFor(metadata *BackupMetadata) *db.Connection {
+	var match *db.Connection
+	for i, connection := range r.connections {
+		if connection.PostgresHost != metadata.Host || connection.PostgresPort != metadata.Port ||
+			connection.PostgresDBName != metadata.Database {
+			continue
+		}
+		if connection.PostgresUser == metadata.User {
+			return &r.connections[i]
+		}
+		if match == nil {
+			match = &r.connections[i]
+		}
+	}
+	return match
+}
+
+func locationKey(location CopyTarget, connectionID uint) string {
+	if location.DestinationType == BackupFilesystem {
+		return fmt.Sprintf("%s/%d", location.DestinationType, connectionID)
+	}
+	return location.String()
+}
+
+func (r *reconciler) markFound(record *db.Backup, location CopyTarget) {
+	r.found[fmt.Sprintf("%d %s", record.ID, locationKey(location, record.ConnectionID))] = true
+}
+
+func (r *reconciler) scanLocal() {
+	entries, err := os.ReadDir(LOCAL_BACKUP_DIR)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.fail(fmt.Errorf("unable to list %s: %w", LOCAL_BACKUP_DIR, err))
+			return
+		}
+	}
+	local := CopyTarget{DestinationType: BackupFilesystem}
+	for _, connection := range r.connections {
+		r.scanned[locationKey(local, connection.ID)] = true
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || entry.Name()+"/" == WAL_ARCHIVE_PREFIX {
+			continue
+		}
+		var owner *db.Connection
+		for i, connection := range r.connections {
+			if r.manager(connection).backupDirName() == entry.Name() {
+				owner = &r.connections[i]
+			}
+		}
+		if owner == nil {
+			r.report.Orphaned = append(r.report.Orphaned, StoredFile{
+				DestinationType: BackupFilesystem,
+				Filename:        entry.Name() + "/",
+				Reason:          "directory does not belong to any connection",
+			})
+			continue
+		}
+
+		r.job.Logf("Scanning %s", entry.Name())
+		manager := r.manager(*owner)
+		for _, filename := range manager.ListAvaiableBackups(BackupFilesystem) {
+			if strings.HasPrefix(filename, ".") {
+				continue
+			}
+			r.reconcileFile(manager, local, filename)
+		}
+	}
+}
+
+func (r *reconciler) scanS3(destination db.Destination) {
+	target := CopyTarget{DestinationType: BackupS3Bucket, DestinationID: &destination.ID}
+	S3Client, err := NewS3Client(destination.Name,
+		destination.EndpointURL,
+		destination.Region,
+		destination.BucketName,
+		destination.AccessKeyID,
+		destination.SecretAccessKey,
+		destination.UseSSL,
+		destination.VerifySSL,
+	)
+	if err != nil {
+		r.fail(fmt.Errorf("S3 client creation failed for %s: %v", destination.Name, err))
+		return
+	}
+	keys, err := S3Client.ListFiles()
+	if err != nil {
+		r.fail(fmt.Errorf("unable to list bucket %s: %w", destination.BucketName, err))
+		return
+	}
+	r.scanned[locationKey(target, 0)] = true
+
+	// Files without a sidecar are attributed to the destination's connection.
+	var owner db.Connection
+	for _, connection := range r.connections {
+		if connection.ID == destination.ConnectionID {
+			owner = connection
+		}
+	}
+
+	r.job.Logf("Scanning bucket %s", destination.BucketName)
+	for _, key := range keys {
+		if strings.HasPrefix(key, WAL_ARCHIVE_PREFIX) || strings.HasPrefix(key, SELF_BACKUP_PREFIX) ||
+			strings.HasSuffix(key, METADATA_SUFFIX) {
+			continue
+		}
+		manager := r.manager(owner)
+		manager.BackupDestination = &destination
+		r.reconcileFile(manager, target, key)
+	}
+}
+
+// reconcileFile compares a stored file with its catalog entry. The manager
+// is set up for the connection the file is attributed to by its location.
+func (r *reconciler) reconcileFile(manager BackupManager, location CopyTarget, filename string) {
+	stored := StoredFile{DestinationType: location.DestinationType, DestinationID: location.DestinationID, Filename: filename}
+
+	metadata, err := manager.readMetadata(location.DestinationType, filename)
+	if err != nil {
+		log.Printf("Ignoring metadata of %s on %s: %v", filename, location, err)
+	}
+	if metadata != nil {
+		connection := r.connectionFor(metadata)
+		if connection == nil {
+			stored.Reason = fmt.Sprintf("metadata names %s@%s:%s/%s, which is not a known connection",
+				metadata.User, metadata.Host, metadata.Port, metadata.Database)
+			r.report.Orphaned = append(r.report.Orphaned, stored)
+			return
+		}
+		if connection.ID != manager.ConnectionID {
+			// Locations are per connection on the filesystem only.
+			if location.DestinationType == BackupFilesystem {
+				stored.Reason = fmt.Sprintf("metadata belongs to connection %d", connection.ID)
+				r.report.Orphaned = append(r.report.Orphaned, stored)
+				return
+			}
+			destination := manager.BackupDestination
+			manager = r.manager(*connection)
+			manager.BackupDestination = destination
+		}
+	}
+	if manager.ConnectionID == 0 {
+		stored.Reason = "no metadata and the destination has no connection"
+		r.report.Orphaned = append(r.report.Orphaned, stored)
+		return
+	}
+	stored.ConnectionID = manager.ConnectionID
+
+	record := manager.lookupBackupRecord(filename)
+	if record == nil {
+		if metadata == nil {
+			stored.Reason = "not catalogued and no metadata, adopt it to catalog it"
+			r.report.Orphaned = append(r.report.Orphaned, stored)
+			return
+		}
+		r.restore(manager, location, metadata)
+		return
+	}
+	if record.Status != BackupStatusCompleted {
+		stored.Reason = fmt.Sprintf("catalogued as %s", record.Status)
+		if record.Status != BackupStatusRunning {
+			r.report.Orphaned = append(r.report.Orphaned, stored)
+		}
+		return
+	}
+	r.markFound(record, location)
+	if copies, err := db.ListBackupCopies(r.conn, record.ID); err == nil {
+		record.Copies = copies
+	}
+
+	known := false
+	for _, recorded := range backupLocations(*record) {
+		if locationKey(recorded, record.ConnectionID) == locationKey(location, record.ConnectionID) {
+			known = true
+		}
+	}
+	if !known {
+		stored.Reason = "stored where the catalog does not expect it, catalogued as a copy"
+		r.report.Repaired = append(r.report.Repaired, stored)
+		if r.apply {
+			backupCopy := db.BackupCopy{
+				BackupID:        record.ID,
+				DestinationType: string(location.DestinationType),
+				DestinationID:   location.DestinationID,
+				Status:          BackupStatusCompleted,
+			}
+			if err := db.CreateBackupCopy(r.conn, &backupCopy); err != nil {
+				r.fail(fmt.Errorf("unable to catalog copy of %s: %w", filename, err))
+			}
+		}
+	}
+
+	if record.Checksum == "" && metadata != nil && metadata.Checksum != "" {
+		stored.Reason = "checksum restored from metadata"
+		r.report.Repaired = append(r.report.Repaired, stored)
+		if r.apply {
+			record.Checksum = metadata.Checksum
+			if err := db.UpdateBackupRecord(r.conn, record); err != nil {
+				r.fail(fmt.Errorf("unable to update catalog entry for %s: %w", filename, err))
+			}
+		}
+	}
+
+	if metadata == nil {
+		stored.Reason = "metadata sidecar written"
+		r.report.Repaired = append(r.report.Repaired, stored)
+		if r.apply {
+			if err := manager.storeMetadata(location.DestinationType, record); err != nil {
+				r.fail(fmt.Errorf("unable to write metadata of %s to %s: %w", filename, location, err))
+			}
+		}
+	}
+}
+
+// restore catalogs a backup from its metadata. A backup stored on several
+// destinations is catalogued once, its other locations become copies.
+func (r *reconciler) restore(manager BackupManager, location CopyTarget, metadata *BackupMetadata) {
+	for _, restored := range r.restored {
+		record := restored.record
+		if record.ConnectionID != manager.ConnectionID || record.Filename != metadata.Filename {
+			continue
+		}
+		r.report.Repaired = append(r.report.Repaired, StoredFile{
+			DestinationType: location.DestinationType,
+			DestinationID:   location.DestinationID,
+			ConnectionID:    manager.ConnectionID,
+			Filename:        metadata.Filename,
+			Reason:          "restored from metadata as a copy",
+		})
+		backupCopy := db.BackupCopy{
+			BackupID:        record.ID,
+			DestinationType: string(location.DestinationType),
+			DestinationID:   location.DestinationID,
+			Status:          BackupStatusCompleted,
+		}
+		if r.apply {
+			if err := db.CreateBackupCopy(r.conn, &backupCopy); err != nil {
+				r.fail(fmt.Errorf("unable to catalog copy of %s: %w", metadata.Filename, err))
+			}
+			r.markFound(record, location)
+		}
+		record.Copies = append(record.Copies, backupCopy)
+		return
+	}
+
+	record := metadata.catalogEntry(manager.ConnectionID, location)
+	r.job.Logf("Restoring catalog entry for %s", metadata.Filename)
+	if r.apply {
+		if err := db.CreateBackupRecord(r.conn, record); err != nil {
+			r.fail(fmt.Errorf("unable to catalog %s: %w", metadata.Filename, err))
+			return
+		}
+		r.markFound(record, location)
+	}
+	r.restored = append(r.restored, restoredBackup{record: record, parentFilename: metadata.ParentFilename})
+}
+
+// linkRestored points restored incremental backups at their parents, once
+// all of them are catalogued, and adds them to the report.
+func (r *reconciler) linkRestored() {
+	for _, restored := range r.restored {
+		record := restored.record
+		if restored.parentFilename != "" {
+			parent, err := db.GetBackupRecordByFilename(r.conn, record.ConnectionID, restored.parentFilename)
+			if err != nil && !r.apply {
+				// Not catalogued before a dry run, look at what would be.
+				for _, other := range r.restored {
+					if other.record.ConnectionID == record.ConnectionID && other.record.Filename == restored.parentFilename {
+						parent, err = *other.record, nil
+					}
+				}
+			}
+			if err != nil {
+				r.fail(fmt.Errorf("parent %s of restored backup %s is not stored anywhere", restored.parentFilename, record.Filename))
+			} else if parent.ID != 0 {
+				record.ParentBackupID = &parent.ID
+				if r.apply {
+					if err := db.UpdateBackupRecord(r.conn, record); err != nil {
+						r.fail(fmt.Errorf("unable to update catalog entry for %s: %w", record.Filename, err))
+					}
+				}
+			}
+		}
+		r.report.Restored = append(r.report.Restored, *record)
+	}
+}
+
+// findMissing reports the completed backups and copies whose files were not
+// found on a location that could be scanned, and records them as missing
+// when applied.
+func (r *reconciler) findMissing() {
+	backups, err := db.ListBackupRecords(r.conn, map[string]interface{}{"status": BackupStatusCompleted})
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	for _, backup := range backups {
+		for i, location := range backupLocations(backup) {
+			key := locationKey(location, backup.ConnectionID)
+			if !r.scanned[key] || r.found[fmt.Sprintf("%d %s", backup.ID, key)] {
+				continue
+			}
+			r.report.Missing = append(r.report.Missing, StoredFile{
+				DestinationType: location.DestinationType,
+				DestinationID:   location.DestinationID,
+				ConnectionID:    backup.ConnectionID,
+				Filename:        backup.Filename,
+				Reason:          "file not found",
+			})
+			if !r.apply {
+				continue
+			}
+
+			missingErr := fmt.Errorf("backup file not found on %s", location)
+			if i == 0 {
+				manager, err := managerForBackup(r.conn, backup)
+				if err != nil {
+					r.fail(err)
+					continue
+				}
+				manager.recordIntegrity(&backup, IntegrityMissing, missingErr)
+				continue
+			}
+			for _, backupCopy := range backup.Copies {
+				if backupCopy.Status == BackupStatusCompleted && locationKey(copyTargetOf(backupCopy), backup.ConnectionID) == key {
+					backupCopy.Status = BackupStatusFailed
+					backupCopy.Error = missingErr.Error()
+					if err := db.UpdateBackupCopy(r.conn, &backupCopy); err != nil {
+						r.fail(fmt.Errorf("unable to update copy of %s: %w", backup.Filename, err))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"strings"
+	"time"
+)
+
+// RECOVERY_WAL_DIR is the directory inside a prepared data directory that
+// holds archived WAL for restore_command. It is relative so the data
+// directory can be moved to the database host before starting it.
+const RECOVERY_WAL_DIR = "pitr_wal"
+
+type RecoveryTarget struct {
+	Time *time.Time
+	LSN  string
+}
+
+// PreparePointInTimeRecovery prepares dataDir from a physical backup, fetches
+// the archived WAL following it and configures the server to replay up to
+// the requested target (or to the end of the archive when none is given).
+func (b BackupManager) PreparePointInTimeRecovery(destination BackupDestination, filename, dataDir string, target RecoveryTarget) error {
+	if b.Catalog == nil {
+		return fmt.Errorf("point-in-time recovery requires the backup catalog")
+	}
+	dataDir, err := resolveDataDirectory(dataDir)
+	if err != nil {
+		return err
+	}
+
+	if target.Time != nil && target.LSN != "" {
+		return fmt.Errorf("only one of target time and target LSN can be given")
+	}
+
+	var targetLSN uint64
+	if target.LSN != "" {
+		lsn, err := parseLSN(target.LSN)
+		if err != nil {
+			return err
+		}
+		targetLSN = lsn
+	}
+
+	var stream db.WalStream
+	if err := b.Catalog.Preload("Connection").Preload("Destination").Where("connection_id = ?", b.ConnectionID).First(&stream).Error; err != nil {
+		return fmt.Errorf("no WAL archive configured for this connection")
+	}
+
+	if err := b.PreparePhysicalRestore(destination, filename, dataDir); err != nil {
+		return err
+	}
+
+	start, err := readManifestWalRange(filepath.Join(dataDir, "backup_manifest"))
+	if err != nil {
+		return err
+	}
+	startLSN, err := parseLSN(start.StartLSN)
+	if err != nil {
+		return err
+	}
+	if targetLSN != 0 && targetLSN < startLSN {
+		return fmt.Errorf("target LSN %s precedes the base backup start %s", target.LSN, start.StartLSN)
+	}
+
+	segments, err := db.ListWalSegments(b.Catalog, b.ConnectionID)
+	if err != nil {
+		return err
+	}
+	needed := selectRecoverySegments(segments, start.Timeline, startLSN, uint64(stream.SegmentSize), target.Time, targetLSN)
+	if len(needed) == 0 {
+		log.Printf("No archived WAL found after base backup %s, recovery will stop at its end", filename)
+	}
+
+	walDir := filepath.Join(dataDir, RECOVERY_WAL_DIR)
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		return err
+	}
+
+	archive := walManagerFor(b.Catalog, stream)
+	for _, segment := range needed {
+		localName := strings.TrimSuffix(segment.Name, ".partial")
+		log.Printf("Fetching archived WAL %s", segment.Name)
+		if err := archive.fetchArchivedWalFile(segment.Name, filepath.Join(walDir, localName)); err != nil {
+			return fmt.Errorf("failed to fetch WAL %s: %w", segment.Name, err)
+		}
+	}
+
+	if err := writeRecoveryConfig(dataDir, target); err != nil {
+		return err
+	}
+
+	log.Printf("Data directory %s prepared for point-in-time recovery with %d WAL files", dataDir, len(needed))
+	return nil
+}
+
+// selectRecoverySegments picks the archived WAL needed to roll a base backup
+// starting at startLSN forward to the target. History files are always
+// included so recovery can follow timeline switches.
+func selectRecoverySegments(segments []db.WalSegment, timeline uint, startLSN, segmentSize uint64, targetTime *time.Time, targetLSN uint64) []db.WalSegment {
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	complete := map[string]bool{}
+	for _, segment := range segments {
+		if !segment.Partial {
+			complete[segment.Name] = true
+		}
+	}
+
+	var needed []db.WalSegment
+	reachedTime := false
+	for _, segment := range segments {
+		if segment.History {
+			needed = append(needed, segment)
+			continue
+		}
+		if segment.Timeline < timeline || reachedTime {
+			continue
+		}
+		if segment.Partial && complete[strings.TrimSuffix(segment.Name, ".partial")] {
+			continue
+		}
+
+		segmentStart, err := parseLSN(segment.StartLSN)
+		if err != nil || segmentStart+segmentSize <= startLSN {
+			continue
+		}
+		if targetLSN != 0 && segmentStart > targetLSN {
+			continue
+		}
+
+		needed = append(needed, segment)
+
+		// Anything archived after the target time was written after it, so
+		// the first such segment is the last one replay can need.
+		if targetTime != nil && segment.ArchivedAt.After(*targetTime) {
+			reachedTime = true
+		}
+	}
+
+	return needed
+}
+
+func writeRecoveryConfig(dataDir string, target RecoveryTarget) error {
+	settings := []string{
+		"",
+		"# Added by pg_bckup_mgr for point-in-time recovery",
+		fmt.Sprintf("restore_command = 'cp \"%s/%%f\" \"%%p\"'", RECOVERY_WAL_DIR),
+		"recovery_target_timeline = 'latest'",
+	}
+	if target.Time != nil {
+		settings = append(settings, fmt.Sprintf("recovery_target_time = '%s'", target.Time.Format("2006-01-02 15:04:05.999999-07:00")))
+	}
+	if target.LSN != "" {
+		settings = append(settings, fmt.Sprintf("recovery_target_lsn = '%s'", target.LSN))
+	}
+	if target.Time != nil || target.LSN != "" {
+		settings = append(settings, "recovery_target_action = 'promote'")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write recovery settings: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(settings, "\n") + "\n"); err != nil {
+		return fmt.Errorf("failed to write recovery settings: %w", err)
+	}
+
+	return os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600)
+}
@@ -0,0 +1,218 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// restoreTarget returns a manager for the database a restore writes to: the
+// backup's own database unless the options name another connection or
+// database.
+func (b BackupManager) restoreTarget(opts RestoreOptions) BackupManager {
+	target := b
+	if opts.Target != nil {
+		target.Host = opts.Target.PostgresHost
+		target.Port = opts.Target.PostgresPort
+		target.DBName = opts.Target.PostgresDBName
+		target.User = opts.Target.PostgresUser
+		target.Password = opts.Target.PostgresPassword
+	}
+	if opts.TargetDBName != "" {
+		target.DBName = opts.TargetDBName
+	}
+	return target
+}
+
+// ensureDatabase creates the target database when it is missing and reports
+// whether it did. It connects
+// through existingDB, the database configured on the connection, which is
+// known to exist and be accessible.
+func (b BackupManager) ensureDatabase(existingDB string) (bool, error) {
+	maintenance := b
+	maintenance.DBName = existingDB
+
+	conn, err := maintenance.Connect()
+	if err != nil {
+		return false, fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	var count int64
+	if err := conn.Raw("SELECT count(*) FROM pg_database WHERE datname = ?", b.DBName).Scan(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", b.DBName, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	log.Printf("Creating database %s for restore", b.DBName)
+	if err := conn.Exec("CREATE DATABASE " + quoteIdentifier(b.DBName)).Error; err != nil {
+		return false, fmt.Errorf("failed to create database %s: %w", b.DBName, err)
+	}
+	return true, nil
+}
+
+// remapRoles hands everything owned by the source roles over to their
+// replacements on the target. Source roles have to exist on the target,
+// e.g. by restoring with globals.
+func (b BackupManager) remapRoles(mapping map[string]string) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	conn, err := b.Connect()
+	if err != nil {
+		return fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	for from, to := range mapping {
+		log.Printf("Reassigning objects owned by %s to %s", from, to)
+		if err := conn.Exec(fmt.Sprintf("REASSIGN OWNED BY %s TO %s", quoteIdentifier(from), quoteIdentifier(to))).Error; err != nil {
+			return fmt.Errorf("failed to reassign objects of role %s to %s: %w", from, to, err)
+		}
+	}
+	return nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (o RestoreOptions) validate(dump BackupOptions) error {
+	if dump.Format == DumpPlain && (o.NoOwner || o.NoPrivileges || len(o.TocEntries) > 0 || o.Jobs > 1) {
+		return fmt.Errorf("plain SQL backups are restored as written, without owner, privilege or object filtering or parallel jobs")
+	}
+	if o.Jobs < 0 {
+		return fmt.Errorf("jobs must not be negative")
+	}
+	if o.Jobs > 1 && dump.Format == DumpTar {
+		return fmt.Errorf("tar format backups cannot be restored in parallel")
+	}
+	if o.Staging && (dump.selective() || len(o.TocEntries) > 0) {
+		return fmt.Errorf("a staged restore replaces the whole database and needs a complete dump")
+	}
+	if o.SingleTransaction && o.restoreJobs(dump) > 1 {
+		return fmt.Errorf("a single transaction restore cannot run parallel jobs")
+	}
+	return nil
+}
+
+// restoreJobs is the number of parallel pg_restore workers to use.
+func (o RestoreOptions) restoreJobs(dump BackupOptions) int {
+	if o.Jobs > 0 {
+		return o.Jobs
+	}
+	if dump.Format == DumpDirectory {
+		return dump.Jobs
+	}
+	return 0
+}
+
+// phase runs fn and records how long it took.
+func (r *RestoreReport) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	timing := PhaseTiming{Name: name, Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		timing.Error = err.Error()
+	}
+	r.Phases = append(r.Phases, timing)
+	return err
+}
+
+// SESSION_TERMINATION_TIMEOUT is how long terminated sessions get to exit.
+const SESSION_TERMINATION_TIMEOUT = 30 * time.Second
+
+// blockSessions keeps other sessions out of the database with CONNECTION
+// LIMIT 0 and terminates the ones connected to it. Unlike revoking CONNECT
+// from PUBLIC, the limit also applies to the database owner and to roles
+// with their own grant. Superusers are exempt from it, so the restore has
+// to connect as one to get in itself. The returned function sets the
+// previous limit again.
+func (b BackupManager) blockSessions() (func(), error) {
+	conn, err := b.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	var superuser bool
+	if err := conn.Raw("SELECT current_setting('is_superuser') = 'on'").Scan(&superuser).Error; err != nil {
+		return nil, fmt.Errorf("failed to check the privileges of %s: %w", b.User, err)
+	}
+	if !superuser {
+		return nil, fmt.Errorf("terminating sessions needs a superuser connection, %s could not connect itself while other sessions are blocked", b.User)
+	}
+
+	var connLimit int
+	if err := conn.Raw("SELECT datconnlimit FROM pg_database WHERE datname = current_database()").Scan(&connLimit).Error; err != nil {
+		return nil, fmt.Errorf("failed to read the connection limit of %s: %w", b.DBName, err)
+	}
+	if err := conn.Exec("ALTER DATABASE " + quoteIdentifier(b.DBName) + " CONNECTION LIMIT 0").Error; err != nil {
+		return nil, fmt.Errorf("failed to block new connections to %s: %w", b.DBName, err)
+	}
+	reopen := func() {
+		if err := b.setConnectionLimit(connLimit); err != nil {
+			log.Printf("Unable to allow connections to %s again: %v", b.DBName, err)
+		}
+	}
+
+	terminated, err := terminateSessions(conn, b.DBName)
+	if err != nil {
+		reopen()
+		return nil, err
+	}
+	log.Printf("Terminated %d sessions on %s", terminated, b.DBName)
+	return reopen, nil
+}
+
+func (b BackupManager) setConnectionLimit(limit int) error {
+	conn, err := b.Connect()
+	if err != nil {
+		return err
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	return conn.Exec(fmt.Sprintf("ALTER DATABASE %s CONNECTION LIMIT %d", quoteIdentifier(b.DBName), limit)).Error
+}
+
+// terminateSessions terminates every session on the database other than
+// the caller's own and waits until they are gone, as pg_terminate_backend
+// only signals them. Sessions that still get in, e.g. of superusers, are
+// terminated again. It returns the number of sessions terminated.
+func terminateSessions(conn *gorm.DB, dbName string) (int64, error) {
+	var total int64
+	deadline := time.Now().Add(SESSION_TERMINATION_TIMEOUT)
+	for {
+		var terminated int64
+		err := conn.Raw("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = ? AND pid <> pg_backend_pid()", dbName).
+			Scan(&terminated).Error
+		if err != nil {
+			return total, fmt.Errorf("failed to terminate sessions on %s: %w", dbName, err)
+		}
+		total += terminated
+
+		time.Sleep(100 * time.Millisecond)
+		var remaining int64
+		err = conn.Raw("SELECT count(*) FROM pg_stat_activity WHERE datname = ? AND pid <> pg_backend_pid()", dbName).
+			Scan(&remaining).Error
+		if err != nil {
+			return total, fmt.Errorf("failed to list sessions on %s: %w", dbName, err)
+		}
+		if remaining == 0 {
+			return total, nil
+		}
+		if time.Now().After(deadline) {
+			return total, fmt.Errorf("%d sessions on %s did not exit within %s", remaining, dbName, SESSION_TERMINATION_TIMEOUT)
+		}
+	}
+}
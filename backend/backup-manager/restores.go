@@ -0,0 +1,172 @@
+package backup_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func (b BackupManager) startRestoreRecord(destination BackupDestination, filename string, opts RestoreOptions) *db.Restore {
+	if b.Catalog == nil {
+		return nil
+	}
+
+	target := b.restoreTarget(opts)
+	restore := &db.Restore{
+		ConnectionID:       b.ConnectionID,
+		DestinationType:    string(destination),
+		Filename:           filename,
+		TargetConnectionID: b.ConnectionID,
+		TargetDatabase:     target.DBName,
+		Status:             RestoreStatusRunning,
+		RollbackOfID:       opts.rollbackOf,
+		StartedAt:          time.Now(),
+	}
+	if opts.Target != nil {
+		restore.TargetConnectionID = opts.Target.ID
+	}
+	if record := b.lookupBackupRecord(filename); record != nil {
+		restore.BackupID = &record.ID
+	}
+
+	if err := db.CreateRestoreRecord(b.Catalog, restore); err != nil {
+		log.Printf("Unable to record restore of %s: %v", filename, err)
+		return nil
+	}
+	return restore
+}
+
+func (b BackupManager) finishRestoreRecord(restore *db.Restore, report RestoreReport, restoreErr error) {
+	if restore == nil {
+		return
+	}
+
+	if data, err := json.Marshal(report.Phases); err == nil {
+		restore.Phases = string(data)
+	}
+	restore.Log = b.Job.Log()
+	finishedAt := time.Now()
+	restore.FinishedAt = &finishedAt
+	restore.Status = RestoreStatusCompleted
+	if restoreErr != nil {
+		restore.Status = RestoreStatusFailed
+		restore.Error = restoreErr.Error()
+	}
+
+	if err := db.UpdateRestoreRecord(b.Catalog, restore); err != nil {
+		log.Printf("Unable to update restore record %d: %v", restore.ID, err)
+	}
+}
+
+// safetyBackup takes a regular backup of the restore target to the same
+// destination, so the restore can be rolled back with RollbackRestore.
+func (b BackupManager) safetyBackup(destination BackupDestination, target BackupManager, opts RestoreOptions) (*db.Backup, error) {
+	target.ScheduleID = nil
+	if opts.Target != nil {
+		target.ConnectionID = opts.Target.ID
+	}
+
+	log.Printf("Taking safety backup of %s before restoring", target.DBName)
+	return target.createBackup(destination, BackupLogical, BackupOptions{})
+}
+
+// RollbackRestore puts the target of a restore back into the state captured
+// by the safety backup taken before it, or for staged restores swaps the
+// replaced database back in.
+func RollbackRestore(conn *gorm.DB, restoreID string) (db.Restore, error) {
+	restore, err := db.GetRestoreRecordByID(conn, restoreID)
+	if err != nil {
+		return restore, err
+	}
+	if restore.Status == RestoreStatusRunning || restore.Status == RestoreStatusRolledBack {
+		return restore, fmt.Errorf("restore %s is %s", restoreID, restore.Status)
+	}
+	if restore.PreviousDatabase != "" {
+		return rollbackStagedRestore(conn, restore)
+	}
+	if restore.SafetyBackup == nil || restore.SafetyBackup.Status != BackupStatusCompleted {
+		return restore, fmt.Errorf("restore %s has no safety backup to roll back to", restoreID)
+	}
+	safety := restore.SafetyBackup
+
+	target, err := db.GetCredentialsById(conn, strconv.FormatUint(uint64(restore.TargetConnectionID), 10))
+	if err != nil {
+		return restore, err
+	}
+
+	manager := BackupManager{
+		Host:         target.PostgresHost,
+		Port:         target.PostgresPort,
+		DBName:       restore.TargetDatabase,
+		User:         target.PostgresUser,
+		Password:     target.PostgresPassword,
+		Catalog:      conn,
+		ConnectionID: target.ID,
+	}
+	if safety.DestinationID != nil {
+		dest, err := db.GetBackupDestinationByID(conn, strconv.FormatUint(uint64(*safety.DestinationID), 10))
+		if err != nil {
+			return restore, err
+		}
+		manager.BackupDestination = &dest
+	}
+
+	log.Printf("Rolling back restore %d of %s with safety backup %s", restore.ID, restore.TargetDatabase, safety.Filename)
+	_, err = manager.RestoreFromBackup(BackupDestination(safety.DestinationType), safety.Filename, RestoreOptions{rollbackOf: &restore.ID})
+	if err != nil {
+		return restore, err
+	}
+
+	restore.Status = RestoreStatusRolledBack
+	if err := db.UpdateRestoreRecord(conn, &restore); err != nil {
+		log.Printf("Unable to update restore record %d: %v", restore.ID, err)
+	}
+	return restore, nil
+}
+
+// rollbackStagedRestore swaps the database a staged restore replaced back
+// in. The restored database is kept in its place under a _rolledback_ name
+// and dropped by the janitor after DEFAULT_KEEP_PREVIOUS.
+func rollbackStagedRestore(conn *gorm.DB, restore db.Restore) (db.Restore, error) {
+	if restore.PreviousDroppedAt != nil {
+		return restore, fmt.Errorf("database %s replaced by restore %d was already dropped", restore.PreviousDatabase, restore.ID)
+	}
+
+	target, err := db.GetCredentialsById(conn, strconv.FormatUint(uint64(restore.TargetConnectionID), 10))
+	if err != nil {
+		return restore, err
+	}
+
+	manager := BackupManager{
+		Host:     target.PostgresHost,
+		Port:     target.PostgresPort,
+		DBName:   restore.TargetDatabase,
+		User:     target.PostgresUser,
+		Password: target.PostgresPassword,
+	}
+	maintenance := manager
+	maintenance.DBName = target.PostgresDBName
+	if maintenance.DBName == restore.TargetDatabase || maintenance.DBName == restore.PreviousDatabase {
+		maintenance.DBName = "postgres"
+	}
+
+	rolledBackName := suffixedDatabaseName(restore.TargetDatabase, "_rolledback_"+time.Now().Format("20060102_150405"))
+	log.Printf("Rolling back staged restore %d of %s by swapping %s back in", restore.ID, restore.TargetDatabase, restore.PreviousDatabase)
+	if _, err := manager.swapDatabase(maintenance, restore.PreviousDatabase, rolledBackName); err != nil {
+		return restore, err
+	}
+
+	dropAt := time.Now().Add(DEFAULT_KEEP_PREVIOUS)
+	restore.Status = RestoreStatusRolledBack
+	restore.PreviousDatabase = rolledBackName
+	restore.DropPreviousAt = &dropAt
+	if err := db.UpdateRestoreRecord(conn, &restore); err != nil {
+		log.Printf("Unable to update restore record %d: %v", restore.ID, err)
+	}
+	return restore, nil
+}
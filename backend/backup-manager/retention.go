@@ -0,0 +1,68 @@
+package backup_manager
+
+import (
+	"log"
+	"pg_bckup_mgr/db"
+
+	"gorm.io/gorm"
+)
+
+// applyRetention deletes the schedule's backups beyond its RetentionCount.
+// Backups that a retained incremental backup is built on are always kept,
+// so retention never breaks a chain.
+func (b BackupManager) applyRetention(schedule db.BackupSchedule) {
+	if b.Catalog == nil || schedule.RetentionCount <= 0 {
+		return
+	}
+
+	var backups []db.Backup
+	if err := b.Catalog.Where("schedule_id = ? AND status = ?", schedule.ID, BackupStatusCompleted).Order("id DESC").Find(&backups).Error; err != nil {
+		log.Printf("Error loading backups for retention of schedule %d: %v", schedule.ID, err)
+		return
+	}
+	if len(backups) <= schedule.RetentionCount {
+		return
+	}
+
+	keep := map[uint]bool{}
+	for i := range backups[:schedule.RetentionCount] {
+		keep[backups[i].ID] = true
+		chain, err := b.backupChain(&backups[i])
+		if err != nil {
+			log.Printf("Retention for schedule %d: %v", schedule.ID, err)
+			continue
+		}
+		for _, link := range chain {
+			keep[link.ID] = true
+		}
+	}
+
+	// Newest first, so incremental backups go before the backups they
+	// depend on.
+	for _, backup := range backups[schedule.RetentionCount:] {
+		if keep[backup.ID] {
+			continue
+		}
+		log.Printf("Retention for schedule %d: deleting backup %s", schedule.ID, backup.Filename)
+		if err := b.DeleteBackup(BackupDestination(backup.DestinationType), backup.Filename); err != nil {
+			log.Printf("Retention for schedule %d: unable to delete %s: %v", schedule.ID, backup.Filename, err)
+		}
+	}
+}
+
+// incrementalsSinceFull counts the schedule's incremental backups taken
+// after its most recent full base backup.
+func incrementalsSinceFull(conn *gorm.DB, scheduleID uint) int {
+	var backups []db.Backup
+	conn.Where("schedule_id = ? AND status = ? AND backup_type IN ?", scheduleID, BackupStatusCompleted,
+		[]string{string(BackupPhysical), string(BackupIncremental)}).Order("id DESC").Find(&backups)
+
+	count := 0
+	for _, backup := range backups {
+		if backup.BackupType != string(BackupIncremental) {
+			break
+		}
+		count++
+	}
+	return count
+}
@@ -1,9 +1,15 @@
 package backup_manager
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"pg_bckup_mgr/auth"
@@ -17,6 +23,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// CHECKSUM_METADATA_KEY is the user metadata entry holding the SHA-256 of
+// an uploaded backup.
+const CHECKSUM_METADATA_KEY = "sha256"
+
+// MAX_SERVER_SIDE_COPY_SIZE is the largest object a single CopyObject
+// request can copy.
+const MAX_SERVER_SIDE_COPY_SIZE = 5 << 30
+
 type S3Client struct {
 	ConnectionName string
 	EndpointURL    string
@@ -26,7 +40,10 @@ type S3Client struct {
 	SecretKeyID    string
 	UseSSL         bool
 	VerifySSL      bool
-	client         *s3.Client
+	// Progress, when set, is called with the bytes transferred by uploads
+	// and downloads.
+	Progress ProgressFunc
+	client   *s3.Client
 }
 
 func NewS3Client(connectionName, endpointURL, region, bucketName, accessKeyID, secretKeyID string, useSSL, verifySSL bool) (*S3Client, error) {
@@ -128,6 +145,17 @@ func (s *S3Client) DeleteBucket() error {
 }
 
 func (s *S3Client) UploadFile(filePath string) error {
+	return s.UploadFileWithKey(filePath, filepath.Base(filePath))
+}
+
+func (s *S3Client) UploadFileWithKey(filePath, key string) error {
+	return s.UploadFileWithChecksum(filePath, key, "")
+}
+
+// UploadFileWithChecksum uploads a file whose SHA-256 (hex encoded) is
+// known. S3 rejects the upload when the received bytes do not match, and
+// the checksum is kept in the object's metadata for later downloads.
+func (s *S3Client) UploadFileWithChecksum(filePath, key, checksum string) error {
 	// Timeout updated to 30 minutes
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
 	defer cancel()
@@ -138,13 +166,26 @@ func (s *S3Client) UploadFile(filePath string) error {
 	}
 	defer file.Close()
 
-	fileName := filepath.Base(filePath)
+	var body io.Reader = file
+	if s.Progress != nil {
+		body = newProgressReader(file, s.Progress)
+	}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(s.BucketName),
-		Key:    aws.String(fileName),
-		Body:   file,
-	})
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if checksum != "" {
+		raw, err := hex.DecodeString(checksum)
+		if err != nil {
+			return fmt.Errorf("invalid checksum for %s: %w", filePath, err)
+		}
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(raw))
+		input.Metadata = map[string]string{CHECKSUM_METADATA_KEY: checksum}
+	}
+
+	_, err = s.client.PutObject(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to upload file %s to bucket %s: %w", filePath, s.BucketName, err)
 	}
@@ -152,6 +193,110 @@ func (s *S3Client) UploadFile(filePath string) error {
 	return nil
 }
 
+// CopyObject copies an object from another bucket behind the same endpoint
+// without passing it through this host. The object's metadata, and with
+// it its checksum, is copied along.
+func (s *S3Client) CopyObject(sourceBucket, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
+	defer cancel()
+
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.BucketName),
+		Key:        aws.String(key),
+		CopySource: aws.String(sourceBucket + "/" + url.PathEscape(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s from bucket %s to bucket %s: %w", key, sourceBucket, s.BucketName, err)
+	}
+	return nil
+}
+
+// CopyFrom streams an object of another S3 client's bucket into this one
+// and returns the SHA-256 of the streamed bytes. checksum, when known, is
+// kept in the new object's metadata and the copy is removed again when the
+// streamed bytes do not match it.
+func (s *S3Client) CopyFrom(source *S3Client, key, checksum string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
+	defer cancel()
+
+	output, err := source.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(source.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %s from bucket %s: %w", key, source.BucketName, err)
+	}
+	defer output.Body.Close()
+
+	hash := sha256.New()
+	var body io.Reader = io.TeeReader(output.Body, hash)
+	if s.Progress != nil {
+		stream := &progressStream{reader: body, report: s.Progress}
+		if output.ContentLength != nil {
+			stream.total = *output.ContentLength
+		}
+		body = stream
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if checksum != "" {
+		input.Metadata = map[string]string{CHECKSUM_METADATA_KEY: checksum}
+	}
+	// The uploader sends the unseekable body in parts.
+	if _, err := manager.NewUploader(s.client).Upload(ctx, input); err != nil {
+		return "", fmt.Errorf("failed to upload file %s to bucket %s: %w", key, s.BucketName, err)
+	}
+
+	streamed := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && streamed != checksum {
+		s.DeleteFile(key)
+		return "", fmt.Errorf("copy of %s is corrupt: expected sha256 %s, got %s", key, checksum, streamed)
+	}
+	return streamed, nil
+}
+
+// UploadData stores a small object, such as a metadata sidecar.
+func (s *S3Client) UploadData(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to bucket %s: %w", key, s.BucketName, err)
+	}
+	return nil
+}
+
+// ReadData reads a small object, such as a metadata sidecar, up to limit
+// bytes.
+func (s *S3Client) ReadData(key string, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(output.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	return data, nil
+}
+
 func (s *S3Client) ListFiles() ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -210,27 +355,120 @@ func (s *S3Client) BucketExists() (bool, error) {
 	return true, nil
 }
 
+// DownloadFile downloads an object to localPath, verifying it against the
+// checksum in its metadata when it has one.
 func (s *S3Client) DownloadFile(key, localPath string) error {
+	_, err := s.downloadFile(key, localPath)
+	return err
+}
+
+// downloadFile is DownloadFile returning the checksum the file was verified
+// against, "" for objects without one.
+func (s *S3Client) downloadFile(key, localPath string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to download file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	checksum := head.Metadata[CHECKSUM_METADATA_KEY]
+
 	file, err := os.Create(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to create local file %s: %w", localPath, err)
+		return "", fmt.Errorf("failed to create local file %s: %w", localPath, err)
 	}
 	defer file.Close()
 
+	var output io.WriterAt = file
+	if s.Progress != nil {
+		writer := &progressWriterAt{file: file, report: s.Progress}
+		if head.ContentLength != nil {
+			writer.total = *head.ContentLength
+		}
+		output = writer
+	}
+
 	downloader := manager.NewDownloader(s.client)
 
-	_, err = downloader.Download(ctx, file, &s3.GetObjectInput{
+	_, err = downloader.Download(ctx, output, &s3.GetObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to download file %s from bucket %s: %w", key, s.BucketName, err)
+		return "", fmt.Errorf("failed to download file %s from bucket %s: %w", key, s.BucketName, err)
 	}
 
-	return nil
+	if checksum != "" {
+		if err := verifyFileChecksum(localPath, checksum); err != nil {
+			return "", fmt.Errorf("downloaded file %s is corrupt: %w", key, err)
+		}
+	}
+	// Keep the object's age, e.g. for backups adopted from the bucket.
+	if head.LastModified != nil {
+		os.Chtimes(localPath, *head.LastModified, *head.LastModified)
+	}
+	return checksum, nil
+}
+
+// OpenFile reads an object, only the given HTTP range of it when rng is
+// not empty. The caller closes the returned body.
+func (s *S3Client) OpenFile(ctx context.Context, key, rng string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	}
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+
+	output, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	return output, nil
+}
+
+// PresignDownload returns a URL anyone can download the object from until
+// it expires after ttl.
+func (s *S3Client) PresignDownload(key string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	presigner := s3.NewPresignClient(s.client)
+	request, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(s.BucketName),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", filepath.Base(key))),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign file %s in bucket %s: %w", key, s.BucketName, err)
+	}
+	return request.URL, nil
+}
+
+// HashFile reads an object and returns its SHA-256, hex encoded.
+func (s *S3Client) HashFile(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
+	defer cancel()
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	defer output.Body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, output.Body); err != nil {
+		return "", fmt.Errorf("failed to read file %s from bucket %s: %w", key, s.BucketName, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (s *S3Client) TestConnection() bool {
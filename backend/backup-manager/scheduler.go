@@ -1,6 +1,7 @@
 package backup_manager
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -13,7 +14,7 @@ import (
 	"gorm.io/gorm"
 )
 
-func CreateSchedule(conn *gorm.DB, connectionId string, destinationId string, schedule string) error {
+func CreateSchedule(conn *gorm.DB, connectionId string, destinationId string, schedule string, opts ScheduleOptions) error {
 	parser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 	cronSchedule, err := parser.Parse(schedule)
 	if err != nil {
@@ -21,6 +22,23 @@ func CreateSchedule(conn *gorm.DB, connectionId string, destinationId string, sc
 		return errors.New("invalid cron expression")
 	}
 
+	parsedType, err := ParseBackupType(string(opts.BackupType))
+	if err != nil {
+		log.Printf("Invalid backup type '%s': %v", opts.BackupType, err)
+		return err
+	}
+	if opts.FullBackupEvery < 0 || opts.RetentionCount < 0 {
+		return errors.New("full_backup_every and retention_count must not be negative")
+	}
+	if err := opts.Dump.Normalize(); err != nil {
+		log.Printf("Invalid backup options: %v", err)
+		return err
+	}
+	if err := ValidateCopyTargets(conn, opts.Copies); err != nil {
+		log.Printf("Invalid copy destinations: %v", err)
+		return err
+	}
+
 	dest, err := db.GetBackupDestinationByID(conn, destinationId)
 	if err != nil {
 		log.Printf("Error getting destination: %v", err)
@@ -37,11 +55,18 @@ func CreateSchedule(conn *gorm.DB, connectionId string, destinationId string, sc
 	nextRun := cronSchedule.Next(now)
 
 	newSchedule := db.BackupSchedule{
-		ConnectionID:  creds.ID,
-		DestinationID: dest.ID,
-		Schedule:      schedule,
-		Enabled:       true,
-		NextRun:       &nextRun,
+		ConnectionID:       creds.ID,
+		DestinationID:      dest.ID,
+		Schedule:           schedule,
+		BackupType:         string(parsedType),
+		FullBackupEvery:    opts.FullBackupEvery,
+		RetentionCount:     opts.RetentionCount,
+		Options:            opts.Dump.String(),
+		VerifyConnectionID: opts.VerifyConnectionID,
+		VerifyAssertions:   encodeAssertions(opts.VerifyAssertions),
+		CopyDestinations:   encodeCopyTargets(opts.Copies),
+		Enabled:            true,
+		NextRun:            &nextRun,
 	}
 
 	if err := conn.Create(&newSchedule).Error; err != nil {
@@ -71,10 +96,17 @@ func UpdateSchedule(conn *gorm.DB, scheduleId string, updates map[string]interfa
 	}
 
 	allowedFields := map[string]bool{
-		"schedule":       true,
-		"enabled":        true,
-		"connection_id":  true,
-		"destination_id": true,
+		"schedule":             true,
+		"enabled":              true,
+		"connection_id":        true,
+		"destination_id":       true,
+		"backup_type":          true,
+		"full_backup_every":    true,
+		"retention_count":      true,
+		"options":              true,
+		"verify_connection_id": true,
+		"verify_assertions":    true,
+		"copy_destinations":    true,
 	}
 
 	filteredUpdates := make(map[string]interface{})
@@ -90,6 +122,52 @@ func UpdateSchedule(conn *gorm.DB, scheduleId string, updates map[string]interfa
 		return errors.New("no valid fields to update")
 	}
 
+	if backupType, ok := filteredUpdates["backup_type"]; ok {
+		parsed, err := ParseBackupType(backupType.(string))
+		if err != nil {
+			log.Printf("Invalid backup type '%s': %v", backupType, err)
+			return err
+		}
+		filteredUpdates["backup_type"] = string(parsed)
+	}
+
+	if options, ok := filteredUpdates["options"]; ok {
+		opts, ok := options.(BackupOptions)
+		if !ok {
+			return errors.New("invalid backup options")
+		}
+		if err := opts.Normalize(); err != nil {
+			log.Printf("Invalid backup options: %v", err)
+			return err
+		}
+		filteredUpdates["options"] = opts.String()
+	}
+
+	// A verify connection of 0 turns verification off.
+	if id, ok := filteredUpdates["verify_connection_id"]; ok && id == uint(0) {
+		filteredUpdates["verify_connection_id"] = nil
+	}
+
+	if assertions, ok := filteredUpdates["verify_assertions"]; ok {
+		list, ok := assertions.([]string)
+		if !ok {
+			return errors.New("invalid verify assertions")
+		}
+		filteredUpdates["verify_assertions"] = encodeAssertions(list)
+	}
+
+	if copies, ok := filteredUpdates["copy_destinations"]; ok {
+		targets, ok := copies.([]CopyTarget)
+		if !ok {
+			return errors.New("invalid copy destinations")
+		}
+		if err := ValidateCopyTargets(conn, targets); err != nil {
+			log.Printf("Invalid copy destinations: %v", err)
+			return err
+		}
+		filteredUpdates["copy_destinations"] = encodeCopyTargets(targets)
+	}
+
 	if newScheduleStr, ok := filteredUpdates["schedule"]; ok {
 		parser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 		cronSchedule, err := parser.Parse(newScheduleStr.(string))
@@ -251,6 +329,14 @@ func RecalculateNextRun(conn *gorm.DB, scheduleId string) error {
 var scheduler *cron.Cron
 var schedulerMu sync.Mutex
 
+// registeredSchedules is the fingerprint of the schedules the scheduler
+// runs, see WatchBackupSchedules.
+var registeredSchedules string
+
+// SCHEDULE_RELOAD_INTERVAL is how often the schedules are checked for
+// changes made outside of this process.
+const SCHEDULE_RELOAD_INTERVAL = time.Minute
+
 func loadBackupSchedules(conn *gorm.DB) []db.BackupSchedule {
 	var schedules []db.BackupSchedule
 
@@ -274,14 +360,63 @@ func executeBackup(conn *gorm.DB, schedule db.BackupSchedule) {
 		User:              schedule.Connection.PostgresUser,
 		Password:          schedule.Connection.PostgresPassword,
 		BackupDestination: &schedule.Destination,
+		Catalog:           conn,
+		ConnectionID:      schedule.ConnectionID,
+		ScheduleID:        &schedule.ID,
+	}
+
+	backupType := BackupType(schedule.BackupType)
+	if backupType == BackupIncremental && schedule.FullBackupEvery > 0 &&
+		incrementalsSinceFull(conn, schedule.ID) >= schedule.FullBackupEvery {
+		log.Printf("Schedule %d reached %d incremental backups, taking a full base backup", schedule.ID, schedule.FullBackupEvery)
+		backupType = BackupPhysical
+	}
+
+	opts, err := ParseBackupOptions(schedule.Options)
+	if err != nil {
+		log.Printf("Ignoring invalid options of schedule %d: %v", schedule.ID, err)
+	}
+	manager.Copies, err = ParseCopyTargets(schedule.CopyDestinations)
+	if err != nil {
+		log.Printf("Ignoring invalid copy destinations of schedule %d: %v", schedule.ID, err)
 	}
 
 	//TODO add local
-	manager.CreateBackup(BackupDestination("s3"))
+	if err := manager.CreateBackup(BackupDestination("s3"), backupType, opts); err == nil {
+		if schedule.VerifyConnectionID != nil && backupType == BackupLogical {
+			verifyScheduledBackup(conn, schedule)
+		}
+		manager.applyRetention(schedule)
+	}
 
 	log.Printf("Backup executed for schedule ID: %d", schedule.ID)
 }
 
+func encodeAssertions(assertions []string) string {
+	if len(assertions) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(assertions)
+	return string(data)
+}
+
+func verifyScheduledBackup(conn *gorm.DB, schedule db.BackupSchedule) {
+	var assertions []string
+	if schedule.VerifyAssertions != "" {
+		if err := json.Unmarshal([]byte(schedule.VerifyAssertions), &assertions); err != nil {
+			log.Printf("Ignoring invalid verify assertions of schedule %d: %v", schedule.ID, err)
+		}
+	}
+
+	verification, err := VerifyLatestBackup(conn, strconv.FormatUint(uint64(schedule.ID), 10),
+		strconv.FormatUint(uint64(*schedule.VerifyConnectionID), 10), assertions)
+	if err != nil {
+		log.Printf("Unable to verify backup of schedule %d: %v", schedule.ID, err)
+		return
+	}
+	log.Printf("Verification of schedule %d backup: %s", schedule.ID, verification.Status)
+}
+
 func updateScheduleRunTimes(conn *gorm.DB, schedule db.BackupSchedule) {
 	parser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 	cronSchedule, err := parser.Parse(schedule.Schedule)
@@ -323,6 +458,7 @@ func RegisterBackupSchedules(conn *gorm.DB) {
 		log.Println("No backup schedules loaded")
 		return
 	}
+	registeredSchedules = schedulesFingerprint(schedules)
 
 	log.Printf("Registering %d backup schedules", len(schedules))
 
@@ -345,6 +481,45 @@ func RegisterBackupSchedules(conn *gorm.DB) {
 	scheduler.Start()
 }
 
+// schedulesFingerprint identifies the schedules as they are registered,
+// without the fields that change on every run.
+func schedulesFingerprint(schedules []db.BackupSchedule) string {
+	var fingerprint []db.BackupSchedule
+	for _, s := range schedules {
+		s.LastRun, s.NextRun = nil, nil
+		s.CreatedAt, s.UpdatedAt = time.Time{}, time.Time{}
+		s.Connection.ServerVersion = 0
+		s.Connection.CreatedAt, s.Connection.UpdatedAt = time.Time{}, time.Time{}
+		s.Destination.CreatedAt, s.Destination.UpdatedAt = time.Time{}, time.Time{}
+		fingerprint = append(fingerprint, s)
+	}
+	data, _ := json.Marshal(fingerprint)
+	return string(data)
+}
+
+// WatchBackupSchedules reloads the scheduler when the schedules, or their
+// connections and destinations, were changed outside of this process, e.g.
+// by "apply-config" or "import-config".
+func WatchBackupSchedules(conn *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(SCHEDULE_RELOAD_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			schedules := loadBackupSchedules(conn)
+			if schedules == nil {
+				continue
+			}
+			schedulerMu.Lock()
+			changed := schedulesFingerprint(schedules) != registeredSchedules
+			schedulerMu.Unlock()
+			if changed {
+				log.Println("Backup schedules changed in the database")
+				RestartBackupScheduler(conn)
+			}
+		}
+	}()
+}
+
 func StopBackupScheduler() {
 	schedulerMu.Lock()
 	defer schedulerMu.Unlock()
@@ -0,0 +1,228 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/auth"
+	"pg_bckup_mgr/db"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+// SELF_BACKUP_PREFIX is the S3 key prefix (and hidden local subdirectory,
+// with a leading dot) under which the manager's own database is backed up,
+// apart from the backups of the connections.
+const SELF_BACKUP_PREFIX = "manager/"
+
+const DEFAULT_SELF_BACKUP_RETENTION = 7
+
+// selfBackupSettings reads the self-backup configuration from the
+// environment:
+//
+//   - SELF_BACKUP_SCHEDULE: cron expression, self-backups are off when unset
+//   - SELF_BACKUP_DESTINATION: "local" (default) or the ID of an S3 destination
+//   - SELF_BACKUP_RETENTION: most recent self-backups to keep, default 7
+func selfBackupSettings() (schedule, destination string, retention int) {
+	schedule = os.Getenv("SELF_BACKUP_SCHEDULE")
+	destination = os.Getenv("SELF_BACKUP_DESTINATION")
+	if destination == "" {
+		destination = "local"
+	}
+	retention = DEFAULT_SELF_BACKUP_RETENTION
+	if value := os.Getenv("SELF_BACKUP_RETENTION"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			retention = n
+		} else {
+			log.Printf("Ignoring invalid SELF_BACKUP_RETENTION %q", value)
+		}
+	}
+	return schedule, destination, retention
+}
+
+// selfBackupManager returns an uncatalogued manager for the manager's own
+// database, from DATABASE_URL, and the destination it is backed up to.
+func selfBackupManager(conn *gorm.DB) (BackupManager, BackupDestination, error) {
+	config, err := pgconn.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return BackupManager{}, "", fmt.Errorf("invalid DATABASE_URL: %w", err)
+	}
+	// Passwords are stored encrypted, like the ones of connections.
+	password, err := auth.EncryptString(config.Password)
+	if err != nil {
+		return BackupManager{}, "", err
+	}
+	manager := BackupManager{
+		Host:     config.Host,
+		Port:     strconv.Itoa(int(config.Port)),
+		DBName:   config.Database,
+		User:     config.User,
+		Password: password,
+	}
+
+	_, destinationParam, _ := selfBackupSettings()
+	if destinationParam == "local" {
+		return manager, BackupFilesystem, nil
+	}
+	dest, err := db.GetBackupDestinationByID(conn, destinationParam)
+	if err != nil {
+		return manager, "", fmt.Errorf("invalid SELF_BACKUP_DESTINATION: %w", err)
+	}
+	manager.BackupDestination = &dest
+	return manager, BackupS3Bucket, nil
+}
+
+func selfBackupDir() string {
+	return filepath.Join(LOCAL_BACKUP_DIR, "."+strings.TrimSuffix(SELF_BACKUP_PREFIX, "/"))
+}
+
+// CreateSelfBackup dumps the manager's own database, its connections,
+// destinations, schedules, users and catalog, to the configured
+// destination and drops the self-backups beyond the retention count. It
+// returns the name the dump was stored under.
+func CreateSelfBackup(conn *gorm.DB, job *Job) (string, error) {
+	manager, destination, err := selfBackupManager(conn)
+	if err != nil {
+		return "", err
+	}
+	manager.Job = job
+
+	os.MkdirAll(selfBackupDir(), 0755)
+	filename := fmt.Sprintf("manager_%s.dump", time.Now().Format("20060102_150405"))
+	dumpPath := filepath.Join(selfBackupDir(), filename)
+	log.Printf("Backing up the manager's database to %s", destination)
+	if err := manager.createPgDumpBackup(dumpPath, BackupOptions{Format: DumpCustom}, "", 0); err != nil {
+		os.Remove(dumpPath)
+		return "", fmt.Errorf("self-backup failed: %w", err)
+	}
+	checksum, err := fileChecksum(dumpPath)
+	if err != nil {
+		os.Remove(dumpPath)
+		return "", err
+	}
+
+	switch destination {
+	case BackupFilesystem:
+		if err := writeChecksumFile(dumpPath, checksum); err != nil {
+			log.Printf("Unable to write checksum file for %s: %v", dumpPath, err)
+		}
+	case BackupS3Bucket:
+		defer os.Remove(dumpPath)
+		S3Client, err := manager.newS3Client()
+		if err != nil {
+			return "", fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		S3Client.Progress = job.StartPhase("upload", "bytes")
+		filename = SELF_BACKUP_PREFIX + filename
+		if err := S3Client.UploadFileWithChecksum(dumpPath, filename, checksum); err != nil {
+			return "", err
+		}
+	}
+
+	_, _, retention := selfBackupSettings()
+	manager.applySelfBackupRetention(destination, retention)
+	log.Printf("Self-backup %s stored on %s", filename, destination)
+	return filename, nil
+}
+
+// ListSelfBackups lists the stored self-backups, oldest first.
+func ListSelfBackups(conn *gorm.DB) ([]string, error) {
+	manager, destination, err := selfBackupManager(conn)
+	if err != nil {
+		return nil, err
+	}
+	return manager.listSelfBackups(destination)
+}
+
+func (b BackupManager) listSelfBackups(destination BackupDestination) ([]string, error) {
+	var names []string
+	switch destination {
+	case BackupFilesystem:
+		entries, err := os.ReadDir(selfBackupDir())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "manager_") && !strings.HasSuffix(entry.Name(), CHECKSUM_SUFFIX) {
+				names = append(names, entry.Name())
+			}
+		}
+	case BackupS3Bucket:
+		S3Client, err := b.newS3Client()
+		if err != nil {
+			return nil, fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		keys, err := S3Client.ListFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, SELF_BACKUP_PREFIX) {
+				names = append(names, key)
+			}
+		}
+	}
+	// The names end in their timestamps.
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b BackupManager) applySelfBackupRetention(destination BackupDestination, retention int) {
+	names, err := b.listSelfBackups(destination)
+	if err != nil {
+		log.Printf("Self-backup retention: %v", err)
+		return
+	}
+	for len(names) > retention {
+		name := names[0]
+		names = names[1:]
+		log.Printf("Self-backup retention: deleting %s", name)
+		var err error
+		if destination == BackupFilesystem {
+			path := filepath.Join(selfBackupDir(), name)
+			err = os.Remove(path)
+			os.Remove(path + CHECKSUM_SUFFIX)
+		} else {
+			var S3Client *S3Client
+			if S3Client, err = b.newS3Client(); err == nil {
+				err = S3Client.DeleteFile(name)
+			}
+		}
+		if err != nil {
+			log.Printf("Self-backup retention: unable to delete %s: %v", name, err)
+		}
+	}
+}
+
+// StartSelfBackups backs up the manager's own database on the
+// SELF_BACKUP_SCHEDULE, when one is set.
+func StartSelfBackups(conn *gorm.DB) {
+	schedule, destination, retention := selfBackupSettings()
+	if schedule == "" {
+		log.Println("Self-backups are disabled, set SELF_BACKUP_SCHEDULE to enable them")
+		return
+	}
+
+	selfBackups := cron.New()
+	_, err := selfBackups.AddFunc(schedule, func() {
+		job := NewJob("self-backup", "backup of the manager's database")
+		_, err := CreateSelfBackup(conn, job)
+		job.Finish(err)
+		if err != nil {
+			log.Printf("Self-backup failed: %v", err)
+		}
+	})
+	if err != nil {
+		log.Printf("Invalid SELF_BACKUP_SCHEDULE %q: %v", schedule, err)
+		return
+	}
+	selfBackups.Start()
+	log.Printf("Self-backups scheduled at %q to %s, keeping %d", schedule, destination, retention)
+}
@@ -0,0 +1,228 @@
+package backup_manager
+
+import (
+	"fmt"
+	"log"
+	"pg_bckup_mgr/db"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// DEFAULT_KEEP_PREVIOUS is how long a database replaced by a staged restore
+// is kept before the janitor drops it.
+const DEFAULT_KEEP_PREVIOUS = 24 * time.Hour
+
+// stagedRestore restores into a new database next to the target, checks it
+// and swaps it in by renaming, so the target is only unavailable for the
+// swap itself. The replaced database is kept as <target>_prev_<timestamp>.
+func (b BackupManager) stagedRestore(destination BackupDestination, filename string, restoreOpts RestoreOptions, restore *db.Restore, report *RestoreReport) error {
+	target := b.restoreTarget(restoreOpts)
+	timestamp := time.Now().Format("20060102_150405")
+	stagingName := suffixedDatabaseName(target.DBName, "_staging_"+timestamp)
+	previousName := suffixedDatabaseName(target.DBName, "_prev_"+timestamp)
+
+	stagingOpts := restoreOpts
+	stagingOpts.Staging = false
+	stagingOpts.TargetDBName = stagingName
+	stagingOpts.CreateDatabase = true
+	stagingOpts.SkipSafetyBackup = true
+	stagingOpts.TerminateSessions = false
+	staging := b.restoreTarget(stagingOpts)
+
+	maintenance := target
+	maintenance.DBName = b.maintenanceDatabase(restoreOpts, target.DBName)
+	dropStaging := func() {
+		if err := maintenance.dropDatabase(stagingName); err != nil {
+			log.Printf("Unable to drop staging database %s: %v", stagingName, err)
+		}
+	}
+
+	if err := b.restoreFromBackup(destination, filename, stagingOpts, nil, report); err != nil {
+		dropStaging()
+		return err
+	}
+
+	err := report.phase("validate", func() error {
+		var expected db.Backup
+		if record := b.lookupBackupRecord(filename); record != nil {
+			expected = *record
+		}
+		checks, err := staging.runVerificationChecks(expected, nil)
+		if err != nil {
+			return err
+		}
+		for _, check := range checks {
+			if !check.Passed {
+				return fmt.Errorf("staging database check %s failed: expected %s, got %s", check.Name, check.Expected, check.Actual)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		dropStaging()
+		return err
+	}
+
+	var replaced bool
+	err = report.phase("swap", func() error {
+		var err error
+		replaced, err = target.swapDatabase(maintenance, stagingName, previousName)
+		return err
+	})
+	if err != nil {
+		dropStaging()
+		return err
+	}
+
+	if replaced && restore != nil {
+		keep := DEFAULT_KEEP_PREVIOUS
+		if restoreOpts.KeepPrevious > 0 {
+			keep = restoreOpts.KeepPrevious
+		}
+		dropAt := time.Now().Add(keep)
+		restore.PreviousDatabase = previousName
+		restore.DropPreviousAt = &dropAt
+	}
+	log.Printf("Staged restore of %s swapped into %s", filename, target.DBName)
+	return nil
+}
+
+// swapDatabase renames the target to previousName and the staging database
+// to the target's name. It reports whether there was a target to replace.
+// Connections to the target are turned off with ALLOW_CONNECTIONS, which
+// applies to every role, and the rename waits for the terminated sessions
+// to exit, as it fails while anyone is connected.
+func (b BackupManager) swapDatabase(maintenance BackupManager, stagingName, previousName string) (bool, error) {
+	conn, err := maintenance.Connect()
+	if err != nil {
+		return false, fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	var allowConn []bool
+	if err := conn.Raw("SELECT datallowconn FROM pg_database WHERE datname = ?", b.DBName).Scan(&allowConn).Error; err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", b.DBName, err)
+	}
+	replace := len(allowConn) > 0
+	setAllowConn := func(name string) {
+		if !replace {
+			return
+		}
+		err := conn.Exec(fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS %t", quoteIdentifier(name), allowConn[0])).Error
+		if err != nil {
+			log.Printf("Unable to allow connections to %s again: %v", name, err)
+		}
+	}
+
+	if replace {
+		if err := conn.Exec("ALTER DATABASE " + quoteIdentifier(b.DBName) + " ALLOW_CONNECTIONS false").Error; err != nil {
+			return false, fmt.Errorf("failed to block new connections to %s: %w", b.DBName, err)
+		}
+		terminated, err := terminateSessions(conn, b.DBName)
+		if err != nil {
+			setAllowConn(b.DBName)
+			return false, err
+		}
+		log.Printf("Terminated %d sessions on %s", terminated, b.DBName)
+		if err := conn.Exec("ALTER DATABASE " + quoteIdentifier(b.DBName) + " RENAME TO " + quoteIdentifier(previousName)).Error; err != nil {
+			setAllowConn(b.DBName)
+			return false, fmt.Errorf("failed to rename %s: %w", b.DBName, err)
+		}
+	}
+
+	if err := conn.Exec("ALTER DATABASE " + quoteIdentifier(stagingName) + " RENAME TO " + quoteIdentifier(b.DBName)).Error; err != nil {
+		if replace {
+			conn.Exec("ALTER DATABASE " + quoteIdentifier(previousName) + " RENAME TO " + quoteIdentifier(b.DBName))
+			setAllowConn(b.DBName)
+		}
+		return false, fmt.Errorf("failed to rename %s to %s: %w", stagingName, b.DBName, err)
+	}
+
+	// The previous database is swapped back by rolling back the restore.
+	setAllowConn(previousName)
+	return replace, nil
+}
+
+// maintenanceDatabase picks a database on the target server to run
+// statements about other databases from: the one configured on the
+// connection, unless that is the database being replaced.
+func (b BackupManager) maintenanceDatabase(opts RestoreOptions, targetDB string) string {
+	name := b.DBName
+	if opts.Target != nil {
+		name = opts.Target.PostgresDBName
+	}
+	if name == targetDB {
+		return "postgres"
+	}
+	return name
+}
+
+// suffixedDatabaseName appends suffix to name, shortening name so the result
+// fits PostgreSQL's 63 byte identifier limit without splitting a character.
+func suffixedDatabaseName(name, suffix string) string {
+	if len(name)+len(suffix) > 63 {
+		cut := 63 - len(suffix)
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	return name + suffix
+}
+
+// StartRestoreJanitor periodically drops databases replaced by staged
+// restores once their grace period is over.
+func StartRestoreJanitor(conn *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			dropExpiredPreviousDatabases(conn)
+			<-ticker.C
+		}
+	}()
+}
+
+func dropExpiredPreviousDatabases(conn *gorm.DB) {
+	var restores []db.Restore
+	err := conn.Where("previous_database <> '' AND previous_dropped_at IS NULL AND drop_previous_at <= ?", time.Now()).Find(&restores).Error
+	if err != nil {
+		log.Printf("Restore janitor: unable to load restores: %v", err)
+		return
+	}
+
+	for _, restore := range restores {
+		target, err := db.GetCredentialsById(conn, strconv.FormatUint(uint64(restore.TargetConnectionID), 10))
+		if err != nil {
+			log.Printf("Restore janitor: %v", err)
+			continue
+		}
+
+		manager := BackupManager{
+			Host:     target.PostgresHost,
+			Port:     target.PostgresPort,
+			DBName:   target.PostgresDBName,
+			User:     target.PostgresUser,
+			Password: target.PostgresPassword,
+		}
+		if manager.DBName == restore.PreviousDatabase {
+			manager.DBName = "postgres"
+		}
+
+		log.Printf("Restore janitor: dropping %s replaced by restore %d", restore.PreviousDatabase, restore.ID)
+		if err := manager.dropDatabase(restore.PreviousDatabase); err != nil {
+			log.Printf("Restore janitor: unable to drop %s: %v", restore.PreviousDatabase, err)
+			continue
+		}
+
+		droppedAt := time.Now()
+		restore.PreviousDroppedAt = &droppedAt
+		if err := db.UpdateRestoreRecord(conn, &restore); err != nil {
+			log.Printf("Restore janitor: unable to update restore %d: %v", restore.ID, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package backup_manager
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSuffixedDatabaseName(t *testing.T) {
+	const suffix = "_prev_20240102_030405"
+
+	tests := []struct {
+		name string
+		db   string
+		want string
+	}{
+		{name: "short", db: "app", want: "app" + suffix},
+		{name: "exactly at the limit", db: strings.Repeat("a", 63-len(suffix)), want: strings.Repeat("a", 63-len(suffix)) + suffix},
+		{name: "one byte over", db: strings.Repeat("a", 64-len(suffix)), want: strings.Repeat("a", 63-len(suffix)) + suffix},
+		{name: "long", db: strings.Repeat("b", 63), want: strings.Repeat("b", 63-len(suffix)) + suffix},
+		{name: "multibyte character at the cut", db: strings.Repeat("a", 63-len(suffix)-1) + "é", want: strings.Repeat("a", 63-len(suffix)-1) + suffix},
+		{name: "empty", db: "", want: suffix},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := suffixedDatabaseName(tt.db, suffix)
+			if got != tt.want {
+				t.Errorf("suffixedDatabaseName() = %q, want %q", got, tt.want)
+			}
+			if len(got) > 63 || !utf8.ValidString(got) {
+				t.Errorf("suffixedDatabaseName() = %q is not a valid identifier", got)
+			}
+		})
+	}
+}
@@ -1,9 +1,18 @@
 package backup_manager
 
-import "pg_bckup_mgr/db"
+import (
+	"pg_bckup_mgr/db"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 const LOCAL_BACKUP_DIR = "/etc/backups"
 
+// WAL_ARCHIVE_PREFIX is the S3 key prefix (and local subdirectory) under
+// which continuously archived WAL segments are stored.
+const WAL_ARCHIVE_PREFIX = "wal/"
+
 type BackupDestination string
 
 const (
@@ -11,6 +20,111 @@ const (
 	BackupS3Bucket   BackupDestination = "s3"
 )
 
+type BackupType string
+
+const (
+	BackupLogical     BackupType = "logical"
+	BackupPhysical    BackupType = "physical"
+	BackupIncremental BackupType = "incremental"
+	BackupGlobals     BackupType = "globals" // roles and tablespaces of the whole server
+)
+
+const (
+	BackupStatusRunning   = "running"
+	BackupStatusCompleted = "completed"
+	BackupStatusFailed    = "failed"
+	BackupStatusDeleted   = "deleted"
+)
+
+const (
+	RestoreStatusRunning    = "running"
+	RestoreStatusCompleted  = "completed"
+	RestoreStatusFailed     = "failed"
+	RestoreStatusRolledBack = "rolled_back"
+)
+
+type ScheduleOptions struct {
+	BackupType      BackupType
+	FullBackupEvery int
+	RetentionCount  int
+	Dump            BackupOptions
+
+	// VerifyConnectionID enables a test restore of every new backup on this
+	// sandbox connection, checked with VerifyAssertions.
+	VerifyConnectionID *uint
+	VerifyAssertions   []string
+
+	// Copies are further destinations every backup is copied to.
+	Copies []CopyTarget
+}
+
+// CopyTarget is a destination a backup is copied to besides the one it is
+// created on. DestinationID names the S3 destination and is unset for the
+// local filesystem.
+type CopyTarget struct {
+	DestinationType BackupDestination `json:"destination_type"`
+	DestinationID   *uint             `json:"destination_id,omitempty"`
+}
+
+type RestoreOptions struct {
+	// WithGlobals applies a globals backup before restoring a database dump,
+	// GlobalsFilename or else the latest one on the same destination.
+	WithGlobals     bool
+	GlobalsFilename string
+
+	// Target restores into another server instead of the one the backup was
+	// taken from, TargetDBName into another database on it. CreateDatabase
+	// creates the target database when it does not exist yet.
+	Target         *db.Connection
+	TargetDBName   string
+	CreateDatabase bool
+
+	NoOwner      bool
+	NoPrivileges bool
+	// RoleMapping reassigns everything owned by a role of the source (key) to
+	// a role on the target (value) once the restore finishes.
+	RoleMapping map[string]string
+
+	// TocEntries restricts the restore to these entries of the dump's table
+	// of contents, see ListBackupContents.
+	TocEntries []int
+
+	// SkipSafetyBackup restores without first backing up the target
+	// database.
+	SkipSafetyBackup bool
+
+	// TerminateSessions blocks new connections to the target and ends the
+	// existing ones for the duration of the restore.
+	TerminateSessions bool
+	SingleTransaction bool
+	ExitOnError       bool
+	// Jobs runs pg_restore with parallel workers, 0 uses the dump's own
+	// setting.
+	Jobs int
+
+	// Staging restores into a new database and swaps it in by renaming once
+	// it passed validation. The replaced database is dropped after
+	// KeepPrevious (DEFAULT_KEEP_PREVIOUS when zero).
+	Staging      bool
+	KeepPrevious time.Duration
+
+	rollbackOf *uint
+	skipHooks  bool // for restores of the manager itself, e.g. verification
+}
+
+// RestoreReport describes a finished or failed restore.
+type RestoreReport struct {
+	RestoreID uint          `json:"restore_id,omitempty"`
+	JobID     string        `json:"job_id,omitempty"`
+	Phases    []PhaseTiming `json:"phases"`
+}
+
+type PhaseTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
 type BackupManager struct {
 	Host              string
 	Port              string
@@ -18,4 +132,18 @@ type BackupManager struct {
 	User              string
 	Password          string
 	BackupDestination *db.Destination
+
+	// Catalog is the manager's own database, used to record created backups.
+	// When nil, backups are still created but not catalogued.
+	Catalog      *gorm.DB
+	ConnectionID uint
+	ScheduleID   *uint
+
+	// Copies are the destinations new backups are copied to once stored on
+	// their own destination.
+	Copies []CopyTarget
+
+	// Job collects the output of the tools run for this manager. Backups and
+	// restores create their own when none is set.
+	Job *Job
 }
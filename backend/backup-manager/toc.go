@@ -0,0 +1,236 @@
+package backup_manager
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// TocEntry is one object of a dump's table of contents as listed by
+// pg_restore -l.
+type TocEntry struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	Schema  string `json:"schema,omitempty"`
+	Name    string `json:"name"`
+	Owner   string `json:"owner,omitempty"`
+	Section string `json:"section"` // pre-data, data or post-data
+}
+
+// tocTypes lists the multi-word object types pg_restore prints, longest
+// first so the most specific one matches.
+var tocTypes = []string{
+	"PUBLICATION TABLES IN SCHEMA",
+	"TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY",
+	"MATERIALIZED VIEW DATA",
+	"TEXT SEARCH TEMPLATE",
+	"FOREIGN DATA WRAPPER",
+	"TEXT SEARCH PARSER",
+	"DATABASE PROPERTIES",
+	"SEQUENCE OWNED BY",
+	"PUBLICATION TABLE",
+	"MATERIALIZED VIEW",
+	"OPERATOR FAMILY",
+	"STATISTICS DATA",
+	"CHECK CONSTRAINT",
+	"OPERATOR CLASS",
+	"FOREIGN SERVER",
+	"EVENT TRIGGER",
+	"FOREIGN TABLE",
+	"ACCESS METHOD",
+	"FK CONSTRAINT",
+	"LARGE OBJECT",
+	"SEQUENCE SET",
+	"INDEX ATTACH",
+	"ROW SECURITY",
+	"USER MAPPING",
+	"DEFAULT ACL",
+	"TABLE ATTACH",
+	"TABLE DATA",
+	"BLOB DATA",
+	"SHELL TYPE",
+}
+
+var postDataTypes = map[string]bool{
+	"INDEX":                        true,
+	"INDEX ATTACH":                 true,
+	"CONSTRAINT":                   true,
+	"FK CONSTRAINT":                true,
+	"TRIGGER":                      true,
+	"EVENT TRIGGER":                true,
+	"RULE":                         true,
+	"POLICY":                       true,
+	"ROW SECURITY":                 true,
+	"PUBLICATION TABLE":            true,
+	"PUBLICATION TABLES IN SCHEMA": true,
+	"MATERIALIZED VIEW DATA":       true,
+}
+
+// ListBackupContents returns the table of contents of a stored logical
+// backup.
+func (b BackupManager) ListBackupContents(destination BackupDestination, filename string) ([]TocEntry, error) {
+	record := b.lookupBackupRecord(filename)
+	if backupTypeOf(record, filename) != BackupLogical {
+		return nil, fmt.Errorf("backup %s is not a database dump", filename)
+	}
+	opts := dumpOptionsOf(record, filename)
+	if opts.Format == DumpPlain {
+		return nil, fmt.Errorf("plain SQL backups have no table of contents")
+	}
+
+	backupPath, cleanup, err := b.fetchBackupFile(destination, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	inputPath, inputCleanup, err := dumpInput(backupPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer inputCleanup()
+
+	return b.listToc(inputPath)
+}
+
+// listToc runs pg_restore -l on a dump file or directory. Dumps it cannot
+// parse fail with pg_restore's message.
+func (b BackupManager) listToc(inputPath string) ([]TocEntry, error) {
+	list, err := b.pgCommand("pg_restore", "-l", inputPath).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("failed to list backup contents: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to list backup contents: %v", err)
+	}
+
+	var entries []TocEntry
+	for _, line := range strings.Split(string(list), "\n") {
+		if entry, ok := parseTocLine(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// parseTocLine parses a pg_restore -l line such as
+//
+//	215; 1259 16386 TABLE public accounts postgres
+//
+// Comment and blank lines are skipped.
+func parseTocLine(line string) (TocEntry, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, ";") {
+		return TocEntry{}, false
+	}
+
+	idPart, rest, ok := strings.Cut(line, ";")
+	if !ok {
+		return TocEntry{}, false
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(idPart))
+	if err != nil {
+		return TocEntry{}, false
+	}
+
+	// Skip the catalog table OID and object OID.
+	fields := strings.Fields(rest)
+	if len(fields) < 3 {
+		return TocEntry{}, false
+	}
+	rest = strings.Join(fields[2:], " ")
+
+	entryType := ""
+	for _, t := range tocTypes {
+		if strings.HasPrefix(rest, t+" ") {
+			entryType = t
+			break
+		}
+	}
+	if entryType == "" {
+		entryType, _, _ = strings.Cut(rest, " ")
+	}
+	fields = strings.Fields(strings.TrimPrefix(rest, entryType))
+
+	entry := TocEntry{ID: id, Type: entryType, Section: tocSection(entryType)}
+	switch {
+	case len(fields) >= 3:
+		entry.Schema = fields[0]
+		entry.Name = strings.Join(fields[1:len(fields)-1], " ")
+		entry.Owner = fields[len(fields)-1]
+	case len(fields) == 2:
+		entry.Schema = fields[0]
+		entry.Name = fields[1]
+	case len(fields) == 1:
+		entry.Name = fields[0]
+	}
+	if entry.Schema == "-" {
+		entry.Schema = ""
+	}
+
+	return entry, true
+}
+
+func tocSection(entryType string) string {
+	switch {
+	case strings.HasSuffix(entryType, " DATA") && entryType != "MATERIALIZED VIEW DATA",
+		entryType == "SEQUENCE SET", entryType == "LARGE OBJECT", entryType == "BLOBS":
+		return "data"
+	case postDataTypes[entryType]:
+		return "post-data"
+	}
+	return "pre-data"
+}
+
+// countTocEntries returns the number of entries in the table of contents
+// of inputPath, or 0 when it cannot be listed.
+func (b BackupManager) countTocEntries(inputPath string) int {
+	entries, _ := b.listToc(inputPath)
+	return len(entries)
+}
+
+// writeTocList writes a pg_restore -L list for inputPath keeping only the
+// given entries. The caller removes the returned file.
+func (b BackupManager) writeTocList(inputPath string, ids []int) (string, error) {
+	list, err := b.pgCommand("pg_restore", "-l", inputPath).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list backup contents: %v", err)
+	}
+
+	selected := map[int]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	var out bytes.Buffer
+	found := 0
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		entry, ok := parseTocLine(scanner.Text())
+		if ok && selected[entry.ID] {
+			out.WriteString(scanner.Text() + "\n")
+			found++
+		}
+	}
+	if found != len(selected) {
+		return "", fmt.Errorf("%d of the selected entries are not part of the backup", len(selected)-found)
+	}
+
+	f, err := os.CreateTemp(LOCAL_BACKUP_DIR, ".restore-*.list")
+	if err != nil {
+		return "", fmt.Errorf("failed to write restore list: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(out.Bytes()); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write restore list: %w", err)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,181 @@
+package backup_manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"pg_bckup_mgr/db"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// TransferBackups copies catalogued backups to the target, or moves them
+// there when move is set. Every backup is transferred even when another one
+// fails; the transferred catalog entries are returned with the errors of
+// the failed ones.
+func TransferBackups(conn *gorm.DB, backupIDs []uint, target CopyTarget, move bool, job *Job) ([]db.Backup, error) {
+	if err := ValidateCopyTargets(conn, []CopyTarget{target}); err != nil {
+		return nil, err
+	}
+
+	var backups []db.Backup
+	var errs []error
+	for _, backupID := range backupIDs {
+		backup, err := TransferBackup(conn, backupID, target, move, job)
+		if err != nil {
+			log.Printf("Unable to transfer backup %d to %s: %v", backupID, target, err)
+			job.Logf("Transfer of backup %d failed: %v", backupID, err)
+			errs = append(errs, err)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	return backups, errors.Join(errs...)
+}
+
+// TransferBackup copies a backup from the destination it is stored on to
+// the target and catalogs the new copy. A move deletes the backup from its
+// destination afterwards and makes the target its destination.
+func TransferBackup(conn *gorm.DB, backupID uint, target CopyTarget, move bool, job *Job) (db.Backup, error) {
+	backup, err := db.GetBackupRecordByID(conn, strconv.FormatUint(uint64(backupID), 10))
+	if err != nil {
+		return backup, err
+	}
+	if backup.Status != BackupStatusCompleted {
+		return backup, fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+
+	manager, err := managerForBackup(conn, backup)
+	if err != nil {
+		return backup, err
+	}
+	manager.Job = job
+	source := BackupDestination(backup.DestinationType)
+	if manager.isStoredOn(source, target) {
+		return backup, fmt.Errorf("backup %s is already stored on %s", backup.Filename, target)
+	}
+	// Restoring a chain fetches all its links from the same destination.
+	if move && (backup.ParentBackupID != nil || len(manager.backupDependents(&backup)) > 0) {
+		return backup, fmt.Errorf("backup %s is part of an incremental chain and can only be copied", backup.Filename)
+	}
+
+	var existing *db.BackupCopy
+	for i := range backup.Copies {
+		backupCopy := &backup.Copies[i]
+		if backupCopy.Status == BackupStatusCompleted && copyTargetOf(*backupCopy).String() == target.String() {
+			existing = backupCopy
+		}
+	}
+	if existing != nil && !move {
+		return backup, fmt.Errorf("backup %s already has a copy on %s", backup.Filename, target)
+	}
+
+	if existing == nil {
+		log.Printf("Transferring backup %s from %s to %s", backup.Filename, source, target)
+		job.Logf("Transferring backup %s to %s", backup.Filename, target)
+		if err := manager.transferFile(&backup, source, target); err != nil {
+			return backup, fmt.Errorf("transfer of backup %s failed: %w", backup.Filename, err)
+		}
+		existing = &db.BackupCopy{
+			BackupID:        backup.ID,
+			DestinationType: string(target.DestinationType),
+			DestinationID:   target.DestinationID,
+			Status:          BackupStatusCompleted,
+		}
+		if err := db.CreateBackupCopy(conn, existing); err != nil {
+			log.Printf("Unable to catalog copy of %s: %v", backup.Filename, err)
+		}
+		backup.Copies = append(backup.Copies, *existing)
+	}
+	if !move {
+		manager.publishMetadata(&backup)
+		return backup, nil
+	}
+
+	if err := manager.deleteBackupFile(source, backup.Filename); err != nil {
+		return backup, fmt.Errorf("backup %s was copied to %s, but not deleted from %s: %w", backup.Filename, target, source, err)
+	}
+
+	// The copy on the target becomes the backup itself.
+	movedID := existing.ID
+	if movedID != 0 {
+		if err := db.DeleteBackupCopy(conn, movedID); err != nil {
+			log.Printf("Unable to remove copy of %s from the catalog: %v", backup.Filename, err)
+		}
+	}
+	remaining := backup.Copies[:0]
+	for _, backupCopy := range backup.Copies {
+		if backupCopy.ID != movedID {
+			remaining = append(remaining, backupCopy)
+		}
+	}
+	backup.Copies = remaining
+	backup.DestinationType = string(target.DestinationType)
+	backup.DestinationID = target.DestinationID
+	if err := db.UpdateBackupRecord(conn, &backup); err != nil {
+		return backup, err
+	}
+	manager.publishMetadata(&backup)
+	return backup, nil
+}
+
+// transferFile stores the backup on the target. S3 objects are copied
+// server-side when the target is behind the same endpoint and can be read
+// with its credentials, and streamed between the buckets otherwise.
+func (b BackupManager) transferFile(record *db.Backup, source BackupDestination, target CopyTarget) error {
+	if source == BackupS3Bucket && target.DestinationType == BackupS3Bucket {
+		sourceClient, err := b.newS3Client()
+		if err != nil {
+			return fmt.Errorf("S3 client creation failed: %v", err)
+		}
+		targetManager, err := b.copyManager(target)
+		if err != nil {
+			return err
+		}
+		targetClient, err := targetManager.newS3Client()
+		if err != nil {
+			return fmt.Errorf("S3 client creation failed: %v", err)
+		}
+
+		if sourceClient.EndpointURL == targetClient.EndpointURL && sourceClient.AccessKeyID == targetClient.AccessKeyID &&
+			record.SizeBytes <= MAX_SERVER_SIDE_COPY_SIZE {
+			b.Job.Logf("Copying server-side from bucket %s to bucket %s", sourceClient.BucketName, targetClient.BucketName)
+			return targetClient.CopyObject(sourceClient.BucketName, record.Filename)
+		}
+
+		targetClient.Progress = b.Job.StartPhase("copy to "+targetManager.BackupDestination.Name, "bytes")
+		checksum, err := targetClient.CopyFrom(sourceClient, record.Filename, record.Checksum)
+		if err != nil {
+			return err
+		}
+		b.recordChecksum(record, checksum)
+		return nil
+	}
+
+	backupPath, cleanup, err := b.fetchStoredFile(source, record.Filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	checksum := record.Checksum
+	if checksum == "" {
+		if checksum, err = fileChecksum(backupPath); err != nil {
+			return err
+		}
+		b.recordChecksum(record, checksum)
+	}
+	return b.storeCopy(target, backupPath, checksum)
+}
+
+// recordChecksum stores the checksum of a backup catalogued without one.
+func (b BackupManager) recordChecksum(record *db.Backup, checksum string) {
+	if record.Checksum != "" {
+		return
+	}
+	record.Checksum = checksum
+	if err := db.UpdateBackupRecord(b.Catalog, record); err != nil {
+		log.Printf("Unable to update catalog entry for backup %s: %v", record.Filename, err)
+	}
+}
@@ -0,0 +1,169 @@
+package backup_manager
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"pg_bckup_mgr/db"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ValidationPassed = "passed"
+	ValidationFailed = "failed"
+)
+
+// Markers pg_dump and pg_dumpall end their plain SQL output with. A file
+// without one was cut short.
+const (
+	dumpCompleteMarker    = "-- PostgreSQL database dump complete"
+	clusterCompleteMarker = "-- PostgreSQL database cluster dump complete"
+)
+
+// validateDump checks that a logical or globals backup is structurally
+// sound and counts the objects in it by type: archives have to be listed by
+// pg_restore, plain SQL has to end with pg_dump's completion marker.
+func (b BackupManager) validateDump(backupPath string, backupType BackupType, opts BackupOptions) (map[string]int, error) {
+	if backupType == BackupGlobals {
+		return scanPlainDump(backupPath, false, clusterCompleteMarker)
+	}
+	if opts.Format == DumpPlain {
+		return scanPlainDump(backupPath, opts.Compression == "gzip", dumpCompleteMarker)
+	}
+
+	inputPath, cleanup, err := dumpInput(backupPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	entries, err := b.listToc(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Type]++
+	}
+	return counts, nil
+}
+
+// scanPlainDump reads a plain SQL dump to its end, counting the objects
+// named in the "-- Name: ...; Type: ...;" comments pg_dump writes before
+// each of them and the roles of a globals dump.
+func scanPlainDump(path string, gzipped bool, marker string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var input io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compressed dump: %w", err)
+		}
+		defer gz.Close()
+		input = gz
+	}
+
+	counts := make(map[string]int)
+	complete := false
+	reader := bufio.NewReaderSize(input, 1<<20)
+	for {
+		line, err := reader.ReadString('\n')
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			// Only comment dashes and the \unrestrict meta-command of newer
+			// releases may follow the marker.
+			if trimmed == marker {
+				complete = true
+			} else if trimmed != "--" && !strings.HasPrefix(trimmed, `\unrestrict `) {
+				complete = false
+			}
+			if strings.HasPrefix(trimmed, "-- Name: ") {
+				if _, rest, ok := strings.Cut(trimmed, "; Type: "); ok {
+					objectType, _, _ := strings.Cut(rest, ";")
+					counts[objectType]++
+				}
+			} else if strings.HasPrefix(trimmed, "CREATE ROLE ") {
+				counts["ROLE"]++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dump: %w", err)
+		}
+	}
+
+	if !complete {
+		return counts, fmt.Errorf("dump is incomplete, it does not end with %q", marker)
+	}
+	return counts, nil
+}
+
+// setValidation puts the outcome of validateDump on a catalog entry.
+func setValidation(record *db.Backup, counts map[string]int, validationErr error) {
+	if record == nil {
+		return
+	}
+
+	validatedAt := time.Now()
+	record.ValidatedAt = &validatedAt
+	record.Validation = ValidationPassed
+	record.ValidationError = ""
+	if validationErr != nil {
+		record.Validation = ValidationFailed
+		record.ValidationError = validationErr.Error()
+	}
+	record.ObjectCounts = ""
+	if len(counts) > 0 {
+		if data, err := json.Marshal(counts); err == nil {
+			record.ObjectCounts = string(data)
+		}
+	}
+}
+
+// ValidateBackup fetches a stored backup and validates it again.
+func ValidateBackup(conn *gorm.DB, backupID string) (db.Backup, error) {
+	backup, err := db.GetBackupRecordByID(conn, backupID)
+	if err != nil {
+		return backup, err
+	}
+	if backup.Status != BackupStatusCompleted {
+		return backup, fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+	backupType := BackupType(backup.BackupType)
+	if backupType != BackupLogical && backupType != BackupGlobals {
+		return backup, fmt.Errorf("only logical and globals backups can be validated, %s is %s", backup.Filename, backup.BackupType)
+	}
+
+	manager, err := managerForBackup(conn, backup)
+	if err != nil {
+		return backup, err
+	}
+	backupPath, cleanup, err := manager.fetchBackupFile(BackupDestination(backup.DestinationType), backup.Filename)
+	if err != nil {
+		return backup, err
+	}
+	defer cleanup()
+
+	counts, validationErr := manager.validateDump(backupPath, backupType, dumpOptionsOf(&backup, backup.Filename))
+	setValidation(&backup, counts, validationErr)
+	if err := db.UpdateBackupRecord(conn, &backup); err != nil {
+		log.Printf("Unable to update catalog entry for backup %s: %v", backup.Filename, err)
+	}
+	if validationErr != nil {
+		return backup, fmt.Errorf("backup %s failed validation: %w", backup.Filename, validationErr)
+	}
+	return backup, nil
+}
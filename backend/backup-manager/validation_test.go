@@ -0,0 +1,108 @@
+package backup_manager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanPlainDump(t *testing.T) {
+	const header = "--\n-- PostgreSQL database dump\n--\n\n"
+	const body = "-- Name: accounts; Type: TABLE; Schema: public; Owner: app\n" +
+		"CREATE TABLE public.accounts (id integer);\n" +
+		"-- Name: accounts_pkey; Type: CONSTRAINT; Schema: public; Owner: app\n" +
+		"-- Name: orders; Type: TABLE; Schema: public; Owner: app\n"
+
+	tests := []struct {
+		name       string
+		dump       string
+		gzip       bool
+		marker     string
+		wantCounts map[string]int
+		wantErr    bool
+	}{
+		{
+			name:       "complete",
+			dump:       header + body + "--\n-- PostgreSQL database dump complete\n--\n\n",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{"TABLE": 2, "CONSTRAINT": 1},
+		},
+		{
+			name:       "complete, gzipped",
+			dump:       header + body + "-- PostgreSQL database dump complete\n",
+			gzip:       true,
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{"TABLE": 2, "CONSTRAINT": 1},
+		},
+		{
+			name:       "unrestrict after the marker",
+			dump:       header + body + "--\n-- PostgreSQL database dump complete\n--\n\n\\unrestrict abc123\n\n",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{"TABLE": 2, "CONSTRAINT": 1},
+		},
+		{
+			name:       "without a trailing newline",
+			dump:       header + "-- PostgreSQL database dump complete",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{},
+		},
+		{
+			name:       "cut short",
+			dump:       header + body + "COPY public.accounts (id) FROM stdin;\n1\n",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{"TABLE": 2, "CONSTRAINT": 1},
+			wantErr:    true,
+		},
+		{
+			name:       "statements after the marker",
+			dump:       header + "-- PostgreSQL database dump complete\nDROP TABLE public.accounts;\n",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{},
+			wantErr:    true,
+		},
+		{
+			name:       "database marker in a globals dump",
+			dump:       "-- PostgreSQL database cluster dump\n-- PostgreSQL database dump complete\n",
+			marker:     clusterCompleteMarker,
+			wantCounts: map[string]int{},
+			wantErr:    true,
+		},
+		{
+			name: "globals",
+			dump: "--\n-- PostgreSQL database cluster dump\n--\n\n" +
+				"CREATE ROLE app;\nALTER ROLE app WITH LOGIN;\nCREATE ROLE reporting;\n" +
+				"--\n-- PostgreSQL database cluster dump complete\n--\n\n",
+			marker:     clusterCompleteMarker,
+			wantCounts: map[string]int{"ROLE": 2},
+		},
+		{
+			name:       "empty",
+			dump:       "",
+			marker:     dumpCompleteMarker,
+			wantCounts: map[string]int{},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.dump)
+			if tt.gzip {
+				data = gzipped(t, tt.dump)
+			}
+			counts, err := scanPlainDump(writeTestFile(t, "dump.sql", data), tt.gzip, tt.marker)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scanPlainDump() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(counts, tt.wantCounts) {
+				t.Errorf("scanPlainDump() counts = %v, want %v", counts, tt.wantCounts)
+			}
+		})
+	}
+
+	t.Run("not gzipped", func(t *testing.T) {
+		path := writeTestFile(t, "dump.sql.gz", []byte(header))
+		if _, err := scanPlainDump(path, true, dumpCompleteMarker); err == nil {
+			t.Error("scanPlainDump() succeeded on a plain file read as gzip")
+		}
+	})
+}
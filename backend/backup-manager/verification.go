@@ -0,0 +1,320 @@
+package backup_manager
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"pg_bckup_mgr/db"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	VerificationRunning = "running"
+	VerificationPassed  = "passed"
+	VerificationFailed  = "failed"
+)
+
+// TableStats is what a database looked like in the snapshot a dump was taken
+// from, to compare a test restore against.
+type TableStats struct {
+	Tables int              `json:"tables"`
+	Rows   map[string]int64 `json:"rows,omitempty"`
+}
+
+type VerificationCheck struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+const userTablesQuery = `
+SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname) AS name, c.relkind::text AS kind
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p')
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+  AND n.nspname NOT LIKE 'pg_temp%'
+ORDER BY 1`
+
+// collectTableStats counts the user tables of the database and, with
+// withRows, the rows of each of them.
+func collectTableStats(conn *gorm.DB, withRows bool) (TableStats, error) {
+	var tables []struct {
+		Name string
+		Kind string
+	}
+	if err := conn.Raw(userTablesQuery).Scan(&tables).Error; err != nil {
+		return TableStats{}, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	stats := TableStats{Tables: len(tables)}
+	if !withRows {
+		return stats, nil
+	}
+
+	stats.Rows = map[string]int64{}
+	for _, table := range tables {
+		// Partitioned tables hold no rows themselves; their partitions
+		// are counted on their own.
+		if table.Kind == "p" {
+			continue
+		}
+		var count int64
+		if err := conn.Raw("SELECT count(*) FROM " + table.Name).Scan(&count).Error; err != nil {
+			return TableStats{}, fmt.Errorf("failed to count rows of %s: %w", table.Name, err)
+		}
+		stats.Rows[table.Name] = count
+	}
+	return stats, nil
+}
+
+// exportDumpSnapshot opens a read-only transaction on the source database,
+// exports its snapshot for pg_dump --snapshot and collects table statistics
+// in it, so they match the dump exactly. release ends the transaction and
+// has to be called once pg_dump finished. Backups of a subset of the
+// database get no statistics.
+func (b BackupManager) exportDumpSnapshot(opts BackupOptions) (string, *TableStats, func()) {
+	if opts.selective() {
+		return "", nil, func() {}
+	}
+
+	conn, err := b.Connect()
+	if err != nil {
+		log.Printf("Unable to connect for dump statistics: %v", err)
+		return "", nil, func() {}
+	}
+	sqlDB, _ := conn.DB()
+
+	tx := conn.Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	release := func() {
+		tx.Rollback()
+		sqlDB.Close()
+	}
+
+	var snapshot string
+	if err := tx.Raw("SELECT pg_export_snapshot()").Scan(&snapshot).Error; err != nil {
+		log.Printf("Unable to export snapshot for dump statistics: %v", err)
+		release()
+		return "", nil, func() {}
+	}
+
+	stats, err := collectTableStats(tx, opts.RecordRowCounts)
+	if err != nil {
+		log.Printf("Unable to collect dump statistics: %v", err)
+		return snapshot, nil, release
+	}
+	return snapshot, &stats, release
+}
+
+// VerifyBackup test-restores a completed logical backup into a scratch
+// database on the sandbox connection, checks it against the statistics
+// captured at dump time and the given SQL assertions (each must return a
+// single true value), then drops the scratch database.
+func VerifyBackup(conn *gorm.DB, backupID string, sandboxID string, assertions []string) (db.BackupVerification, error) {
+	var verification db.BackupVerification
+
+	backup, err := db.GetBackupRecordByID(conn, backupID)
+	if err != nil {
+		return verification, err
+	}
+	if backup.Status != BackupStatusCompleted {
+		return verification, fmt.Errorf("backup %s is %s", backup.Filename, backup.Status)
+	}
+	if backup.BackupType != string(BackupLogical) {
+		return verification, fmt.Errorf("only logical backups can be verified, %s is %s", backup.Filename, backup.BackupType)
+	}
+
+	source, err := db.GetCredentialsById(conn, strconv.FormatUint(uint64(backup.ConnectionID), 10))
+	if err != nil {
+		return verification, err
+	}
+	sandbox, err := db.GetCredentialsById(conn, sandboxID)
+	if err != nil {
+		return verification, err
+	}
+
+	manager := BackupManager{
+		Host:         source.PostgresHost,
+		Port:         source.PostgresPort,
+		DBName:       source.PostgresDBName,
+		User:         source.PostgresUser,
+		Password:     source.PostgresPassword,
+		Catalog:      conn,
+		ConnectionID: source.ID,
+	}
+	if backup.DestinationID != nil {
+		dest, err := db.GetBackupDestinationByID(conn, strconv.FormatUint(uint64(*backup.DestinationID), 10))
+		if err != nil {
+			return verification, err
+		}
+		manager.BackupDestination = &dest
+	}
+
+	verification = db.BackupVerification{
+		BackupID:            backup.ID,
+		SandboxConnectionID: sandbox.ID,
+		ScratchDatabase:     fmt.Sprintf("pgbm_verify_%d_%d", backup.ID, time.Now().Unix()),
+		Status:              VerificationRunning,
+		StartedAt:           time.Now(),
+	}
+	if err := db.CreateBackupVerification(conn, &verification); err != nil {
+		return verification, err
+	}
+
+	plain := dumpOptionsOf(&backup, backup.Filename).Format == DumpPlain
+	restoreOpts := RestoreOptions{
+		Target:         &sandbox,
+		TargetDBName:   verification.ScratchDatabase,
+		CreateDatabase: true,
+		NoOwner:        !plain,
+		NoPrivileges:   !plain,
+		// The scratch database is created by the restore and dropped after.
+		SkipSafetyBackup: true,
+		skipHooks:        true,
+	}
+	scratch := manager.restoreTarget(restoreOpts)
+
+	log.Printf("Verifying backup %s in scratch database %s", backup.Filename, verification.ScratchDatabase)
+	_, err = manager.RestoreFromBackup(BackupDestination(backup.DestinationType), backup.Filename, restoreOpts)
+	verification.RestoreSeconds = time.Since(verification.StartedAt).Seconds()
+
+	var checks []VerificationCheck
+	if err == nil {
+		checks, err = scratch.runVerificationChecks(backup, assertions)
+	}
+
+	dropper := scratch
+	dropper.DBName = sandbox.PostgresDBName
+	if dropErr := dropper.dropDatabase(verification.ScratchDatabase); dropErr != nil {
+		log.Printf("Unable to drop scratch database %s: %v", verification.ScratchDatabase, dropErr)
+	}
+
+	verification.Status = VerificationPassed
+	if err != nil {
+		verification.Status = VerificationFailed
+		verification.Error = err.Error()
+	}
+	for _, check := range checks {
+		if !check.Passed {
+			verification.Status = VerificationFailed
+		}
+	}
+	if data, err := json.Marshal(checks); err == nil {
+		verification.Checks = string(data)
+	}
+	finishedAt := time.Now()
+	verification.FinishedAt = &finishedAt
+	if err := db.UpdateBackupVerification(conn, &verification); err != nil {
+		log.Printf("Unable to record verification of backup %s: %v", backup.Filename, err)
+	}
+
+	backup.Verification = verification.Status
+	backup.VerifiedAt = &finishedAt
+	if err := db.UpdateBackupRecord(conn, &backup); err != nil {
+		log.Printf("Unable to update catalog entry for backup %s: %v", backup.Filename, err)
+	}
+
+	log.Printf("Verification of backup %s %s in %.1fs", backup.Filename, verification.Status, verification.RestoreSeconds)
+	return verification, nil
+}
+
+// VerifyLatestBackup verifies the most recent completed backup of a schedule.
+func VerifyLatestBackup(conn *gorm.DB, scheduleID string, sandboxID string, assertions []string) (db.BackupVerification, error) {
+	var backup db.Backup
+	err := conn.Where("schedule_id = ? AND status = ? AND backup_type = ?", scheduleID, BackupStatusCompleted, string(BackupLogical)).
+		Order("id DESC").First(&backup).Error
+	if err != nil {
+		return db.BackupVerification{}, fmt.Errorf("no completed logical backup found for schedule %s", scheduleID)
+	}
+	return VerifyBackup(conn, strconv.FormatUint(uint64(backup.ID), 10), sandboxID, assertions)
+}
+
+func (b BackupManager) runVerificationChecks(backup db.Backup, assertions []string) ([]VerificationCheck, error) {
+	conn, err := b.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	var expected *TableStats
+	if backup.TableStats != "" {
+		var stats TableStats
+		if err := json.Unmarshal([]byte(backup.TableStats), &stats); err == nil {
+			expected = &stats
+		}
+	}
+
+	actual, err := collectTableStats(conn, expected != nil && len(expected.Rows) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []VerificationCheck{}
+	if expected != nil {
+		checks = append(checks, VerificationCheck{
+			Name:     "table count",
+			Passed:   actual.Tables == expected.Tables,
+			Expected: strconv.Itoa(expected.Tables),
+			Actual:   strconv.Itoa(actual.Tables),
+		})
+		tables := make([]string, 0, len(expected.Rows))
+		for table := range expected.Rows {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			rows := expected.Rows[table]
+			restored, ok := actual.Rows[table]
+			check := VerificationCheck{
+				Name:     "row count " + table,
+				Passed:   ok && restored == rows,
+				Expected: strconv.FormatInt(rows, 10),
+			}
+			if ok {
+				check.Actual = strconv.FormatInt(restored, 10)
+			}
+			checks = append(checks, check)
+		}
+	} else {
+		checks = append(checks, VerificationCheck{
+			Name:   "table count",
+			Passed: actual.Tables > 0,
+			Actual: strconv.Itoa(actual.Tables),
+		})
+	}
+
+	for _, assertion := range assertions {
+		check := VerificationCheck{Name: assertion, Expected: "true"}
+		var result bool
+		if err := conn.Raw(assertion).Row().Scan(&result); err != nil {
+			check.Actual = err.Error()
+		} else {
+			check.Passed = result
+			check.Actual = strconv.FormatBool(result)
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+func (b BackupManager) dropDatabase(name string) error {
+	conn, err := b.Connect()
+	if err != nil {
+		return fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	// Sessions left on the database, e.g. on one replaced by a staged
+	// restore, would make a plain DROP fail.
+	return conn.Exec("DROP DATABASE IF EXISTS " + quoteIdentifier(name) + " WITH (FORCE)").Error
+}
@@ -0,0 +1,464 @@
+package backup_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"pg_bckup_mgr/db"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	WalStreamStatusStreaming = "streaming"
+	WalStreamStatusStopped   = "stopped"
+	WalStreamStatusFailed    = "failed"
+)
+
+const (
+	walShipInterval    = 10 * time.Second
+	walRestartDelay    = 10 * time.Second
+	walSlotDropTries   = 5
+	defaultSegmentSize = 16 * 1024 * 1024
+)
+
+var walSegmentName = regexp.MustCompile(`^[0-9A-F]{24}$`)
+var walHistoryName = regexp.MustCompile(`^[0-9A-F]{8}\.history$`)
+
+type walStreamer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var walStreamers = map[uint]*walStreamer{}
+var walStreamersMu sync.Mutex
+
+func CreateWalStream(conn *gorm.DB, connectionId string, destinationId string, slotName string) (db.WalStream, error) {
+	creds, err := db.GetCredentialsById(conn, connectionId)
+	if err != nil {
+		log.Printf("Error getting credentials: %v", err)
+		return db.WalStream{}, err
+	}
+
+	stream := db.WalStream{
+		ConnectionID: creds.ID,
+		SlotName:     slotName,
+		Enabled:      true,
+		Status:       WalStreamStatusStopped,
+	}
+	if stream.SlotName == "" {
+		stream.SlotName = fmt.Sprintf("pg_bckup_mgr_%d", creds.ID)
+	}
+
+	if destinationId != "" && destinationId != string(BackupFilesystem) {
+		dest, err := db.GetBackupDestinationByID(conn, destinationId)
+		if err != nil {
+			log.Printf("Error getting destination: %v", err)
+			return db.WalStream{}, err
+		}
+		stream.DestinationID = &dest.ID
+	}
+
+	if err := db.CreateWalStream(conn, &stream); err != nil {
+		log.Printf("Error creating WAL stream: %v", err)
+		return db.WalStream{}, err
+	}
+
+	log.Printf("Created WAL stream %d for connection %d using slot %s", stream.ID, stream.ConnectionID, stream.SlotName)
+	return stream, nil
+}
+
+// StartWalStreams starts streaming for every enabled WAL stream.
+func StartWalStreams(conn *gorm.DB) {
+	var streams []db.WalStream
+	if err := conn.Where("enabled = ?", true).Find(&streams).Error; err != nil {
+		log.Printf("Error loading WAL streams: %v", err)
+		return
+	}
+
+	for _, stream := range streams {
+		if err := StartWalStream(conn, stream.ID); err != nil {
+			log.Printf("Failed to start WAL stream %d: %v", stream.ID, err)
+		}
+	}
+}
+
+func StartWalStream(conn *gorm.DB, streamID uint) error {
+	walStreamersMu.Lock()
+	defer walStreamersMu.Unlock()
+
+	if _, running := walStreamers[streamID]; running {
+		return nil
+	}
+
+	stream, err := db.GetWalStreamByID(conn, strconv.FormatUint(uint64(streamID), 10))
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Model(&db.WalStream{}).Where("id = ?", streamID).Update("enabled", true).Error; err != nil {
+		return fmt.Errorf("failed to enable WAL stream %d: %w", streamID, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &walStreamer{cancel: cancel, done: make(chan struct{})}
+	walStreamers[streamID] = w
+
+	go w.run(ctx, conn, stream)
+
+	log.Printf("Started WAL stream %d for connection %d", stream.ID, stream.ConnectionID)
+	return nil
+}
+
+func StopWalStream(conn *gorm.DB, streamID uint) error {
+	walStreamersMu.Lock()
+	w, running := walStreamers[streamID]
+	delete(walStreamers, streamID)
+	walStreamersMu.Unlock()
+
+	if running {
+		w.cancel()
+		<-w.done
+	}
+
+	return conn.Model(&db.WalStream{}).Where("id = ?", streamID).Updates(map[string]interface{}{
+		"enabled": false,
+		"status":  WalStreamStatusStopped,
+	}).Error
+}
+
+// DeleteWalStream stops the stream and drops its replication slot, which
+// would otherwise keep all WAL on the server until its disk fills up. The
+// stream is deleted even when the slot cannot be dropped; the returned
+// warning then says that the slot was left behind.
+func DeleteWalStream(conn *gorm.DB, streamID uint) (string, error) {
+	stream, err := db.GetWalStreamByID(conn, strconv.FormatUint(uint64(streamID), 10))
+	if err != nil {
+		return "", err
+	}
+	if err := StopWalStream(conn, streamID); err != nil {
+		return "", err
+	}
+
+	var warning string
+	if err := walManagerFor(conn, stream).dropReplicationSlot(stream.SlotName); err != nil {
+		log.Printf("Unable to drop replication slot %s of WAL stream %d: %v", stream.SlotName, streamID, err)
+		warning = fmt.Sprintf("replication slot %s was left behind on %s and keeps WAL on the server until it is dropped with pg_drop_replication_slot: %v",
+			stream.SlotName, stream.Connection.PostgresHost, err)
+	}
+	if err := db.DeleteWalStreamByID(conn, strconv.FormatUint(uint64(streamID), 10)); err != nil {
+		return warning, err
+	}
+	log.Printf("Deleted WAL stream %d", streamID)
+	return warning, nil
+}
+
+// dropReplicationSlot drops the slot if it exists. The walsender of a
+// pg_receivewal that was just stopped may hold it for a moment longer.
+func (b BackupManager) dropReplicationSlot(slotName string) error {
+	conn, err := b.Connect()
+	if err != nil {
+		return fmt.Errorf("database connection failed: %v", err)
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	for try := 1; ; try++ {
+		err = conn.Exec("SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = ?", slotName).Error
+		if err == nil || try == walSlotDropTries {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func walManagerFor(conn *gorm.DB, stream db.WalStream) BackupManager {
+	return BackupManager{
+		Host:              stream.Connection.PostgresHost,
+		Port:              stream.Connection.PostgresPort,
+		DBName:            stream.Connection.PostgresDBName,
+		User:              stream.Connection.PostgresUser,
+		Password:          stream.Connection.PostgresPassword,
+		BackupDestination: stream.Destination,
+		Catalog:           conn,
+		ConnectionID:      stream.ConnectionID,
+	}
+}
+
+func (b BackupManager) walSpoolDir() string {
+	return filepath.Join(LOCAL_BACKUP_DIR, ".wal-spool", b.backupDirName())
+}
+
+func (b BackupManager) walArchiveDir() string {
+	return filepath.Join(LOCAL_BACKUP_DIR, WAL_ARCHIVE_PREFIX, b.backupDirName())
+}
+
+func (b BackupManager) walArchiveKey(name string) string {
+	return WAL_ARCHIVE_PREFIX + b.backupDirName() + "/" + name
+}
+
+func (w *walStreamer) run(ctx context.Context, conn *gorm.DB, stream db.WalStream) {
+	defer close(w.done)
+	// A streamer that gave up is not running anymore, so StartWalStream
+	// has to be able to start it again.
+	defer func() {
+		walStreamersMu.Lock()
+		if walStreamers[stream.ID] == w {
+			delete(walStreamers, stream.ID)
+		}
+		walStreamersMu.Unlock()
+	}()
+
+	b := walManagerFor(conn, stream)
+	spool := b.walSpoolDir()
+	if err := os.MkdirAll(spool, 0700); err != nil {
+		setWalStreamStatus(conn, stream.ID, WalStreamStatusFailed, err)
+		return
+	}
+
+	if stream.SegmentSize == 0 {
+		stream.SegmentSize = b.walSegmentSize()
+		conn.Model(&db.WalStream{}).Where("id = ?", stream.ID).Update("segment_size", stream.SegmentSize)
+	}
+
+	connArgs := []string{"-h", b.Host, "-p", b.Port, "-U", b.User, "-w", "-S", stream.SlotName}
+	createSlot := b.pgCommandContext(ctx, "pg_receivewal", append(connArgs, "--create-slot", "--if-not-exists")...)
+	if output, err := createSlot.CombinedOutput(); err != nil {
+		log.Printf("Unable to create replication slot %s: %v: %s", stream.SlotName, err, output)
+	}
+
+	shipperDone := make(chan struct{})
+	go func() {
+		defer close(shipperDone)
+		shipped := map[string]time.Time{}
+		ticker := time.NewTicker(walShipInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				b.shipWalSegments(conn, &stream, spool, shipped)
+				return
+			case <-ticker.C:
+				if err := b.shipWalSegments(conn, &stream, spool, shipped); err != nil {
+					log.Printf("Error shipping WAL for stream %d: %v", stream.ID, err)
+				}
+			}
+		}
+	}()
+
+	for {
+		setWalStreamStatus(conn, stream.ID, WalStreamStatusStreaming, nil)
+		cmd := b.pgCommandContext(ctx, "pg_receivewal", append(connArgs, "-D", spool, "-n")...)
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			err = errors.New("pg_receivewal exited")
+		}
+		log.Printf("pg_receivewal for stream %d stopped: %v: %s", stream.ID, err, output)
+		setWalStreamStatus(conn, stream.ID, WalStreamStatusFailed, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output))))
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(walRestartDelay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	<-shipperDone
+	setWalStreamStatus(conn, stream.ID, WalStreamStatusStopped, nil)
+	log.Printf("WAL stream %d stopped", stream.ID)
+}
+
+func setWalStreamStatus(conn *gorm.DB, streamID uint, status string, streamErr error) {
+	updates := map[string]interface{}{
+		"status": status,
+		"error":  "",
+	}
+	if streamErr != nil {
+		updates["error"] = streamErr.Error()
+	}
+	if err := conn.Model(&db.WalStream{}).Where("id = ?", streamID).Updates(updates).Error; err != nil {
+		log.Printf("Error updating WAL stream %d status: %v", streamID, err)
+	}
+}
+
+func (b BackupManager) walSegmentSize() int64 {
+	conn, err := b.Connect()
+	if err != nil {
+		return defaultSegmentSize
+	}
+	sqlDB, _ := conn.DB()
+	defer sqlDB.Close()
+
+	var size int64
+	if err := conn.Raw("SELECT setting::bigint * (CASE unit WHEN 'B' THEN 1 WHEN 'kB' THEN 1024 WHEN 'MB' THEN 1024*1024 ELSE 1 END) FROM pg_settings WHERE name = 'wal_segment_size'").Scan(&size).Error; err != nil || size == 0 {
+		return defaultSegmentSize
+	}
+	return size
+}
+
+// shipWalSegments archives finished segments and history files from the
+// spool directory, and refreshes the copy of the segment currently being
+// written so that the archive lags the server by at most walShipInterval.
+func (b BackupManager) shipWalSegments(conn *gorm.DB, stream *db.WalStream, spool string, shipped map[string]time.Time) error {
+	entries, err := os.ReadDir(spool)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		complete := walSegmentName.MatchString(name)
+		partial := strings.HasSuffix(name, ".partial") && walSegmentName.MatchString(strings.TrimSuffix(name, ".partial"))
+		history := walHistoryName.MatchString(name)
+		if !complete && !partial && !history {
+			continue
+		}
+		if last, ok := shipped[name]; ok && !info.ModTime().After(last) {
+			continue
+		}
+
+		path := filepath.Join(spool, name)
+		if err := b.archiveWalFile(path, name); err != nil {
+			return err
+		}
+		shipped[name] = info.ModTime()
+
+		segment := db.WalSegment{
+			WalStreamID:   stream.ID,
+			ConnectionID:  stream.ConnectionID,
+			DestinationID: stream.DestinationID,
+			Name:          name,
+			Partial:       partial,
+			History:       history,
+			SizeBytes:     info.Size(),
+			ArchivedAt:    time.Now(),
+		}
+		timeline, _ := strconv.ParseUint(name[:8], 16, 32)
+		segment.Timeline = uint(timeline)
+		if !history {
+			segment.StartLSN = formatLSN(walSegmentStartLSN(name[:24], uint64(stream.SegmentSize)))
+		}
+
+		var existing db.WalSegment
+		if conn.Where("wal_stream_id = ? AND name = ?", stream.ID, name).First(&existing).Error == nil {
+			segment.ID = existing.ID
+			segment.CreatedAt = existing.CreatedAt
+		}
+		if err := conn.Save(&segment).Error; err != nil {
+			return fmt.Errorf("failed to record WAL segment %s: %w", name, err)
+		}
+
+		if complete {
+			// The finished segment supersedes any partial copy shipped earlier.
+			b.removeArchivedWalFile(name + ".partial")
+			conn.Where("wal_stream_id = ? AND name = ?", stream.ID, name+".partial").Delete(&db.WalSegment{})
+			delete(shipped, name+".partial")
+			delete(shipped, name)
+			os.Remove(path)
+		}
+
+		if !history {
+			now := time.Now()
+			stream.Timeline = segment.Timeline
+			conn.Model(&db.WalStream{}).Where("id = ?", stream.ID).Updates(map[string]interface{}{
+				"timeline":         segment.Timeline,
+				"last_segment":     name,
+				"last_archived_at": &now,
+			})
+		}
+	}
+
+	return nil
+}
+
+func (b BackupManager) archiveWalFile(path, name string) error {
+	if b.BackupDestination == nil {
+		dir := b.walArchiveDir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		return copyFile(path, filepath.Join(dir, name))
+	}
+
+	S3Client, err := b.newS3Client()
+	if err != nil {
+		return fmt.Errorf("S3 client creation failed: %v", err)
+	}
+	return S3Client.UploadFileWithKey(path, b.walArchiveKey(name))
+}
+
+func (b BackupManager) removeArchivedWalFile(name string) {
+	if b.BackupDestination == nil {
+		os.Remove(filepath.Join(b.walArchiveDir(), name))
+		return
+	}
+
+	S3Client, err := b.newS3Client()
+	if err != nil {
+		return
+	}
+	S3Client.DeleteFile(b.walArchiveKey(name))
+}
+
+func (b BackupManager) fetchArchivedWalFile(name, localPath string) error {
+	if b.BackupDestination == nil {
+		return copyFile(filepath.Join(b.walArchiveDir(), name), localPath)
+	}
+
+	S3Client, err := b.newS3Client()
+	if err != nil {
+		return fmt.Errorf("S3 client creation failed: %v", err)
+	}
+	return S3Client.DownloadFile(b.walArchiveKey(name), localPath)
+}
+
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.Split(lsn, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid LSN: %s", lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", lsn)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", lsn)
+	}
+	return hi<<32 | lo, nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, lsn&0xFFFFFFFF)
+}
+
+// walSegmentStartLSN returns the first LSN stored in the named segment.
+func walSegmentStartLSN(name string, segmentSize uint64) uint64 {
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
+	xlogID, _ := strconv.ParseUint(name[8:16], 16, 32)
+	seg, _ := strconv.ParseUint(name[16:24], 16, 32)
+	segmentsPerXLogID := uint64(0x100000000) / segmentSize
+	return (xlogID*segmentsPerXLogID + seg) * segmentSize
+}
@@ -2,6 +2,9 @@ package db
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
 	"pg_bckup_mgr/auth"
 
@@ -9,31 +12,56 @@ import (
 	"gorm.io/gorm"
 )
 
-func TestConnection(conn Connection) bool {
+// CONNECT_TIMEOUT_SECONDS bounds how long probing a connection's server
+// waits for it to answer.
+const CONNECT_TIMEOUT_SECONDS = 10
+
+// TestConnection checks that the connection's server is reachable and
+// records its version on conn.
+func TestConnection(conn *Connection) bool {
+	return ProbeConnection(conn) == nil
+}
+
+// ProbeConnection is TestConnection returning why the server could not be
+// reached.
+func ProbeConnection(conn *Connection) error {
+	version, err := ServerVersion(*conn)
+	if err != nil {
+		return err
+	}
+	conn.ServerVersion = version
+	return nil
+}
+
+// ServerVersion returns the server_version_num of the connection's server,
+// e.g. 170002 for PostgreSQL 17.2.
+func ServerVersion(conn Connection) (int, error) {
 	decryptedPassword, _ := auth.DecryptString(conn.PostgresPassword)
-	dsn := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s",
-		conn.PostgresUser,
-		decryptedPassword,
-		conn.PostgresHost,
-		conn.PostgresPort,
-		conn.PostgresDBName)
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	dsn := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(conn.PostgresUser, decryptedPassword),
+		Host:     net.JoinHostPort(conn.PostgresHost, conn.PostgresPort),
+		Path:     "/" + conn.PostgresDBName,
+		RawQuery: fmt.Sprintf("connect_timeout=%d", CONNECT_TIMEOUT_SECONDS),
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn.String()), &gorm.Config{})
 	if err != nil {
-		return false
+		return 0, err
 	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
-		return false
+		return 0, err
 	}
 	defer sqlDB.Close()
 
-	if err := sqlDB.Ping(); err != nil {
-		return false
+	var version int
+	if err := db.Raw("SHOW server_version_num").Scan(&version).Error; err != nil {
+		return 0, err
 	}
 
-	return true
+	return version, nil
 }
 
 func Connect() (*gorm.DB, error) {
@@ -47,11 +75,15 @@ func Connect() (*gorm.DB, error) {
 		return nil, err
 	}
 
-	err = conn.AutoMigrate(&Connection{})
+	err = conn.AutoMigrate(&Connection{}, &Destination{}, &BackupSchedule{}, &Backup{}, &WalStream{}, &WalSegment{}, &BackupVerification{}, &Restore{}, &Hook{}, &BackupCopy{}, &User{}, &AuditLog{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	if err := ensureAdmin(conn); err != nil {
+		return nil, err
+	}
+
 	return conn, nil
 }
 
@@ -103,6 +135,39 @@ func UpdateCredentials(conn *gorm.DB, obj Connection) error {
 	return nil
 }
 
+// UpdateServerVersion records the version of a server on every connection
+// pointing to it.
+func UpdateServerVersion(conn *gorm.DB, host, port string, version int) error {
+	result := conn.Model(&Connection{}).
+		Where("postgres_host = ? AND postgres_port = ? AND server_version IS DISTINCT FROM ?", host, port, version).
+		Update("server_version", version)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update server version: %w", result.Error)
+	}
+	return nil
+}
+
+// GetServerVersion returns the version last recorded for a server, or 0.
+func GetServerVersion(conn *gorm.DB, host, port string) (int, error) {
+	var version int
+	result := conn.Model(&Connection{}).
+		Where("postgres_host = ? AND postgres_port = ? AND server_version IS NOT NULL", host, port).
+		Order("updated_at DESC").Limit(1).Pluck("server_version", &version)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to get server version: %w", result.Error)
+	}
+	return version, nil
+}
+
+func ListAllBackupDestinations(conn *gorm.DB) ([]Destination, error) {
+	var destinations []Destination
+	result := conn.Find(&destinations)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list backup destinations: %w", result.Error)
+	}
+	return destinations, nil
+}
+
 func GetBackupDestinationByID(conn *gorm.DB, id string) (Destination, error) {
 	var destinations Destination
 	result := conn.First(&destinations, id)
@@ -123,6 +188,46 @@ func CreateUser(conn *gorm.DB, obj User) error {
 	return nil
 }
 
+// ensureAdmin makes the oldest user an admin when there is none, e.g. after
+// upgrading from a version without roles.
+func ensureAdmin(conn *gorm.DB) error {
+	admins, err := CountUsersWithRole(conn, RoleAdmin)
+	if err != nil || admins > 0 {
+		return err
+	}
+
+	var user User
+	result := conn.Order("id").Limit(1).Find(&user)
+	if result.Error != nil {
+		return fmt.Errorf("failed to find first user: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	log.Printf("No admin found, making user %s an admin", user.Username)
+	return UpdateUserRole(conn, user.Username, RoleAdmin)
+}
+
+func CountUsersWithRole(conn *gorm.DB, role string) (int64, error) {
+	var count int64
+	result := conn.Model(&User{}).Where("role = ?", role).Count(&count)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to count users: %w", result.Error)
+	}
+	return count, nil
+}
+
+func UpdateUserRole(conn *gorm.DB, username, role string) error {
+	result := conn.Model(&User{}).Where("username = ?", username).Update("role", role)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update user: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user with username %s not found", username)
+	}
+	return nil
+}
+
 func GetUserByName(conn *gorm.DB, username string) (User, error) {
 	var user User
 	result := conn.Where("username = ?", username).First(&user)
@@ -134,3 +239,292 @@ func GetUserByName(conn *gorm.DB, username string) (User, error) {
 	}
 	return user, nil
 }
+
+func CreateBackupRecord(conn *gorm.DB, obj *Backup) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create backup record: %w", result.Error)
+	}
+	return nil
+}
+
+func UpdateBackupRecord(conn *gorm.DB, obj *Backup) error {
+	result := conn.Omit("Copies").Save(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update backup record: %w", result.Error)
+	}
+	return nil
+}
+
+func GetBackupRecordByID(conn *gorm.DB, id string) (Backup, error) {
+	var backup Backup
+	result := conn.Preload("Copies").First(&backup, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return backup, fmt.Errorf("backup with id %s not found", id)
+		}
+		return backup, fmt.Errorf("failed to get backup: %w", result.Error)
+	}
+	return backup, nil
+}
+
+func GetBackupRecordByFilename(conn *gorm.DB, connectionID uint, filename string) (Backup, error) {
+	var backup Backup
+	result := conn.Where("connection_id = ? AND filename = ?", connectionID, filename).Order("id DESC").First(&backup)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return backup, fmt.Errorf("backup %s not found", filename)
+		}
+		return backup, fmt.Errorf("failed to get backup: %w", result.Error)
+	}
+	return backup, nil
+}
+
+func ListBackupRecords(conn *gorm.DB, filters map[string]interface{}) ([]Backup, error) {
+	var backups []Backup
+	query := conn.Model(&Backup{})
+	for key, value := range filters {
+		query = query.Where(fmt.Sprintf("%s = ?", key), value)
+	}
+	result := query.Preload("Copies").Order("started_at DESC").Find(&backups)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", result.Error)
+	}
+	return backups, nil
+}
+
+func CreateBackupCopy(conn *gorm.DB, obj *BackupCopy) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create backup copy: %w", result.Error)
+	}
+	return nil
+}
+
+func UpdateBackupCopy(conn *gorm.DB, obj *BackupCopy) error {
+	result := conn.Save(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update backup copy: %w", result.Error)
+	}
+	return nil
+}
+
+func DeleteBackupCopy(conn *gorm.DB, id uint) error {
+	result := conn.Delete(&BackupCopy{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete backup copy: %w", result.Error)
+	}
+	return nil
+}
+
+func ListBackupCopies(conn *gorm.DB, backupID uint) ([]BackupCopy, error) {
+	var copies []BackupCopy
+	result := conn.Where("backup_id = ?", backupID).Order("id").Find(&copies)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list backup copies: %w", result.Error)
+	}
+	return copies, nil
+}
+
+func CreateWalStream(conn *gorm.DB, obj *WalStream) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create WAL stream: %w", result.Error)
+	}
+	return nil
+}
+
+func GetWalStreamByID(conn *gorm.DB, id string) (WalStream, error) {
+	var stream WalStream
+	result := conn.Preload("Connection").Preload("Destination").First(&stream, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return stream, fmt.Errorf("WAL stream with id %s not found", id)
+		}
+		return stream, fmt.Errorf("failed to get WAL stream: %w", result.Error)
+	}
+	return stream, nil
+}
+
+func ListWalStreams(conn *gorm.DB) ([]WalStream, error) {
+	var streams []WalStream
+	result := conn.Preload("Connection").Preload("Destination").Find(&streams)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list WAL streams: %w", result.Error)
+	}
+	return streams, nil
+}
+
+func DeleteWalStreamByID(conn *gorm.DB, id string) error {
+	result := conn.Delete(&WalStream{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete WAL stream: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("WAL stream with id %s not found", id)
+	}
+	return nil
+}
+
+func CreateWalSegment(conn *gorm.DB, obj *WalSegment) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record WAL segment: %w", result.Error)
+	}
+	return nil
+}
+
+func ListWalSegments(conn *gorm.DB, connectionID uint) ([]WalSegment, error) {
+	var segments []WalSegment
+	result := conn.Where("connection_id = ?", connectionID).Order("timeline ASC, name ASC").Find(&segments)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", result.Error)
+	}
+	return segments, nil
+}
+
+func CreateBackupVerification(conn *gorm.DB, obj *BackupVerification) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create backup verification: %w", result.Error)
+	}
+	return nil
+}
+
+func UpdateBackupVerification(conn *gorm.DB, obj *BackupVerification) error {
+	result := conn.Save(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update backup verification: %w", result.Error)
+	}
+	return nil
+}
+
+func ListBackupVerifications(conn *gorm.DB, backupID uint) ([]BackupVerification, error) {
+	var verifications []BackupVerification
+	query := conn.Model(&BackupVerification{})
+	if backupID != 0 {
+		query = query.Where("backup_id = ?", backupID)
+	}
+	result := query.Order("started_at DESC").Find(&verifications)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list backup verifications: %w", result.Error)
+	}
+	return verifications, nil
+}
+
+func CreateRestoreRecord(conn *gorm.DB, obj *Restore) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create restore record: %w", result.Error)
+	}
+	return nil
+}
+
+func UpdateRestoreRecord(conn *gorm.DB, obj *Restore) error {
+	result := conn.Omit("SafetyBackup").Save(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update restore record: %w", result.Error)
+	}
+	return nil
+}
+
+func GetRestoreRecordByID(conn *gorm.DB, id string) (Restore, error) {
+	var restore Restore
+	result := conn.Preload("SafetyBackup").First(&restore, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return restore, fmt.Errorf("restore with id %s not found", id)
+		}
+		return restore, fmt.Errorf("failed to get restore: %w", result.Error)
+	}
+	return restore, nil
+}
+
+func ListRestoreRecords(conn *gorm.DB, filters map[string]interface{}) ([]Restore, error) {
+	var restores []Restore
+	query := conn.Model(&Restore{})
+	for key, value := range filters {
+		query = query.Where(fmt.Sprintf("%s = ?", key), value)
+	}
+	result := query.Order("started_at DESC").Find(&restores)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list restores: %w", result.Error)
+	}
+	return restores, nil
+}
+
+func CreateHook(conn *gorm.DB, obj *Hook) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create hook: %w", result.Error)
+	}
+	return nil
+}
+
+func UpdateHook(conn *gorm.DB, obj *Hook) error {
+	result := conn.Omit("Connection", "Schedule").Save(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update hook: %w", result.Error)
+	}
+	return nil
+}
+
+func GetHookByID(conn *gorm.DB, id string) (Hook, error) {
+	var hook Hook
+	result := conn.First(&hook, id)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return hook, fmt.Errorf("hook with id %s not found", id)
+		}
+		return hook, fmt.Errorf("failed to get hook: %w", result.Error)
+	}
+	return hook, nil
+}
+
+func ListHooks(conn *gorm.DB, filters map[string]interface{}) ([]Hook, error) {
+	var hooks []Hook
+	query := conn.Model(&Hook{})
+	for key, value := range filters {
+		query = query.Where(fmt.Sprintf("%s = ?", key), value)
+	}
+	result := query.Order("stage, position, id").Find(&hooks)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list hooks: %w", result.Error)
+	}
+	return hooks, nil
+}
+
+func DeleteHookByID(conn *gorm.DB, id string) error {
+	result := conn.Delete(&Hook{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete hook: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("hook with id %s not found", id)
+	}
+	return nil
+}
+
+func CreateAuditLog(conn *gorm.DB, obj *AuditLog) error {
+	result := conn.Create(obj)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create audit log: %w", result.Error)
+	}
+	return nil
+}
+
+func ListAuditLogs(conn *gorm.DB, filters map[string]interface{}, limit int) ([]AuditLog, error) {
+	var logs []AuditLog
+	query := conn.Model(&AuditLog{})
+	for key, value := range filters {
+		query = query.Where(fmt.Sprintf("%s = ?", key), value)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	result := query.Order("created_at DESC, id DESC").Find(&logs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list audit logs: %w", result.Error)
+	}
+	return logs, nil
+}
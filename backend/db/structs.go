@@ -4,10 +4,17 @@ import (
 	"time"
 )
 
+const (
+	RoleAdmin    = "admin"    // everything, including managing users and reading the audit log
+	RoleOperator = "operator" // everything but managing users, hooks and the declared configuration
+	RoleUser     = "user"     // taking, listing and checking backups, but not restoring, moving or deleting them or changing what they connect to
+)
+
 type User struct {
 	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
 	Username  string    `json:"username" gorm:"type:varchar(255);not null;uniqueIndex"`
 	Password  string    `json:"password" gorm:"type:varchar(255);not null"`
+	Role      string    `json:"role" gorm:"type:varchar(50);not null;default:'user'"`
 	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 }
@@ -16,6 +23,22 @@ func (User) TableName() string {
 	return "users"
 }
 
+// AuditLog records an access to sensitive data, such as a backup download.
+type AuditLog struct {
+	ID         uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	Username   string    `json:"username" gorm:"type:varchar(255);not null;index"`
+	Action     string    `json:"action" gorm:"type:varchar(100);not null;index"`
+	ResourceID string    `json:"resource_id,omitempty" gorm:"type:varchar(255)"`
+	Details    string    `json:"details,omitempty" gorm:"type:text"`
+	Status     string    `json:"status" gorm:"type:varchar(50);not null"` // allowed, denied or failed
+	ClientIP   string    `json:"client_ip,omitempty" gorm:"type:varchar(100)"`
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
+
 type Connection struct {
 	ID               uint      `json:"id" gorm:"primaryKey;autoIncrement"`
 	PostgresHost     string    `json:"postgres_host" gorm:"type:varchar(255);not null"`
@@ -23,6 +46,7 @@ type Connection struct {
 	PostgresDBName   string    `json:"postgres_db_name" gorm:"type:varchar(255);not null"`
 	PostgresUser     string    `json:"postgres_user" gorm:"type:varchar(255);not null"`
 	PostgresPassword string    `json:"postgres_password" gorm:"type:varchar(255);not null"`
+	ServerVersion    int       `json:"server_version,omitempty"` // server_version_num last seen, e.g. 170002
 	CreatedAt        time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt        time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 
@@ -58,15 +82,22 @@ func (Destination) TableName() string {
 }
 
 type BackupSchedule struct {
-	ID            uint       `json:"id" gorm:"primaryKey;autoIncrement"`
-	ConnectionID  uint       `json:"connection_id" gorm:"not null;index"`
-	DestinationID uint       `json:"destination_id" gorm:"not null;index"`
-	Schedule      string     `json:"schedule" gorm:"type:varchar(255);not null"` // Cron expression
-	Enabled       bool       `json:"enabled" gorm:"default:true;index"`
-	LastRun       *time.Time `json:"last_run,omitempty"`
-	NextRun       *time.Time `json:"next_run,omitempty" gorm:"index"`
-	CreatedAt     time.Time  `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt     time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+	ID                 uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ConnectionID       uint       `json:"connection_id" gorm:"not null;index"`
+	DestinationID      uint       `json:"destination_id" gorm:"not null;index"`
+	Schedule           string     `json:"schedule" gorm:"type:varchar(255);not null"` // Cron expression
+	BackupType         string     `json:"backup_type" gorm:"type:varchar(50);not null;default:'logical'"`
+	FullBackupEvery    int        `json:"full_backup_every" gorm:"default:0"`           // Incremental schedules take a full backup after this many incrementals, 0 = never
+	RetentionCount     int        `json:"retention_count" gorm:"default:0"`             // Most recent backups to keep, 0 = keep all
+	Options            string     `json:"options,omitempty" gorm:"type:text"`           // JSON encoded dump options for logical backups
+	VerifyConnectionID *uint      `json:"verify_connection_id,omitempty"`               // Sandbox connection each new backup is test-restored on
+	VerifyAssertions   string     `json:"verify_assertions,omitempty" gorm:"type:text"` // JSON list of SQL assertions checked after the test restore
+	CopyDestinations   string     `json:"copy_destinations,omitempty" gorm:"type:text"` // JSON list of further destinations every backup is copied to
+	Enabled            bool       `json:"enabled" gorm:"default:true;index"`
+	LastRun            *time.Time `json:"last_run,omitempty"`
+	NextRun            *time.Time `json:"next_run,omitempty" gorm:"index"`
+	CreatedAt          time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt          time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
 
 	Connection  Connection  `json:"connection,omitempty" gorm:"foreignKey:ConnectionID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
 	Destination Destination `json:"destination,omitempty" gorm:"foreignKey:DestinationID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
@@ -75,3 +106,183 @@ type BackupSchedule struct {
 func (BackupSchedule) TableName() string {
 	return "backup_schedules"
 }
+
+type Backup struct {
+	ID                 uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ConnectionID       uint       `json:"connection_id" gorm:"not null;index"`
+	DestinationID      *uint      `json:"destination_id,omitempty" gorm:"index"`
+	ScheduleID         *uint      `json:"schedule_id,omitempty" gorm:"index"`
+	DestinationType    string     `json:"destination_type" gorm:"type:varchar(50);not null"` // local or s3
+	BackupType         string     `json:"backup_type" gorm:"type:varchar(50);not null;default:'logical'"`
+	ParentBackupID     *uint      `json:"parent_backup_id,omitempty" gorm:"index"`  // previous backup of an incremental chain
+	Format             string     `json:"format,omitempty" gorm:"type:varchar(50)"` // pg_dump format of logical backups
+	Compression        string     `json:"compression,omitempty" gorm:"type:varchar(50)"`
+	Options            string     `json:"options,omitempty" gorm:"type:text"`             // JSON encoded dump options
+	TableStats         string     `json:"table_stats,omitempty" gorm:"type:text"`         // JSON table and row counts captured in the dump's snapshot
+	Verification       string     `json:"verification,omitempty" gorm:"type:varchar(50)"` // result of the latest restore verification
+	VerifiedAt         *time.Time `json:"verified_at,omitempty"`
+	Checksum           string     `json:"checksum,omitempty" gorm:"type:varchar(64)"`  // SHA-256 of the stored file
+	Integrity          string     `json:"integrity,omitempty" gorm:"type:varchar(50)"` // result of the latest checksum verification
+	IntegrityCheckedAt *time.Time `json:"integrity_checked_at,omitempty" gorm:"index"`
+	IntegrityError     string     `json:"integrity_error,omitempty" gorm:"type:text"`
+	Validation         string     `json:"validation,omitempty" gorm:"type:varchar(50);index"` // passed or failed, see pg_restore --list validation
+	ValidatedAt        *time.Time `json:"validated_at,omitempty"`
+	ValidationError    string     `json:"validation_error,omitempty" gorm:"type:text"`
+	ObjectCounts       string     `json:"object_counts,omitempty" gorm:"type:text"` // JSON object counts by type
+	Filename           string     `json:"filename" gorm:"type:varchar(500);not null;index"`
+	Status             string     `json:"status" gorm:"type:varchar(50);not null;index"`
+	SizeBytes          int64      `json:"size_bytes"`
+	WalTimeline        uint       `json:"wal_timeline,omitempty"`
+	WalStartLSN        string     `json:"wal_start_lsn,omitempty" gorm:"type:varchar(32)"`
+	WalEndLSN          string     `json:"wal_end_lsn,omitempty" gorm:"type:varchar(32)"`
+	Error              string     `json:"error,omitempty" gorm:"type:text"`
+	Log                string     `json:"log,omitempty" gorm:"type:text"` // output of the tools that created the backup
+	StartedAt          time.Time  `json:"started_at"`
+	FinishedAt         *time.Time `json:"finished_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt          time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Connection Connection   `json:"-" gorm:"foreignKey:ConnectionID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	Copies     []BackupCopy `json:"copies,omitempty" gorm:"foreignKey:BackupID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+}
+
+func (Backup) TableName() string {
+	return "backups"
+}
+
+// BackupCopy is a copy of a backup stored on another destination than the
+// one the backup was created on.
+type BackupCopy struct {
+	ID              uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	BackupID        uint      `json:"backup_id" gorm:"not null;index"`
+	DestinationType string    `json:"destination_type" gorm:"type:varchar(50);not null"` // local or s3
+	DestinationID   *uint     `json:"destination_id,omitempty" gorm:"index"`
+	Status          string    `json:"status" gorm:"type:varchar(50);not null;index"` // running, completed, failed or deleted
+	Error           string    `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt       time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt       time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (BackupCopy) TableName() string {
+	return "backup_copies"
+}
+
+type BackupVerification struct {
+	ID                  uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	BackupID            uint       `json:"backup_id" gorm:"not null;index"`
+	SandboxConnectionID uint       `json:"sandbox_connection_id" gorm:"not null;index"`
+	ScratchDatabase     string     `json:"scratch_database" gorm:"type:varchar(255);not null"`
+	Status              string     `json:"status" gorm:"type:varchar(50);not null;index"` // running, passed or failed
+	RestoreSeconds      float64    `json:"restore_seconds"`
+	Checks              string     `json:"checks,omitempty" gorm:"type:text"` // JSON encoded check results
+	Error               string     `json:"error,omitempty" gorm:"type:text"`
+	StartedAt           time.Time  `json:"started_at"`
+	FinishedAt          *time.Time `json:"finished_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt           time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Backup Backup `json:"-" gorm:"foreignKey:BackupID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+}
+
+func (BackupVerification) TableName() string {
+	return "backup_verifications"
+}
+
+type Restore struct {
+	ID                 uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ConnectionID       uint       `json:"connection_id" gorm:"not null;index"` // connection the backup belongs to
+	BackupID           *uint      `json:"backup_id,omitempty" gorm:"index"`
+	DestinationType    string     `json:"destination_type" gorm:"type:varchar(50);not null"`
+	Filename           string     `json:"filename" gorm:"type:varchar(500);not null"`
+	TargetConnectionID uint       `json:"target_connection_id" gorm:"not null;index"`
+	TargetDatabase     string     `json:"target_database" gorm:"type:varchar(255);not null"`
+	Status             string     `json:"status" gorm:"type:varchar(50);not null;index"`
+	SafetyBackupID     *uint      `json:"safety_backup_id,omitempty"`                           // backup of the target taken right before the restore
+	RollbackOfID       *uint      `json:"rollback_of_id,omitempty"`                             // restore this one rolled back
+	Phases             string     `json:"phases,omitempty" gorm:"type:text"`                    // JSON encoded per-phase timings
+	PreviousDatabase   string     `json:"previous_database,omitempty" gorm:"type:varchar(255)"` // database replaced by a staged restore, or by its rollback
+	DropPreviousAt     *time.Time `json:"drop_previous_at,omitempty"`
+	PreviousDroppedAt  *time.Time `json:"previous_dropped_at,omitempty"`
+	Log                string     `json:"log,omitempty" gorm:"type:text"`
+	Error              string     `json:"error,omitempty" gorm:"type:text"`
+	StartedAt          time.Time  `json:"started_at"`
+	FinishedAt         *time.Time `json:"finished_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt          time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Connection   Connection `json:"-" gorm:"foreignKey:ConnectionID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	SafetyBackup *Backup    `json:"safety_backup,omitempty" gorm:"foreignKey:SafetyBackupID;constraint:OnDelete:SET NULL,OnUpdate:CASCADE"`
+}
+
+func (Restore) TableName() string {
+	return "restores"
+}
+
+type WalStream struct {
+	ID             uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ConnectionID   uint       `json:"connection_id" gorm:"not null;uniqueIndex"`
+	DestinationID  *uint      `json:"destination_id,omitempty" gorm:"index"` // nil archives to the local filesystem
+	SlotName       string     `json:"slot_name" gorm:"type:varchar(63);not null"`
+	SegmentSize    int64      `json:"segment_size"`
+	Enabled        bool       `json:"enabled" gorm:"default:true"`
+	Status         string     `json:"status" gorm:"type:varchar(50)"`
+	Timeline       uint       `json:"timeline"`
+	LastSegment    string     `json:"last_segment" gorm:"type:varchar(64)"`
+	LastArchivedAt *time.Time `json:"last_archived_at,omitempty"`
+	Error          string     `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt      time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Connection  Connection   `json:"-" gorm:"foreignKey:ConnectionID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	Destination *Destination `json:"destination,omitempty" gorm:"foreignKey:DestinationID;constraint:OnDelete:SET NULL,OnUpdate:CASCADE"`
+}
+
+func (WalStream) TableName() string {
+	return "wal_streams"
+}
+
+// Hook is SQL, a local command or an HTTP call run before or after the
+// backups or restores of a connection, or only the backups of a schedule.
+type Hook struct {
+	ID             uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	ConnectionID   uint      `json:"connection_id" gorm:"not null;index"`
+	ScheduleID     *uint     `json:"schedule_id,omitempty" gorm:"index"`
+	Name           string    `json:"name" gorm:"type:varchar(255);not null"`
+	Stage          string    `json:"stage" gorm:"type:varchar(50);not null;index"` // pre_backup, post_backup, pre_restore or post_restore
+	Kind           string    `json:"kind" gorm:"type:varchar(50);not null"`        // sql, command or http
+	Command        string    `json:"command" gorm:"type:text;not null"`            // SQL, shell command or URL
+	TimeoutSeconds int       `json:"timeout_seconds" gorm:"default:60"`
+	AbortOnFailure bool      `json:"abort_on_failure"`
+	Position       int       `json:"position" gorm:"default:0"` // hooks of a stage run in ascending order
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt      time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Connection Connection      `json:"-" gorm:"foreignKey:ConnectionID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	Schedule   *BackupSchedule `json:"-" gorm:"foreignKey:ScheduleID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+}
+
+func (Hook) TableName() string {
+	return "hooks"
+}
+
+type WalSegment struct {
+	ID            uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	WalStreamID   uint      `json:"wal_stream_id" gorm:"not null;index"`
+	ConnectionID  uint      `json:"connection_id" gorm:"not null;index"`
+	DestinationID *uint     `json:"destination_id,omitempty"`
+	Name          string    `json:"name" gorm:"type:varchar(64);not null"` // WAL file name, e.g. 000000010000000000000003
+	Timeline      uint      `json:"timeline" gorm:"not null;index"`
+	StartLSN      string    `json:"start_lsn" gorm:"type:varchar(32)"`
+	Partial       bool      `json:"partial"`
+	History       bool      `json:"history"`
+	SizeBytes     int64     `json:"size_bytes"`
+	ArchivedAt    time.Time `json:"archived_at"`
+	CreatedAt     time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	WalStream WalStream `json:"-" gorm:"foreignKey:WalStreamID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+}
+
+func (WalSegment) TableName() string {
+	return "wal_segments"
+}
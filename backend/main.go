@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 	"pg_bckup_mgr/api/handlers"
 	m "pg_bckup_mgr/api/middleware"
 	backup_manager "pg_bckup_mgr/backup-manager"
@@ -20,7 +24,125 @@ func init() {
 	log.Println("Application Initialization Phase Complete!")
 }
 
+// reconcile runs "reconcile [-apply]": it rebuilds the catalog from the
+// metadata stored next to the backups, e.g. after the manager's database
+// was lost, and prints the report.
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "change the catalog, instead of only reporting what would change")
+	flags.Parse(args)
+
+	dbConn, err := db.Connect()
+	if err != nil {
+		log.Fatalln("Unable to connect to the database")
+	}
+	report, err := backup_manager.Reconcile(dbConn, *apply, nil)
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+	if err != nil {
+		log.Fatalf("Reconciliation finished with errors: %v", err)
+	}
+}
+
+// exportConfig runs "export-config -file <path>", with the passphrase in
+// CONFIG_PASSPHRASE.
+func exportConfig(args []string) {
+	flags := flag.NewFlagSet("export-config", flag.ExitOnError)
+	file := flags.String("file", "config-export.json", "file to write the export to")
+	flags.Parse(args)
+
+	dbConn, err := db.Connect()
+	if err != nil {
+		log.Fatalln("Unable to connect to the database")
+	}
+	export, err := backup_manager.ExportConfig(dbConn, os.Getenv("CONFIG_PASSPHRASE"))
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	data, _ := json.MarshalIndent(export, "", "  ")
+	if err := os.WriteFile(*file, data, 0600); err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	fmt.Printf("Configuration exported to %s\n", *file)
+}
+
+// importConfig runs "import-config -file <path>", with the passphrase in
+// CONFIG_PASSPHRASE.
+func importConfig(args []string) {
+	flags := flag.NewFlagSet("import-config", flag.ExitOnError)
+	file := flags.String("file", "config-export.json", "export to import")
+	flags.Parse(args)
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	dbConn, err := db.Connect()
+	if err != nil {
+		log.Fatalln("Unable to connect to the database")
+	}
+	report, err := backup_manager.ImportConfig(dbConn, data, os.Getenv("CONFIG_PASSPHRASE"))
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	data, _ = json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+}
+
+// applyConfig runs "apply-config -file <path> [-plan] [-prune [-force]]" and prints
+// the changes.
+func applyConfig(args []string) {
+	flags := flag.NewFlagSet("apply-config", flag.ExitOnError)
+	file := flags.String("file", "pg_bckup_mgr.yaml", "configuration file to apply")
+	planOnly := flags.Bool("plan", false, "only print the changes")
+	prune := flags.Bool("prune", false, "delete connections, destinations and schedules the file does not declare")
+	force := flags.Bool("force", false, "prune connections and destinations that still have backups")
+	flags.Parse(args)
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatalf("Apply failed: %v", err)
+	}
+	config, err := backup_manager.LoadDeclaredConfig(data)
+	if err != nil {
+		log.Fatalf("Apply failed: %v", err)
+	}
+	dbConn, err := db.Connect()
+	if err != nil {
+		log.Fatalln("Unable to connect to the database")
+	}
+
+	opts := backup_manager.ApplyOptions{Prune: *prune, Force: *force}
+	var plan backup_manager.ConfigPlan
+	if *planOnly {
+		plan, err = backup_manager.PlanConfig(dbConn, config, opts)
+	} else {
+		plan, err = backup_manager.ApplyConfig(dbConn, config, opts)
+	}
+	data, _ = json.MarshalIndent(plan, "", "  ")
+	fmt.Println(string(data))
+	if err != nil {
+		log.Fatalf("Apply failed, nothing was changed: %v", err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reconcile":
+			reconcile(os.Args[2:])
+			return
+		case "export-config":
+			exportConfig(os.Args[2:])
+			return
+		case "import-config":
+			importConfig(os.Args[2:])
+			return
+		case "apply-config":
+			applyConfig(os.Args[2:])
+			return
+		}
+	}
 
 	r := gin.Default()
 	r.Use(m.CORSMiddleware())
@@ -36,6 +158,21 @@ func main() {
 	backup_manager.RegisterBackupSchedules(dbConn)
 	log.Println("Backup schedules registered successfully!")
 
+	// Pick up schedules changed by the CLI or another instance
+	backup_manager.WatchBackupSchedules(dbConn)
+
+	// Resume continuous WAL archiving
+	backup_manager.StartWalStreams(dbConn)
+
+	// Drop databases replaced by staged restores after their grace period
+	backup_manager.StartRestoreJanitor(dbConn)
+
+	// Re-verify the checksums of stored backups
+	backup_manager.StartBackupScrubber(dbConn)
+
+	// Back up the manager's own database
+	backup_manager.StartSelfBackups(dbConn)
+
 	api.GET("/healthcheck", handlers.Healthcheck())
 
 	// User auth
@@ -44,33 +181,83 @@ func main() {
 	api.GET("/user/list", handlers.ListUsers(dbConn))
 
 	apiProtected := api.Use(m.AuthMiddleware())
+	operatorOnly := m.RequireRole(dbConn, db.RoleAdmin, db.RoleOperator)
+	adminOnly := m.RequireRole(dbConn, db.RoleAdmin)
 
 	// Backup endpoints
 	apiProtected.POST("/backup/create", handlers.CreateBackup(dbConn))
-	apiProtected.POST("/backup/restore", handlers.RestoreFromBackup(dbConn))
 	apiProtected.GET("/backup/list", handlers.ListBackups(dbConn))
-	apiProtected.DELETE("/backup/delete", handlers.DeleteBackup(dbConn))
+	apiProtected.GET("/backup/catalog", handlers.ListBackupCatalog(dbConn))
+	apiProtected.GET("/backup/contents", handlers.ListBackupContents(dbConn))
+	apiProtected.POST("/backup/verify", operatorOnly, handlers.Audited(dbConn, "backup.verify"), handlers.VerifyBackup(dbConn))
+	apiProtected.GET("/backup/verifications", handlers.ListBackupVerifications(dbConn))
+	apiProtected.POST("/backup/scrub", handlers.ScrubBackup(dbConn))
+	apiProtected.POST("/backup/validate", handlers.ValidateBackup(dbConn))
+	apiProtected.GET("/restores/list", handlers.ListRestores(dbConn))
+	apiProtected.POST("/restores/rollback", operatorOnly, handlers.Audited(dbConn, "restore.rollback"), handlers.RollbackRestore(dbConn))
+	apiProtected.DELETE("/backup/delete", operatorOnly, handlers.Audited(dbConn, "backup.delete"), handlers.DeleteBackup(dbConn))
+
+	// Endpoints moving backups in or out of the manager, or pointing it at
+	// other servers, restricted to operators and audited
+	apiProtected.GET("/backup/download", operatorOnly, handlers.DownloadBackup(dbConn))
+	apiProtected.HEAD("/backup/download", operatorOnly, handlers.DownloadBackup(dbConn))
+	apiProtected.POST("/backup/presign", operatorOnly, handlers.PresignBackup(dbConn))
+	apiProtected.POST("/backup/restore", operatorOnly, handlers.Audited(dbConn, "backup.restore"), handlers.RestoreFromBackup(dbConn))
+	apiProtected.POST("/backup/restore/physical", operatorOnly, handlers.Audited(dbConn, "backup.restore_physical"), handlers.RestorePhysicalBackup(dbConn))
+	apiProtected.POST("/backup/transfer", operatorOnly, handlers.Audited(dbConn, "backup.transfer"), handlers.TransferBackups(dbConn))
+	apiProtected.POST("/backup/upload", operatorOnly, handlers.Audited(dbConn, "backup.upload"), handlers.UploadBackup(dbConn))
+	apiProtected.POST("/backup/adopt", operatorOnly, handlers.Audited(dbConn, "backup.adopt"), handlers.AdoptBackups(dbConn))
+
+	// Administration endpoints
+	apiProtected.PUT("/user/role", adminOnly, handlers.UpdateUserRole(dbConn))
+	apiProtected.GET("/audit/list", adminOnly, handlers.ListAuditLogs(dbConn))
+	apiProtected.POST("/catalog/reconcile", adminOnly, handlers.ReconcileCatalog(dbConn))
+	apiProtected.POST("/config/export", adminOnly, handlers.ExportConfig(dbConn))
+	apiProtected.POST("/config/import", adminOnly, handlers.ImportConfig(dbConn))
+	apiProtected.POST("/config/apply", adminOnly, handlers.ApplyConfig(dbConn))
+	apiProtected.POST("/manager/backup", adminOnly, handlers.CreateSelfBackup(dbConn))
+	apiProtected.GET("/manager/backups", adminOnly, handlers.ListSelfBackups(dbConn))
+
+	// Job endpoints, for backups and restores running in the background
+	apiProtected.GET("/jobs/list", handlers.ListJobs())
+	apiProtected.GET("/jobs/get", handlers.GetJob())
+	apiProtected.GET("/jobs/stream", handlers.StreamJob())
 
 	// Backup destination endpoints
-	apiProtected.POST("/backup-destinations/s3/create", handlers.CreateBackupDestination(dbConn))
+	apiProtected.POST("/backup-destinations/s3/create", operatorOnly, handlers.Audited(dbConn, "destination.create"), handlers.CreateBackupDestination(dbConn))
 	apiProtected.GET("/backup-destinations/s3/list", handlers.ListAllBackupDestinations(dbConn))
-	apiProtected.PUT("/backup-destinations/s3/update", handlers.UpdateBackupDestination(dbConn))
-	apiProtected.DELETE("/backup-destinations/s3/delete", handlers.DeleteBackupDestination(dbConn))
+	apiProtected.PUT("/backup-destinations/s3/update", operatorOnly, handlers.Audited(dbConn, "destination.update"), handlers.UpdateBackupDestination(dbConn))
+	apiProtected.DELETE("/backup-destinations/s3/delete", operatorOnly, handlers.Audited(dbConn, "destination.delete"), handlers.DeleteBackupDestination(dbConn))
+
+	// WAL archiving and point-in-time recovery endpoints
+	apiProtected.POST("/wal/streams/create", operatorOnly, handlers.Audited(dbConn, "wal_stream.create"), handlers.CreateWalStream(dbConn))
+	apiProtected.GET("/wal/streams/list", handlers.ListWalStreams(dbConn))
+	apiProtected.POST("/wal/streams/start", operatorOnly, handlers.Audited(dbConn, "wal_stream.start"), handlers.StartWalStream(dbConn))
+	apiProtected.POST("/wal/streams/stop", operatorOnly, handlers.Audited(dbConn, "wal_stream.stop"), handlers.StopWalStream(dbConn))
+	apiProtected.DELETE("/wal/streams/delete", operatorOnly, handlers.Audited(dbConn, "wal_stream.delete"), handlers.DeleteWalStream(dbConn))
+	apiProtected.GET("/wal/segments/list", handlers.ListWalSegments(dbConn))
+	apiProtected.POST("/wal/restore", operatorOnly, handlers.Audited(dbConn, "wal.restore"), handlers.PointInTimeRecovery(dbConn))
+
+	// Hook endpoints, hooks run on the manager so only admins define them
+	apiProtected.POST("/hooks/create", adminOnly, handlers.CreateHook(dbConn))
+	apiProtected.GET("/hooks/list", adminOnly, handlers.ListHooks(dbConn))
+	apiProtected.PUT("/hooks/update", adminOnly, handlers.UpdateHook(dbConn))
+	apiProtected.DELETE("/hooks/delete", adminOnly, handlers.DeleteHook(dbConn))
 
 	// Connection endpoints
-	apiProtected.POST("/connections/create", handlers.CreateConnection(dbConn))
+	apiProtected.POST("/connections/create", operatorOnly, handlers.Audited(dbConn, "connection.create"), handlers.CreateConnection(dbConn))
 	apiProtected.GET("/connections/list", handlers.ListConnections(dbConn))
-	apiProtected.PUT("/connections/update", handlers.UpdateConnection(dbConn))
-	apiProtected.DELETE("/connections/delete", handlers.DeleteConnection(dbConn))
+	apiProtected.PUT("/connections/update", operatorOnly, handlers.Audited(dbConn, "connection.update"), handlers.UpdateConnection(dbConn))
+	apiProtected.DELETE("/connections/delete", operatorOnly, handlers.Audited(dbConn, "connection.delete"), handlers.DeleteConnection(dbConn))
 
 	// Backup schedule endpoints
-	apiProtected.POST("/schedules/create", handlers.CreateSchedule(dbConn))
+	apiProtected.POST("/schedules/create", operatorOnly, handlers.Audited(dbConn, "schedule.create"), handlers.CreateSchedule(dbConn))
 	apiProtected.GET("/schedules/list", handlers.ListSchedules(dbConn))
 	apiProtected.GET("/schedules/get", handlers.GetSchedule(dbConn))
-	apiProtected.PUT("/schedules/update", handlers.UpdateSchedule(dbConn))
-	apiProtected.DELETE("/schedules/delete", handlers.DeleteSchedule(dbConn))
-	apiProtected.POST("/schedules/enable", handlers.EnableSchedule(dbConn))
-	apiProtected.POST("/schedules/disable", handlers.DisableSchedule(dbConn))
+	apiProtected.PUT("/schedules/update", operatorOnly, handlers.Audited(dbConn, "schedule.update"), handlers.UpdateSchedule(dbConn))
+	apiProtected.DELETE("/schedules/delete", operatorOnly, handlers.Audited(dbConn, "schedule.delete"), handlers.DeleteSchedule(dbConn))
+	apiProtected.POST("/schedules/enable", operatorOnly, handlers.Audited(dbConn, "schedule.enable"), handlers.EnableSchedule(dbConn))
+	apiProtected.POST("/schedules/disable", operatorOnly, handlers.Audited(dbConn, "schedule.disable"), handlers.DisableSchedule(dbConn))
 
 	log.Println("🚀 Application Startup Complete! 🚀")
 	r.Run(":8080")
@@ -5,6 +5,7 @@ CREATE TABLE connections (
     postgres_db_name VARCHAR(255) NOT NULL,
     postgres_user VARCHAR(255) NOT NULL,
     postgres_password VARCHAR(255) NOT NULL,
+    server_version INTEGER,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(postgres_host, postgres_port, postgres_db_name)
@@ -60,6 +61,13 @@ CREATE TABLE backup_schedules (
     connection_id INTEGER NOT NULL,
     destination_id INTEGER NOT NULL,
     schedule VARCHAR(255) NOT NULL,
+    backup_type VARCHAR(50) NOT NULL DEFAULT 'logical',
+    full_backup_every INTEGER DEFAULT 0,
+    retention_count INTEGER DEFAULT 0,
+    options TEXT,
+    verify_connection_id INTEGER,
+    verify_assertions TEXT,
+    copy_destinations TEXT,
     enabled BOOLEAN DEFAULT TRUE,
     last_run TIMESTAMP,
     next_run TIMESTAMP,
@@ -88,11 +96,250 @@ CREATE TRIGGER update_backup_schedules_updated_at
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
 
+CREATE TABLE backups (
+    id SERIAL PRIMARY KEY,
+    connection_id INTEGER NOT NULL,
+    destination_id INTEGER,
+    schedule_id INTEGER,
+    destination_type VARCHAR(50) NOT NULL,
+    backup_type VARCHAR(50) NOT NULL DEFAULT 'logical',
+    parent_backup_id INTEGER,
+    format VARCHAR(50),
+    compression VARCHAR(50),
+    options TEXT,
+    table_stats TEXT,
+    verification VARCHAR(50),
+    verified_at TIMESTAMP,
+    checksum VARCHAR(64),
+    integrity VARCHAR(50),
+    integrity_checked_at TIMESTAMP,
+    integrity_error TEXT,
+    validation VARCHAR(50),
+    validated_at TIMESTAMP,
+    validation_error TEXT,
+    object_counts TEXT,
+    log TEXT,
+    filename VARCHAR(500) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    size_bytes BIGINT,
+    wal_timeline INTEGER,
+    wal_start_lsn VARCHAR(32),
+    wal_end_lsn VARCHAR(32),
+    error TEXT,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_backups_connection 
+        FOREIGN KEY (connection_id) 
+        REFERENCES connections(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_backups_integrity_checked_at ON backups(integrity_checked_at);
+CREATE INDEX idx_backups_connection_id ON backups(connection_id);
+CREATE INDEX idx_backups_destination_id ON backups(destination_id);
+CREATE INDEX idx_backups_schedule_id ON backups(schedule_id);
+CREATE INDEX idx_backups_parent_backup_id ON backups(parent_backup_id);
+CREATE INDEX idx_backups_filename ON backups(filename);
+CREATE INDEX idx_backups_status ON backups(status);
+CREATE INDEX idx_backups_validation ON backups(validation);
+
+CREATE TRIGGER update_backups_updated_at 
+    BEFORE UPDATE ON backups 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE backup_copies (
+    id SERIAL PRIMARY KEY,
+    backup_id INTEGER NOT NULL,
+    destination_type VARCHAR(50) NOT NULL,
+    destination_id INTEGER,
+    status VARCHAR(50) NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_backup_copies_backup 
+        FOREIGN KEY (backup_id) 
+        REFERENCES backups(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_backup_copies_backup_id ON backup_copies(backup_id);
+CREATE INDEX idx_backup_copies_destination_id ON backup_copies(destination_id);
+CREATE INDEX idx_backup_copies_status ON backup_copies(status);
+
+CREATE TRIGGER update_backup_copies_updated_at 
+    BEFORE UPDATE ON backup_copies 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE backup_verifications (
+    id SERIAL PRIMARY KEY,
+    backup_id INTEGER NOT NULL,
+    sandbox_connection_id INTEGER NOT NULL,
+    scratch_database VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    restore_seconds DOUBLE PRECISION,
+    checks TEXT,
+    error TEXT,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_backup_verifications_backup 
+        FOREIGN KEY (backup_id) 
+        REFERENCES backups(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_backup_verifications_backup_id ON backup_verifications(backup_id);
+CREATE INDEX idx_backup_verifications_sandbox_connection_id ON backup_verifications(sandbox_connection_id);
+CREATE INDEX idx_backup_verifications_status ON backup_verifications(status);
+
+CREATE TRIGGER update_backup_verifications_updated_at 
+    BEFORE UPDATE ON backup_verifications 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE restores (
+    id SERIAL PRIMARY KEY,
+    connection_id INTEGER NOT NULL,
+    backup_id INTEGER,
+    destination_type VARCHAR(50) NOT NULL,
+    filename VARCHAR(500) NOT NULL,
+    target_connection_id INTEGER NOT NULL,
+    target_database VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    safety_backup_id INTEGER,
+    rollback_of_id INTEGER,
+    phases TEXT,
+    previous_database VARCHAR(255),
+    drop_previous_at TIMESTAMP,
+    previous_dropped_at TIMESTAMP,
+    log TEXT,
+    error TEXT,
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_restores_connection 
+        FOREIGN KEY (connection_id) 
+        REFERENCES connections(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE,
+    CONSTRAINT fk_restores_safety_backup 
+        FOREIGN KEY (safety_backup_id) 
+        REFERENCES backups(id) 
+        ON DELETE SET NULL 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_restores_connection_id ON restores(connection_id);
+CREATE INDEX idx_restores_backup_id ON restores(backup_id);
+CREATE INDEX idx_restores_target_connection_id ON restores(target_connection_id);
+CREATE INDEX idx_restores_status ON restores(status);
+
+CREATE TRIGGER update_restores_updated_at 
+    BEFORE UPDATE ON restores 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE wal_streams (
+    id SERIAL PRIMARY KEY,
+    connection_id INTEGER NOT NULL UNIQUE,
+    destination_id INTEGER,
+    slot_name VARCHAR(63) NOT NULL,
+    segment_size BIGINT,
+    enabled BOOLEAN DEFAULT TRUE,
+    status VARCHAR(50),
+    timeline INTEGER,
+    last_segment VARCHAR(64),
+    last_archived_at TIMESTAMP,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_wal_streams_connection 
+        FOREIGN KEY (connection_id) 
+        REFERENCES connections(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE,
+    CONSTRAINT fk_wal_streams_destination 
+        FOREIGN KEY (destination_id) 
+        REFERENCES destinations(id) 
+        ON DELETE SET NULL 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_wal_streams_destination_id ON wal_streams(destination_id);
+
+CREATE TRIGGER update_wal_streams_updated_at 
+    BEFORE UPDATE ON wal_streams 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE wal_segments (
+    id SERIAL PRIMARY KEY,
+    wal_stream_id INTEGER NOT NULL,
+    connection_id INTEGER NOT NULL,
+    destination_id INTEGER,
+    name VARCHAR(64) NOT NULL,
+    timeline INTEGER NOT NULL,
+    start_lsn VARCHAR(32),
+    partial BOOLEAN DEFAULT FALSE,
+    history BOOLEAN DEFAULT FALSE,
+    size_bytes BIGINT,
+    archived_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_wal_segments_wal_stream 
+        FOREIGN KEY (wal_stream_id) 
+        REFERENCES wal_streams(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_wal_segments_wal_stream_id ON wal_segments(wal_stream_id);
+CREATE INDEX idx_wal_segments_connection_id ON wal_segments(connection_id);
+CREATE INDEX idx_wal_segments_timeline ON wal_segments(timeline);
+
+CREATE TABLE hooks (
+    id SERIAL PRIMARY KEY,
+    connection_id INTEGER NOT NULL,
+    schedule_id INTEGER,
+    name VARCHAR(255) NOT NULL,
+    stage VARCHAR(50) NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    command TEXT NOT NULL,
+    timeout_seconds INTEGER DEFAULT 60,
+    abort_on_failure BOOLEAN DEFAULT TRUE,
+    position INTEGER DEFAULT 0,
+    enabled BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_hooks_connection 
+        FOREIGN KEY (connection_id) 
+        REFERENCES connections(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE,
+    CONSTRAINT fk_hooks_schedule 
+        FOREIGN KEY (schedule_id) 
+        REFERENCES backup_schedules(id) 
+        ON DELETE CASCADE 
+        ON UPDATE CASCADE
+);
+
+CREATE INDEX idx_hooks_connection_id ON hooks(connection_id);
+CREATE INDEX idx_hooks_schedule_id ON hooks(schedule_id);
+CREATE INDEX idx_hooks_stage ON hooks(stage);
+
+CREATE TRIGGER update_hooks_updated_at 
+    BEFORE UPDATE ON hooks 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
 
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL DEFAULT 'user',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -102,3 +349,18 @@ CREATE INDEX idx_users_username ON users(username);
 CREATE TRIGGER update_users_updated_at 
     BEFORE UPDATE ON users 
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE audit_logs (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    action VARCHAR(100) NOT NULL,
+    resource_id VARCHAR(255),
+    details TEXT,
+    status VARCHAR(50) NOT NULL,
+    client_ip VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_logs_username ON audit_logs(username);
+CREATE INDEX idx_audit_logs_action ON audit_logs(action);
+CREATE INDEX idx_audit_logs_created_at ON audit_logs(created_at);